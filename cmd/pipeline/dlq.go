@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"pg-to-es/internal/business"
+	"pg-to-es/internal/contract"
+
+	"github.com/ardanlabs/conf/v2"
+)
+
+// deadLetterCommand runs `dlq list`, printing every dead letter as a JSON line, or
+// `dlq replay [id...]`, replaying the dead letters of ids or every one when none is given
+func deadLetterCommand(ctx context.Context, args conf.Args, es contract.Elastic, index string, documents contract.Documents,
+	deadLetters contract.DeadLetters, logger *slog.Logger) error {
+	switch args.Num(1) {
+	case "", "list":
+		letters, err := deadLetters.List(ctx)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		for _, letter := range letters {
+			err = enc.Encode(letter)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "replay":
+		var ids []int64
+		for _, arg := range args[2:] {
+			id, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid dead letter id '%s'", arg)
+			}
+			ids = append(ids, id)
+		}
+		replayed, err := business.ReplayDeadLetters(ctx, es, index, documents, deadLetters, ids...)
+		logger.Info("replayed dead letters", "dead_letters", replayed)
+		return err
+	default:
+		return fmt.Errorf("unknown dlq command '%s', use list or replay", args.Num(1))
+	}
+}
@@ -2,18 +2,34 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"pg-to-es/internal/business"
 	"pg-to-es/internal/config"
+	"pg-to-es/internal/contract"
 	"pg-to-es/internal/db"
+	"pg-to-es/internal/logging"
+	"pg-to-es/internal/mapping"
 	"pg-to-es/internal/service"
+	"pg-to-es/internal/tracing"
 )
 
 func main() {
+	err := run()
+	if err != nil {
+		slog.Error("pipeline failed", logging.Err(err))
+		os.Exit(1)
+	}
+}
+
+// run runs the command given, returning once it is done or interrupted, after every resource is released
+func run() error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -24,34 +40,334 @@ func main() {
 	// Initialize Config
 	cfg, err := config.Load()
 	if err != nil {
-		log.Fatalln("config.Load() failed, err:", err.Error())
+		return fmt.Errorf("config.Load() failed, err: %w", err)
 	}
 
+	// Initialize Logger, the standard logger & main write through it too
+	logger, err := logging.New(cfg.Log, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("logging.New() failed, err: %w", err)
+	}
+	slog.SetDefault(logger)
+
+	// Load Mapping, documents are rebuilt as per it unless changes carry the legacy payload
+	var (
+		m *mapping.Mapping
+		// tables the mapping refers to, streamed raw by the replication listener
+		tables []string
+	)
+	events := cfg.Pipeline.Events
+	if cfg.Pipeline.Mapping != "" {
+		m, err = mapping.Load(cfg.Pipeline.Mapping)
+		if events == "" {
+			events = config.EventsRows
+		}
+	} else if events == config.EventsRows || events == config.EventsKeys {
+		m = mapping.Users()
+	}
+	switch {
+	case err != nil:
+	case events == "":
+		events = config.EventsPayload
+	case events == config.EventsPayload && m != nil:
+		err = fmt.Errorf("mapping requires events '%s' or '%s'", config.EventsRows, config.EventsKeys)
+	case events != config.EventsPayload && events != config.EventsRows && events != config.EventsKeys:
+		err = fmt.Errorf("unknown events '%s'", events)
+	}
+	if err == nil && m != nil && cfg.Pg.ListenerMode == config.ListenerModeOutbox {
+		err = fmt.Errorf("events '%s' are not supported in listener mode '%s'", events, config.ListenerModeOutbox)
+	}
+	if err != nil {
+		return fmt.Errorf("mapping initialization failed, err: %w", err)
+	}
+	if m != nil {
+		tables = m.Tables()
+	}
+
+	command := cfg.Args.Num(0)
+	if command == "gen-triggers" {
+		err = generateTriggersCommand(ctx, cfg.Args, cfg.Pg, events, tables)
+		if err != nil {
+			return fmt.Errorf("gen-triggers failed, err: %w", err)
+		}
+		return nil
+	}
+
+	// Export spans, the ones left are flushed on exit
+	shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing, "pg-to-es-pipeline")
+	if err != nil {
+		return fmt.Errorf("tracing.Setup() failed, err: %w", err)
+	}
+	defer shutdownTracing(ctx)
+
 	// Initialize Elasticsearch Service
-	esSvc, err := service.NewElastic(cfg.Es)
+	esSvc, err := service.NewElastic(cfg.Es, logger)
 	if err != nil {
-		log.Fatalf("elasticsearch.New() failed, err: %s", err)
+		return fmt.Errorf("elasticsearch.New() failed, err: %w", err)
+	}
+
+	// Bootstrap Index, failing on mappings not matching unless reindexing, left to the pipeline when publishing
+	if command != "reindex" && command != "publish" {
+		indexDefinition, err := service.IndexDefinition(cfg.Es.IndexMapping)
+		if err == nil {
+			err = esSvc.EnsureIndex(ctx, cfg.Es.Index, cfg.Es.WriteIndex(), indexDefinition)
+		}
+		if err != nil {
+			return fmt.Errorf("index bootstrap failed, err: %w", err)
+		}
 	}
 
 	// Run Migrations
 	err = db.Migrate(cfg.Pg)
 	if err != nil {
-		log.Fatalf("b.Migrate() failed, err: %s", err)
+		return fmt.Errorf("b.Migrate() failed, err: %w", err)
+	}
+
+	// Initialize Dead Letter Store
+	var deadLetters contract.DeadLetters
+	switch cfg.Pipeline.DeadLetterStore {
+	case config.DeadLetterStorePostgres:
+		deadLetters, err = service.NewPgDeadLetters(ctx, cfg.Pg)
+	case config.DeadLetterStoreFile:
+		deadLetters = service.NewFileDeadLetters(cfg.Pipeline.DeadLetterFile)
+	default:
+		err = fmt.Errorf("unknown dead letter store '%s'", cfg.Pipeline.DeadLetterStore)
+	}
+	if err != nil {
+		return fmt.Errorf("dead letter store initialization failed, err: %w", err)
 	}
 
-	// Initiate DB Listener Service
-	dbListenerSvc, err := service.NewDbListener(cfg.Pg)
+	// Initialize Documents Service, built as per the mapping if any
+	var documents interface {
+		contract.Documents
+		Close() error
+	}
+	if m != nil {
+		documents, err = service.NewMappedDocuments(ctx, cfg.Pg, m)
+	} else {
+		documents, err = service.NewPgDocuments(cfg.Pg)
+	}
 	if err != nil {
-		log.Fatalf("db.NewListener() failed, err: %s", err)
+		return fmt.Errorf("documents initialization failed, err: %w", err)
+	}
+	defer documents.Close()
+
+	if command == "dlq" {
+		err = deadLetterCommand(ctx, cfg.Args, esSvc, cfg.Es.WriteIndex(), documents, deadLetters, logger)
+		if err != nil {
+			return fmt.Errorf("dlq %s failed, err: %w", cfg.Args.Num(1), err)
+		}
+		return nil
+	}
+
+	if command == "verify" {
+		err = verifyCommand(ctx, cfg.Args, esSvc, cfg.Es.WriteIndex(), documents, cfg.Pipeline.BackfillBatch, logger)
+		if err != nil {
+			return fmt.Errorf("verify failed, err: %w", err)
+		}
+		return nil
+	}
+
+	if command == "reindex" {
+		err = reindexCommand(ctx, cfg.Args, esSvc, documents, cfg.Es, cfg.Pipeline.BackfillBatch, logger)
+		if err != nil {
+			return fmt.Errorf("reindex failed, err: %w", err)
+		}
+		return nil
+	}
+
+	// Initialize Event Bus, carrying deltas from the listener to the pipeline
+	var bus contract.EventBus
+	switch cfg.Bus.Mode {
+	case "":
+		if command == "publish" {
+			err = fmt.Errorf("publish requires bus mode '%s'", config.BusModeNats)
+		}
+	case config.BusModeMemory:
+		bus = service.NewMemoryBus()
+		if command == "publish" {
+			err = fmt.Errorf("publish requires bus mode '%s'", config.BusModeNats)
+		}
+	case config.BusModeNats:
+		bus, err = service.NewNatsBus(ctx, cfg.Bus, logger)
+	default:
+		err = fmt.Errorf("unknown bus mode '%s'", cfg.Bus.Mode)
+	}
+	if err != nil {
+		return fmt.Errorf("event bus initialization failed, err: %w", err)
+	}
+	if bus != nil {
+		defer bus.Close()
+	}
+
+	// Serve Health & Readiness, of standbys as well, failing the pipeline if it can not
+	failed := make(chan error, 1)
+	admin := business.NewAdmin(esSvc, cfg.Pipeline.AdminPort)
+	if cfg.Pipeline.AdminPort != 0 {
+		admin.InitRoutes()
+		go func() {
+			logger.Info("admin server listening", "port", cfg.Pipeline.AdminPort)
+			err := admin.Start()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				failed <- fmt.Errorf("admin.Start() failed, err: %w", err)
+			}
+		}()
+		defer admin.Shutdown(ctx)
+	}
+
+	// Elect a Leader, standbys wait for it to step down before listening
+	var lost <-chan struct{}
+	if cfg.Pipeline.LeaderName != "" {
+		name := cfg.Pipeline.LeaderName
+		if command == "publish" {
+			// publishers are elected apart from the pipelines consuming what they publish
+			name += "_publish"
+		}
+		leader, err := service.NewPgLeader(cfg.Pg, name, cfg.Pipeline.LeaderInterval, logger)
+		if err != nil {
+			return fmt.Errorf("service.NewPgLeader() failed, err: %w", err)
+		}
+		defer leader.Close()
+		admin.SetLeader(leader)
+		campaignCtx, cancelCampaign := context.WithCancel(ctx)
+		campaigned := make(chan error, 1)
+		go func() { campaigned <- leader.Campaign(campaignCtx) }()
+		select {
+		case err = <-campaigned:
+			cancelCampaign()
+		case <-interruptStream:
+			cancelCampaign()
+			<-campaigned
+			logger.Info("pipeline interrupted!")
+			return nil
+		case err = <-failed:
+			cancelCampaign()
+			<-campaigned
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("leader.Campaign() failed, err: %w", err)
+		}
+		lost = leader.Lost()
+	}
+
+	// Initiate DB Listener Service, the pipeline consumes from a NATS bus rather than listening itself
+	var dbListenerSvc contract.DbListener
+	switch {
+	case cfg.Bus.Mode == config.BusModeNats && command != "publish":
+	case cfg.Pg.ListenerMode == config.ListenerModeNotify:
+		err = db.InstallNotify(ctx, cfg.Pg, events, tables)
+		if err == nil {
+			dbListenerSvc, err = service.NewDbListener(cfg.Pg, logger)
+		}
+	case cfg.Pg.ListenerMode == config.ListenerModeReplication:
+		dbListenerSvc, err = service.NewReplicationListener(cfg.Pg, tables, logger)
+	case cfg.Pg.ListenerMode == config.ListenerModeOutbox:
+		err = db.InstallOutbox(ctx, cfg.Pg)
+		if err == nil {
+			dbListenerSvc, err = service.NewOutboxListener(cfg.Pg, logger)
+		}
+	default:
+		err = fmt.Errorf("unknown listener mode '%s'", cfg.Pg.ListenerMode)
+	}
+	if err != nil {
+		return fmt.Errorf("db.NewListener() failed, err: %w", err)
+	}
+
+	// Buffer Deltas on disk, ahead of indexing
+	if dbListenerSvc != nil && cfg.Pipeline.QueueDir != "" {
+		queue, err := service.OpenDiskQueue(cfg.Pipeline.QueueDir, cfg.Pipeline.QueueSegmentBytes, logger)
+		if err != nil {
+			return fmt.Errorf("service.OpenDiskQueue() failed, err: %w", err)
+		}
+		defer queue.Close()
+		dbListenerSvc = service.NewQueuedListener(dbListenerSvc, queue, logger)
+	}
+
+	// Publish Deltas to the bus, for the pipeline to consume them apart
+	if command == "publish" {
+		admin.SetListener(dbListenerSvc)
+		relayed := make(chan error, 1)
+		go func() { relayed <- service.Relay(ctx, dbListenerSvc, bus, logger) }()
+		logger.Info("pipeline publishing")
+		defer dbListenerSvc.Stop()
+		select {
+		case err = <-relayed:
+			if err != nil {
+				return fmt.Errorf("service.Relay() failed, err: %w", err)
+			}
+		case <-interruptStream:
+			logger.Info("pipeline interrupted!")
+		case err = <-failed:
+			return err
+		case <-lost:
+			logger.Error("leadership lost, publisher stepping down")
+			cancel()
+			return errors.New("leadership lost")
+		}
+		return nil
+	}
+	switch cfg.Bus.Mode {
+	case config.BusModeMemory:
+		listener := dbListenerSvc
+		go func() {
+			err := service.Relay(ctx, listener, bus, logger)
+			if err != nil {
+				logger.Error("service.Relay() failed", logging.Err(err))
+			}
+		}()
+		defer listener.Stop()
+		dbListenerSvc = service.NewBusListener(bus, logger)
+	case config.BusModeNats:
+		dbListenerSvc = service.NewBusListener(bus, logger)
+	}
+
+	// Initialize Checkpoint Store
+	var checkpoint contract.Checkpoint
+	switch cfg.Pipeline.CheckpointStore {
+	case config.CheckpointStorePostgres:
+		checkpoint, err = service.NewPgCheckpoint(ctx, cfg.Pg, cfg.Pipeline.CheckpointName)
+	case config.CheckpointStoreFile:
+		checkpoint = service.NewFileCheckpoint(cfg.Pipeline.CheckpointFile)
+	default:
+		err = fmt.Errorf("unknown checkpoint store '%s'", cfg.Pipeline.CheckpointStore)
+	}
+	if err != nil {
+		return fmt.Errorf("checkpoint initialization failed, err: %w", err)
 	}
 
 	// Initialize & run pipeline
-	psToEsPipeline := business.NewPipeline(dbListenerSvc, esSvc, cfg.Es.Index)
-	psToEsPipeline.Start(ctx)
+	psToEsPipeline := business.NewPipeline(dbListenerSvc, esSvc, checkpoint, deadLetters, documents, cfg.Es.WriteIndex(), cfg.Pipeline, logger)
+	admin.SetListener(dbListenerSvc)
+	admin.SetPipeline(psToEsPipeline)
+	switch command {
+	case "", "sync":
+		err = psToEsPipeline.Start(ctx)
+		if err != nil {
+			return fmt.Errorf("pipeline.Start() failed, err: %w", err)
+		}
+	case "backfill":
+		err = psToEsPipeline.Backfill(ctx)
+		if err != nil {
+			return fmt.Errorf("pipeline.Backfill() failed, err: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown command '%s', use sync, backfill, publish, verify, reindex, dlq or gen-triggers", command)
+	}
 	defer psToEsPipeline.Stop()
 
-	log.Println("pipeline syncing")
-	// Await interruptions
-	<-interruptStream
-	log.Println("pipeline interrupted!")
+	logger.Info("pipeline syncing")
+	// Await interruptions, or the loss of leadership, for the process to be restarted as a standby once
+	// everything is released
+	select {
+	case <-interruptStream:
+		logger.Info("pipeline interrupted!")
+	case err = <-failed:
+		return err
+	case <-lost:
+		logger.Error("leadership lost, pipeline stepping down")
+		cancel()
+		return errors.New("leadership lost")
+	}
+	return nil
 }
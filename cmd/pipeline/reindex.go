@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"pg-to-es/internal/business"
+	"pg-to-es/internal/config"
+	"pg-to-es/internal/contract"
+	"pg-to-es/internal/service"
+
+	"github.com/ardanlabs/conf/v2"
+)
+
+// reindexCommand runs `reindex [postgres|index]`, building the next version of the index from postgres
+// (default) or from the index in use, and pointing the aliases to it once caught up
+func reindexCommand(ctx context.Context, args conf.Args, es *service.Elastic, documents contract.Documents,
+	cfg config.Es, batchSize int, logger *slog.Logger) error {
+	source := args.Num(1)
+	if source == "" {
+		source = business.ReindexFromPostgres
+	}
+	definition, err := service.IndexDefinition(cfg.IndexMapping)
+	if err != nil {
+		return err
+	}
+	index, err := business.Reindex(ctx, es, es, documents, cfg.Index, cfg.WriteIndex(), definition, source, batchSize, logger)
+	if err != nil {
+		return err
+	}
+	logger.Info("reindexed", "index", index)
+	return nil
+}
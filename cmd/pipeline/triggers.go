@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"pg-to-es/internal/config"
+	"pg-to-es/internal/db"
+
+	"github.com/ardanlabs/conf/v2"
+)
+
+// generateTriggersCommand runs `gen-triggers`, printing the SQL of the notify function & triggers,
+// or `gen-triggers install`, installing them
+func generateTriggersCommand(ctx context.Context, args conf.Args, cfg config.Pg, events string, tables []string) error {
+	switch args.Num(1) {
+	case "":
+		stmt, err := db.NotifySQL(cfg, events, tables)
+		if err != nil {
+			return err
+		}
+		fmt.Print(stmt)
+		return nil
+	case "install":
+		return db.InstallNotify(ctx, cfg, events, tables)
+	default:
+		return fmt.Errorf("unknown gen-triggers command '%s', use install, or none to print the SQL", args.Num(1))
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"pg-to-es/internal/business"
+	"pg-to-es/internal/contract"
+
+	"github.com/ardanlabs/conf/v2"
+)
+
+// verifyCommand runs `verify [--repair]`, printing the documents of index out of sync with postgres
+// as JSON, and reindexing or deleting them with --repair
+func verifyCommand(ctx context.Context, args conf.Args, es contract.Elastic, index string, documents contract.Documents,
+	batchSize int, logger *slog.Logger) error {
+	repair := false
+	for _, arg := range args[1:] {
+		switch arg {
+		case "--repair", "-repair":
+			repair = true
+		default:
+			return fmt.Errorf("unknown verify argument '%s', use --repair", arg)
+		}
+	}
+	drift, err := business.Verify(ctx, es, documents, index, batchSize, repair)
+	if err != nil {
+		return err
+	}
+	logger.Info("verified documents", "documents", drift.Checked, "missing", len(drift.Missing),
+		"stale", len(drift.Stale), "orphaned", len(drift.Orphaned), "repaired", drift.Repaired)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", " ")
+	return enc.Encode(drift)
+}
@@ -2,17 +2,31 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"pg-to-es/internal/business"
 	"pg-to-es/internal/config"
+	"pg-to-es/internal/logging"
 	"pg-to-es/internal/service"
+	"pg-to-es/internal/tracing"
 )
 
 func main() {
+	err := run()
+	if err != nil {
+		slog.Error("server failed", logging.Err(err))
+		os.Exit(1)
+	}
+}
+
+// run serves requests until interrupted, returning once every resource is released
+func run() error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -23,28 +37,57 @@ func main() {
 	// Initialize Config
 	cfg, err := config.Load()
 	if err != nil {
-		log.Fatalln("config.Load() failed, err:", err.Error())
+		return fmt.Errorf("config.Load() failed, err: %w", err)
 	}
 
+	// Initialize Logger, the standard logger & main write through it too
+	logger, err := logging.New(cfg.Log, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("logging.New() failed, err: %w", err)
+	}
+	slog.SetDefault(logger)
+
+	// Export spans, the ones left are flushed on exit
+	shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing, "pg-to-es-server")
+	if err != nil {
+		return fmt.Errorf("tracing.Setup() failed, err: %w", err)
+	}
+	defer shutdownTracing(ctx)
+
 	// Initialize Elasticsearch Service
-	esSvc, err := service.NewElastic(cfg.Es)
+	esSvc, err := service.NewElastic(cfg.Es, logger)
 	if err != nil {
-		log.Fatalf("elasticsearch.New() failed, err: %s", err)
+		return fmt.Errorf("elasticsearch.New() failed, err: %w", err)
+	}
+
+	// Bootstrap Index, failing on mappings not matching
+	indexDefinition, err := service.IndexDefinition(cfg.Es.IndexMapping)
+	if err == nil {
+		err = esSvc.EnsureIndex(ctx, cfg.Es.Index, cfg.Es.WriteIndex(), indexDefinition)
+	}
+	if err != nil {
+		return fmt.Errorf("index bootstrap failed, err: %w", err)
 	}
 
 	// Initialize & run server
-	server := business.NewServer(esSvc, cfg.Server.Port, cfg.Es.Index)
+	server := business.NewServer(esSvc, cfg.Server.Port, cfg.Es.Index, logger)
 	server.InitRoutes()
+	failed := make(chan error, 1)
 	go func() {
-		log.Printf("server listening on :%d", cfg.Server.Port)
-		err = server.Start()
-		if err != nil {
-			log.Fatalf("srv.Start() failed, err: %s", err)
+		logger.Info("server listening", "port", cfg.Server.Port)
+		err := server.Start()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			failed <- fmt.Errorf("srv.Start() failed, err: %w", err)
 		}
 	}()
+	defer server.Shutdown(ctx)
 
 	// Await interruptions
-	<-interruptStream
-	log.Println("server interrupted!")
-	server.Shutdown(ctx)
+	select {
+	case <-interruptStream:
+		logger.Info("server interrupted!")
+	case err = <-failed:
+		return err
+	}
+	return nil
 }
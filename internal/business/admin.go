@@ -0,0 +1,134 @@
+package business
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"pg-to-es/internal/contract"
+	"pg-to-es/internal/metrics"
+	"pg-to-es/internal/model"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// pingTimeout bounds the check of elasticsearch made by /readyz
+const pingTimeout = 2 * time.Second
+
+// Admin serves the health & readiness of the pipeline, for orchestrators to probe. The leader, listener &
+// pipeline are reported once set, as they are only known as the pipeline starts
+type Admin struct {
+	srv *http.Server
+	es  contract.Elastic
+
+	mu       sync.Mutex
+	leader   contract.Leader
+	listener contract.DbListener
+	pipeline *Pipeline
+}
+
+func NewAdmin(es contract.Elastic, port int) *Admin {
+	s := &http.Server{
+		Addr:         fmt.Sprintf(":%d", port),
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		Handler:      nil,
+	}
+	return &Admin{srv: s, es: es}
+}
+
+func (a *Admin) InitRoutes() {
+	r := mux.NewRouter()
+	r.HandleFunc("/healthz", a.Healthz).Methods("GET")
+	r.HandleFunc("/readyz", a.Readyz).Methods("GET")
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
+	a.srv.Handler = r
+}
+
+func (a *Admin) Start() error {
+	if a.srv.Handler == nil {
+		return fmt.Errorf("can not start admin server, routes not initialized, use InitRoutes()")
+	}
+	return a.srv.ListenAndServe()
+}
+
+func (a *Admin) Shutdown(ctx context.Context) error {
+	return a.srv.Shutdown(ctx)
+}
+
+// SetLeader reports the leadership of leader, pipelines not electing any always lead
+func (a *Admin) SetLeader(leader contract.Leader) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.leader = leader
+}
+
+// SetListener reports the connection of listener & the deltas it buffers
+func (a *Admin) SetListener(listener contract.DbListener) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.listener = listener
+}
+
+// SetPipeline reports the deltas processed by pipeline
+func (a *Admin) SetPipeline(pipeline *Pipeline) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pipeline = pipeline
+}
+
+// Healthz fails once the pipeline stopped processing deltas, standbys are healthy
+func (a *Admin) Healthz(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	listener, pipeline := a.listener, a.pipeline
+	a.mu.Unlock()
+	var res model.Health
+	if pipeline != nil {
+		res = pipeline.Health()
+	} else if backlog, ok := listener.(contract.Backlog); ok {
+		depth := backlog.Depth()
+		res.QueueDepth = &depth
+	}
+	res.Status = "ok"
+	status := http.StatusOK
+	if pipeline != nil && !res.Running {
+		res.Status = "failing"
+		status = http.StatusServiceUnavailable
+	}
+	encodeStatus(w, status, res)
+}
+
+// Readyz succeeds while leading, connected to the source of deltas & reaching elasticsearch
+func (a *Admin) Readyz(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	leader, listener := a.leader, a.listener
+	a.mu.Unlock()
+	res := model.Readiness{
+		Leader:            leader == nil || leader.IsLeader(),
+		ListenerConnected: listener != nil,
+	}
+	if conn, ok := listener.(contract.Connection); ok {
+		res.ListenerConnected = conn.Connected()
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), pingTimeout)
+	defer cancel()
+	err := a.es.Ping(ctx)
+	res.ElasticsearchReachable = err == nil
+	if err != nil {
+		res.Error = err.Error()
+	}
+	res.Status = "ready"
+	status := http.StatusOK
+	if !res.Leader || !res.ListenerConnected || !res.ElasticsearchReachable {
+		res.Status = "not ready"
+		status = http.StatusServiceUnavailable
+	}
+	encodeStatus(w, status, res)
+}
+
+func encodeStatus(w http.ResponseWriter, status int, res interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encode(w, res)
+}
@@ -0,0 +1,78 @@
+package business
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"pg-to-es/internal/config"
+	"pg-to-es/internal/mock"
+	"pg-to-es/internal/model"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmin(t *testing.T) {
+	ctx := context.Background()
+	es := mock.NewElastic([]model.User{})
+	admin := NewAdmin(es, 0)
+	healthz := func() (int, model.Health) {
+		w := httptest.NewRecorder()
+		admin.Healthz(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		var res model.Health
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+		return w.Code, res
+	}
+	readyz := func() (int, model.Readiness) {
+		w := httptest.NewRecorder()
+		admin.Readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var res model.Readiness
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+		return w.Code, res
+	}
+
+	// standing by
+	leader := mock.NewLeader(false)
+	admin.SetLeader(leader)
+	code, health := healthz()
+	assert.Equal(t, http.StatusOK, code, "standbys must be healthy")
+	assert.Equal(t, "ok", health.Status)
+	code, readiness := readyz()
+	assert.Equal(t, http.StatusServiceUnavailable, code, "standbys must not be ready")
+	assert.False(t, readiness.Leader)
+
+	// leading
+	assert.NoError(t, leader.Campaign(ctx))
+	listener := mock.NewDbListener()
+	pipeline := NewPipeline(listener, es, mock.NewCheckpoint(""), mock.NewDeadLetters(), mock.NewDocuments(nil, ""), "", config.Pipeline{RetryAttempts: 1}, slog.Default())
+	admin.SetListener(listener)
+	admin.SetPipeline(pipeline)
+	assert.NoError(t, pipeline.Start(ctx))
+	listener.Push(model.Delta{Position: "1/0:1", Payload: `{"operation":"DELETE","table":"users","payload":{"id":1}}`})
+	listener.Push(model.Delta{Position: "1/0:2", Payload: `not json`})
+	assert.Eventually(t, func() bool {
+		_, health = healthz()
+		return health.EventsProcessed == 2
+	}, time.Second, 10*time.Millisecond, "deltas processed must be reported")
+	assert.True(t, health.Running)
+	assert.Equal(t, int64(2), health.EventsReceived)
+	assert.Equal(t, int64(1), health.EventsFailed, "deltas dead-lettered must be reported as failed")
+	assert.NotNil(t, health.LastEventAt)
+	code, readiness = readyz()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, model.Readiness{Status: "ready", Leader: true, ListenerConnected: true, ElasticsearchReachable: true}, readiness)
+
+	es.SetUnreachable(true)
+	code, readiness = readyz()
+	assert.Equal(t, http.StatusServiceUnavailable, code, "pipelines not reaching elasticsearch must not be ready")
+	assert.False(t, readiness.ElasticsearchReachable)
+	assert.NotEmpty(t, readiness.Error)
+
+	pipeline.Stop()
+	code, health = healthz()
+	assert.Equal(t, http.StatusServiceUnavailable, code, "pipelines no longer processing deltas must be failing")
+	assert.Equal(t, "failing", health.Status)
+}
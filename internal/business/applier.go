@@ -0,0 +1,132 @@
+package business
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"pg-to-es/internal/contract"
+	"pg-to-es/internal/mapping"
+	"sort"
+	"time"
+)
+
+// applier applies deltas to elasticsearch, buffering the writes until Flush
+type applier interface {
+	Apply(ctx context.Context, data string) error
+	// Len returns the number of buffered writes
+	Len() int
+	// Full reports whether the buffer should be flushed right away
+	Full() bool
+	// FlushInterval returns the longest writes should stay buffered
+	FlushInterval() time.Duration
+	Flush(ctx context.Context) error
+	// Reset discards every buffered write
+	Reset()
+}
+
+// newApplier returns the applier matching documents, a mappedApplier when they are built
+// as per a mapping, else a bulkApplier patching documents incrementally
+func newApplier(es contract.Elastic, index string, documents contract.Documents, batchSize int) applier {
+	bulk := es.Bulk(index)
+	mapped, ok := documents.(contract.MappedDocuments)
+	if !ok {
+		return bulkApplier{Bulk: bulk, documents: documents}
+	}
+	return &mappedApplier{
+		es:            es,
+		index:         index,
+		documents:     mapped,
+		batchSize:     max(batchSize, 1),
+		flushInterval: bulk.FlushInterval(),
+		ids:           map[string]bool{},
+	}
+}
+
+// bulkApplier patches the documents held in elasticsearch with the content of deltas
+type bulkApplier struct {
+	contract.Bulk
+	// documents read the changes notified by key alone
+	documents contract.Documents
+}
+
+func (a bulkApplier) Apply(ctx context.Context, data string) error {
+	return apply(ctx, a.Bulk, a.documents, data)
+}
+
+// mappedApplier collects the ids of the documents deltas affect & rebuilds them from postgres on Flush.
+// Deltas carry a single row, as changed in its table
+type mappedApplier struct {
+	es            contract.Elastic
+	index         string
+	documents     contract.MappedDocuments
+	batchSize     int
+	flushInterval time.Duration
+	// ids of the documents to rebuild
+	ids map[string]bool
+}
+
+func (a *mappedApplier) Apply(ctx context.Context, data string) error {
+	var d struct {
+		Operation string                 `json:"operation"`
+		Table     string                 `json:"table"`
+		Payload   map[string]interface{} `json:"payload"`
+	}
+	dec := json.NewDecoder(bytes.NewReader([]byte(data)))
+	// keeps large keys intact
+	dec.UseNumber()
+	err := dec.Decode(&d)
+	if err != nil {
+		return permanent(fmt.Errorf("json.Unmarshal() failed, err: %w", err))
+	}
+	ids, err := a.documents.Roots(ctx, d.Table, d.Payload)
+	if errors.Is(err, mapping.ErrNotMapped) {
+		return permanent(err)
+	}
+	if err != nil {
+		return fmt.Errorf("documents.Roots() failed, err: %w", err)
+	}
+	for _, id := range ids {
+		a.ids[id] = true
+	}
+	return nil
+}
+
+func (a *mappedApplier) Len() int {
+	return len(a.ids)
+}
+
+func (a *mappedApplier) Full() bool {
+	return len(a.ids) >= a.batchSize
+}
+
+func (a *mappedApplier) FlushInterval() time.Duration {
+	return a.flushInterval
+}
+
+// Flush rebuilds every document collected, they stay collected for a retry on failure
+func (a *mappedApplier) Flush(ctx context.Context) error {
+	if len(a.ids) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(a.ids))
+	for id := range a.ids {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	docs, err := a.documents.Build(ctx, ids)
+	if err != nil {
+		return fmt.Errorf("documents.Build() failed, err: %w", err)
+	}
+	err = a.es.BulkWrite(ctx, a.index, docs)
+	if err != nil {
+		return fmt.Errorf("es.BulkWrite() failed, err: %w", err)
+	}
+	a.Reset()
+	return nil
+}
+
+func (a *mappedApplier) Reset() {
+	a.ids = map[string]bool{}
+}
@@ -0,0 +1,45 @@
+package business
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"pg-to-es/internal/contract"
+)
+
+// ReplayDeadLetters applies the dead letters of ids, every one when ids is empty, against the
+// current state of the index. Letters applied are removed, the others are kept for a later replay.
+// Documents built as per a mapping are rebuilt from postgres rather. Returns the number of letters applied
+func ReplayDeadLetters(ctx context.Context, es contract.Elastic, index string, documents contract.Documents,
+	deadLetters contract.DeadLetters, ids ...int64) (int, error) {
+	letters, err := deadLetters.List(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("deadLetters.List() failed, err: %w", err)
+	}
+	wanted := map[int64]bool{}
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	replayed := 0
+	var errs []error
+	for _, letter := range letters {
+		if len(ids) > 0 && !wanted[letter.ID] {
+			continue
+		}
+		// flushed one at a time, so a failure is attributed to its letter
+		bulk := newApplier(es, index, documents, 1)
+		err = bulk.Apply(ctx, letter.Payload)
+		if err == nil {
+			err = bulk.Flush(ctx)
+		}
+		if err == nil {
+			err = deadLetters.Remove(ctx, letter.ID)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("replaying dead letter %d failed, err: %w", letter.ID, err))
+			continue
+		}
+		replayed++
+	}
+	return replayed, errors.Join(errs...)
+}
@@ -1,238 +1,680 @@
 package business
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"pg-to-es/internal/config"
 	"pg-to-es/internal/contract"
+	"pg-to-es/internal/logging"
+	"pg-to-es/internal/metrics"
 	"pg-to-es/internal/model"
+	"pg-to-es/internal/tracing"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Pipeline struct {
-	listener contract.DbListener
-	es       contract.Elastic
-	index    string
-	// TODO: make this pipeline asyc by introducing message brokers, for async processing of delta
+	listener    contract.DbListener
+	es          contract.Elastic
+	checkpoint  contract.Checkpoint
+	deadLetters contract.DeadLetters
+	documents   contract.Documents
+	index       string
+	cfg         config.Pipeline
+	logger      *slog.Logger
+	// set when documents are built as per a mapping, see mappedApplier
+	mapped bool
+	// closed by Stop, cuts retries short
+	quit     chan struct{}
+	quitOnce sync.Once
+	// closed once process() has flushed & returned
+	done chan struct{}
+	// sequence of the first delta not completed yet, with the positions of the ones completed past it
+	commitMu  sync.Mutex
+	next      uint64
+	completed map[uint64]string
+	// reported by Health
+	running   atomic.Bool
+	lastEvent atomic.Int64
+	received  atomic.Int64
+	processed atomic.Int64
+	failed    atomic.Int64
 }
 
-func NewPipeline(listener contract.DbListener, es contract.Elastic, index string) *Pipeline {
-	return &Pipeline{listener, es, index}
+func NewPipeline(listener contract.DbListener, es contract.Elastic, checkpoint contract.Checkpoint,
+	deadLetters contract.DeadLetters, documents contract.Documents, index string, cfg config.Pipeline, logger *slog.Logger) *Pipeline {
+	p := &Pipeline{
+		listener:    listener,
+		es:          es,
+		checkpoint:  checkpoint,
+		deadLetters: deadLetters,
+		documents:   documents,
+		index:       index,
+		cfg:         cfg,
+		logger:      logger,
+		quit:        make(chan struct{}),
+		next:        1,
+		completed:   map[uint64]string{},
+	}
+	_, p.mapped = documents.(contract.MappedDocuments)
+	return p
 }
 
+// Start resumes syncing from the last committed checkpoint
 func (p *Pipeline) Start(ctx context.Context) error {
-	deltaStream, err := p.listener.Start(ctx)
+	from, err := p.checkpoint.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("checkpoint.Load() failed, err: %w", err)
+	}
+	deltaStream, err := p.listener.Start(ctx, from)
 	if err != nil {
 		return err
 	}
-	process(ctx, p.es, deltaStream, p.index)
+	p.process(ctx, deltaStream)
 	return err
 }
 
+// Backfill indexes a consistent snapshot of every document & then hands off to live
+// streaming, from the position right after the snapshot
+func (p *Pipeline) Backfill(ctx context.Context) error {
+	// changes committed while the snapshot is read must be retained for the hand off
+	err := p.listener.Prepare(ctx)
+	if err != nil {
+		return fmt.Errorf("listener.Prepare() failed, err: %w", err)
+	}
+	indexed := 0
+	position, err := p.documents.Snapshot(ctx, p.cfg.BackfillBatch, func(docs []model.Document) error {
+		err := p.es.BulkWrite(ctx, p.index, docs)
+		if err != nil {
+			return fmt.Errorf("es.BulkWrite() failed, err: %w", err)
+		}
+		indexed += len(docs)
+		p.logger.Info("backfill indexed documents", "documents", indexed)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("documents.Snapshot() failed, err: %w", err)
+	}
+	err = p.checkpoint.Save(ctx, position)
+	if err != nil {
+		return fmt.Errorf("checkpoint.Save() failed, err: %w", err)
+	}
+	return p.Start(ctx)
+}
+
+// Stop the listener & wait for buffered writes to be flushed, without retrying
 func (p *Pipeline) Stop() {
+	p.quitOnce.Do(func() { close(p.quit) })
 	p.listener.Stop()
+	if p.done != nil {
+		<-p.done
+	}
 }
 
-func process(ctx context.Context, es contract.Elastic, deltaStream <-chan string, index string) {
-	// Process delta
+// process applies deltas to elasticsearch in bulk, spread across workers by the document they
+// target, so deltas of a document stay in order while unrelated documents are processed in
+// parallel. Deltas which may target any document wait for every worker to flush & are applied
+// on their own, consecutive ones flushed at once. Deltas which can not be applied or flushed within the retry attempts are dead-lettered
+func (p *Pipeline) process(ctx context.Context, deltaStream <-chan model.Delta) {
+	p.done = make(chan struct{})
+	workers := make([]*worker, max(p.cfg.Workers, 1))
+	var wg sync.WaitGroup
+	for idx := range workers {
+		workers[idx] = &worker{p: p, jobs: make(chan job, workerQueueSize), bulk: p.newApplier()}
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			w.run(ctx)
+		}(workers[idx])
+	}
+	// stops verifying & resyncing
+	stop := make(chan struct{})
+	if p.cfg.VerifyInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.verifyEvery(ctx, stop)
+		}()
+	}
+	wg.Add(1)
 	go func() {
-		type payload struct {
-			Operation string          `json:"operation"`
-			Table     string          `json:"table"`
-			Payload   json.RawMessage `json:"payload"`
-		}
-		type document struct {
-			UserID             int    `json:"user_id"`
-			UserName           string `json:"user_name"`
-			UserCreatedAt      string `json:"user_created_at"`
-			ProjectID          int    `json:"project_id"`
-			ProjectName        string `json:"project_name"`
-			ProjectSlug        string `json:"project_slug"`
-			ProjectDescription string `json:"project_description"`
-			ProjectCreatedAt   string `json:"project_created_at"`
-			HashtagID          int    `json:"hashtag_id"`
-			HashtagName        string `json:"hashtag_name"`
-			HashtagCreatedAt   string `json:"hashtag_created_at"`
-			Operation          string `json:"operation"`
-			Table              string `json:"table"`
-		}
-		for data := range deltaStream {
-			log.Println("data", data)
-			var d payload
-			err := json.Unmarshal([]byte(data), &d)
-			if err != nil {
-				log.Printf("json.Unmarshal() failed, content: '%s', err: %s", data, err)
-				continue
+		defer wg.Done()
+		p.resyncGaps(ctx, stop)
+	}()
+	p.running.Store(true)
+	go func() {
+		defer close(p.done)
+		defer p.running.Store(false)
+		defer wg.Wait()
+		defer close(stop)
+		defer func() {
+			for _, w := range workers {
+				close(w.jobs)
 			}
-
-			switch d.Operation {
-			case "INSERT", "UPDATE":
-				var delta document
-				err = json.Unmarshal(d.Payload, &delta)
-				if err != nil {
-					log.Printf("\njson.Unmarshal(d.Payload, &user), err: %s", err)
-					continue
-				}
-				var esDocx []model.User
-				switch {
-				case delta.UserID > 0:
-					esDoc, _ := es.GetByUserId(ctx, index, delta.UserID)
-					if esDoc != nil {
-						esDocx = []model.User{
-							*esDoc,
-						}
-					}
-				case delta.ProjectID > 0:
-					esDocx, _ = es.GetByProjectId(ctx, index, delta.UserID)
-				case delta.HashtagID > 0:
-					esDocx, _ = es.GetByHashTagId(ctx, index, delta.UserID)
+		}()
+		// flush every worker, for what follows to observe every write ahead of it
+		barrier := func() {
+			var flushed sync.WaitGroup
+			flushed.Add(len(workers))
+			for _, w := range workers {
+				w.jobs <- job{flushed: &flushed}
+			}
+			flushed.Wait()
+		}
+		var seq uint64
+		// applies consecutive deltas which may target any document, flushed at once
+		var global *worker
+		// flushes the deltas applied by global, false once the pipeline stopped
+		flushGlobal := func() bool {
+			if global == nil {
+				return true
+			}
+			global.flush(ctx)
+			stopped := global.stopped
+			global = nil
+			return !stopped
+		}
+		// hands delta over, false once the pipeline stopped
+		receive := func(delta model.Delta) bool {
+			now := time.Now()
+			p.received.Add(1)
+			p.lastEvent.Store(now.UnixNano())
+			table, operation := eventOf(delta.Payload)
+			metrics.EventsReceived.WithLabelValues(table, operation).Inc()
+			seq++
+			// spans the receipt of delta up to its hand over to a worker
+			_, span := tracing.Start(ctx, "pipeline.receive", trace.WithAttributes(tracing.Delta(delta)...))
+			defer span.End()
+			j := job{seq: seq, delta: delta, table: table, operation: operation, received: now, span: span.SpanContext()}
+			idx, ok := p.partition(delta.Payload, len(workers))
+			if ok {
+				if !flushGlobal() {
+					return false
 				}
-				if esDocx == nil {
-					user := &model.User{
-						ID:        delta.UserID,
-						Name:      delta.UserName,
-						CreatedAt: delta.UserCreatedAt,
-						Projects:  []model.Project{},
-					}
-					if delta.ProjectID > 0 {
-						project := model.Project{
-							ID:          delta.ProjectID,
-							Name:        delta.ProjectName,
-							Slug:        delta.ProjectSlug,
-							Description: delta.ProjectDescription,
-							CreatedAt:   delta.ProjectCreatedAt,
-							Hashtags:    []model.Hashtag{},
-						}
-						if delta.HashtagID > 0 {
-							project.Hashtags = append(project.Hashtags, model.Hashtag{
-								ID:        delta.HashtagID,
-								Name:      delta.HashtagName,
-								CreatedAt: delta.ProjectCreatedAt,
-							})
-						}
-						user.Projects = append(user.Projects, project)
+				workers[idx].jobs <- j
+				return true
+			}
+			if global == nil {
+				barrier()
+				global = &worker{p: p, bulk: p.newApplier()}
+			}
+			global.apply(ctx, j)
+			if global.stopped {
+				return false
+			}
+			if global.bulk.Full() {
+				return flushGlobal()
+			}
+			return true
+		}
+		for {
+			if global != nil {
+				// keeps applying the deltas ready, flushing once none is
+				select {
+				case delta, ok := <-deltaStream:
+					if !ok {
+						flushGlobal()
+						return
 					}
-					err = es.Create(ctx, index, delta.UserID, *user)
-					if err != nil {
-						log.Printf("\nes.Create() failed, err: %s", err)
-						continue
+					if !receive(delta) {
+						return
 					}
-				} else {
-					for idx := range esDocx {
-						esDocx[idx].Name = delta.ProjectName
-						if d.Operation == "UPDATE" {
-							for pIdx, project := range esDocx[idx].Projects {
-								if project.ID == delta.ProjectID {
-									esDocx[idx].Projects[pIdx].Name = delta.ProjectName
-									esDocx[idx].Projects[pIdx].Description = delta.ProjectDescription
-									esDocx[idx].Projects[pIdx].Slug = delta.ProjectSlug
-									for hIdx, hashtag := range esDocx[idx].Projects[pIdx].Hashtags {
-										if hashtag.ID == delta.HashtagID {
-											esDocx[idx].Projects[pIdx].Hashtags[hIdx].Name = delta.HashtagName
-										}
-									}
-								}
-							}
-						} else {
-							newProject := model.Project{
-								ID:          delta.ProjectID,
-								Name:        delta.ProjectName,
-								Description: delta.ProjectDescription,
-								Slug:        delta.ProjectSlug,
-								CreatedAt:   delta.ProjectCreatedAt,
-							}
-							newProject.Hashtags = []model.Hashtag{
-								{
-									ID:        delta.HashtagID,
-									Name:      delta.HashtagName,
-									CreatedAt: delta.HashtagCreatedAt,
-								},
-							}
-							if esDocx[idx].Projects == nil {
-								esDocx[idx].Projects = []model.Project{}
-							}
-							esDocx[idx].Projects = append(esDocx[idx].Projects, newProject)
-						}
-						err = es.Update(ctx, index, delta.UserID, esDocx[idx])
-						if err != nil {
-							log.Printf("\nes.Update() failed, err: %s", err)
-							continue
-						}
+					continue
+				default:
+					if !flushGlobal() {
+						return
 					}
+				}
+			}
+			delta, ok := <-deltaStream
+			if !ok || !receive(delta) {
+				return
+			}
+		}
+	}()
+}
 
+// Health reports whether deltas are processed, when the last one was received, how many were processed
+// (indexed or dead-lettered), dead-lettered & are buffered by the listener
+func (p *Pipeline) Health() model.Health {
+	health := model.Health{
+		Running:         p.running.Load(),
+		EventsReceived:  p.received.Load(),
+		EventsProcessed: p.processed.Load(),
+		EventsFailed:    p.failed.Load(),
+	}
+	if last := p.lastEvent.Load(); last != 0 {
+		at := time.Unix(0, last)
+		health.LastEventAt = &at
+	}
+	if backlog, ok := p.listener.(contract.Backlog); ok {
+		depth := backlog.Depth()
+		health.QueueDepth = &depth
+	}
+	return health
+}
+
+// resyncGaps resyncs the gaps of the listener alongside the deltas, until stop is closed. Gaps reported
+// while a resync is pending or running are merged into the next one & resyncs start ResyncInterval apart
+// at the least, for a flapping connection not to walk every document over & over
+func (p *Pipeline) resyncGaps(ctx context.Context, stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(ctx)
+	var (
+		pending *model.Gap
+		// fires once the pending gap may be resynced
+		due <-chan time.Time
+		// closed once the running resync is over
+		running chan struct{}
+		last    time.Time
+	)
+	defer func() {
+		cancel()
+		if running != nil {
+			<-running
+		}
+	}()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		case gap := <-p.listener.Gaps():
+			metrics.ListenerGaps.Inc()
+			metrics.ListenerGapSeconds.Add(gap.To.Sub(gap.From).Seconds())
+			if pending != nil {
+				if pending.From.Before(gap.From) {
+					gap.From = pending.From
 				}
-			case "DELETE":
-				switch d.Table {
-				case "users":
-					var u model.User
-					err = json.Unmarshal(d.Payload, &u)
-					if err != nil {
-						log.Printf("json.Unmarshal() failed, err: %v", err)
-						continue
-					}
+				if pending.To.After(gap.To) {
+					gap.To = pending.To
+				}
+			} else if running == nil {
+				due = time.After(time.Until(last.Add(p.cfg.ResyncInterval)))
+			}
+			pending = &gap
+		case <-due:
+			running = make(chan struct{})
+			go func(gap model.Gap, done chan struct{}) {
+				defer close(done)
+				p.resync(ctx, gap)
+			}(*pending, running)
+			pending, due, last = nil, nil, time.Now()
+		case <-running:
+			running = nil
+			if pending != nil {
+				due = time.After(time.Until(last.Add(p.cfg.ResyncInterval)))
+			}
+		}
+	}
+}
 
-					log.Println(u)
-					err = es.Delete(ctx, index, u.ID)
-					if err != nil {
-						log.Printf("\nes.Delete() failed, err: %s", err)
-						continue
-					}
+// resync repairs the documents changed during gap, as verified against postgres: every document is compared,
+// as neither updates nor deletes leave a trace to look the ones changed during gap up by
+func (p *Pipeline) resync(ctx context.Context, gap model.Gap) {
+	ctx, span := tracing.Start(ctx, "pipeline.resync", trace.WithAttributes(
+		attribute.String("pg_to_es.gap.from", gap.From.Format(time.RFC3339)),
+		attribute.String("pg_to_es.gap.to", gap.To.Format(time.RFC3339)),
+	))
+	defer span.End()
+	duration := gap.To.Sub(gap.From)
+	p.logger.Warn("listener gap, resyncing documents changed during it",
+		"from", gap.From.Format(time.RFC3339), "to", gap.To.Format(time.RFC3339), "duration", duration)
+	var drift model.Drift
+	_, err := p.retry(func() error {
+		var err error
+		drift, err = Verify(ctx, p.es, p.documents, p.index, p.cfg.BackfillBatch, true)
+		return err
+	})
+	metrics.ResyncedDocuments.Add(float64(drift.Repaired))
+	span.SetAttributes(tracing.Documents.Int(drift.Repaired))
+	if err != nil {
+		tracing.Fail(span, err)
+		p.logger.Error("resync failed", "documents", drift.Repaired, logging.Err(err))
+		return
+	}
+	p.logger.Info("resynced documents", "documents", drift.Repaired, "missing", len(drift.Missing),
+		"stale", len(drift.Stale), "orphaned", len(drift.Orphaned))
+}
 
-				case "projects":
-					var p model.Project
-					err = json.Unmarshal(d.Payload, &p)
-					if err != nil {
-						log.Printf("json.Unmarshal() failed, err: %v", err)
-						continue
-					}
+func (p *Pipeline) newApplier() applier {
+	return newApplier(p.es, p.index, p.documents, p.cfg.BackfillBatch)
+}
 
-					err = es.RemoveProject(ctx, index, p.ID)
-					if err != nil {
-						log.Printf("\nes.RemoveProject() failed, err: %s", err)
-						continue
-					}
+// complete marks deltas as flushed or dead-lettered, committing the position up to which
+// every delta handed over is
+func (p *Pipeline) complete(ctx context.Context, jobs []job) {
+	p.commitMu.Lock()
+	defer p.commitMu.Unlock()
+	for _, j := range jobs {
+		p.processed.Add(int64(1 + len(j.merged)))
+		p.completed[j.seq] = j.delta.Position
+		observeProcessed(j)
+		// superseded by j, thus completed along with it
+		for _, m := range j.merged {
+			p.completed[m.seq] = m.delta.Position
+			observeProcessed(m)
+		}
+	}
+	var position string
+	for {
+		pos, ok := p.completed[p.next]
+		if !ok {
+			break
+		}
+		delete(p.completed, p.next)
+		if pos != "" {
+			position = pos
+		}
+		p.next++
+	}
+	p.commit(ctx, position)
+}
 
-				case "hashtags":
-					var h model.Hashtag
-					err = json.Unmarshal(d.Payload, &h)
-					if err != nil {
-						log.Printf("json.Unmarshal() failed, err: %v", err)
-						continue
-					}
+// deadLetter persists delta along with the error it failed with
+func (p *Pipeline) deadLetter(ctx context.Context, delta model.Delta, attempts int, cause error) {
+	letter := model.DeadLetter{
+		Position: delta.Position,
+		Payload:  delta.Payload,
+		Error:    cause.Error(),
+		Attempts: attempts,
+	}
+	p.failed.Add(1)
+	metrics.EventsFailed.WithLabelValues(eventOf(delta.Payload)).Inc()
+	ctx, span := tracing.Start(ctx, "pipeline.dead_letter", trace.WithAttributes(
+		append(tracing.Delta(delta), tracing.Attempts.Int(attempts))...))
+	defer span.End()
+	tracing.Fail(span, cause)
+	_, err := p.retry(func() error { return p.deadLetters.Add(ctx, letter) })
+	if err != nil {
+		tracing.Fail(span, err)
+		p.logger.Error("deadLetters.Add() failed, delta lost", append(p.deltaFields(delta), logging.Err(err))...)
+	}
+}
 
-					err = es.RemoveHashtag(ctx, index, h.ID)
-					if err != nil {
-						log.Printf("\nes.RemoveHashtag() failed, err: %s", err)
-						continue
-					}
+// observeProcessed records j as processed, along with the time it took since received
+func observeProcessed(j job) {
+	metrics.EventsProcessed.WithLabelValues(j.table, j.operation).Inc()
+	metrics.ProcessingSeconds.WithLabelValues(j.table, j.operation).Observe(time.Since(j.received).Seconds())
+}
 
-				case "project_hashtags":
-					var h model.ProjectHashtag
-					err = json.Unmarshal(d.Payload, &h)
-					if err != nil {
-						log.Printf("json.Unmarshal() failed, err: %v", err)
-						continue
-					}
+// eventOf returns the table & operation of a delta, unknown for deltas not telling
+func eventOf(data string) (string, string) {
+	var e struct {
+		Table     string `json:"table"`
+		Operation string `json:"operation"`
+	}
+	json.Unmarshal([]byte(data), &e)
+	if e.Table == "" {
+		e.Table = "unknown"
+	}
+	if e.Operation == "" {
+		e.Operation = "unknown"
+	}
+	return e.Table, e.Operation
+}
 
-					err = es.RemoveHashtag(ctx, index, h.HashtagId)
-					if err != nil {
-						log.Printf("\nes.RemoveHashtag() failed, err: %s", err)
-						continue
-					}
-				case "user_projects":
-					var h model.UserProject
-					err = json.Unmarshal(d.Payload, &h)
-					if err != nil {
-						log.Printf("json.Unmarshal() failed, err: %v", err)
-						continue
-					}
+// deltaFields returns the fields delta is logged with, along with the document it targets when a single one
+func (p *Pipeline) deltaFields(delta model.Delta) []any {
+	fields := logging.Delta(delta)
+	// deltas of mapped documents carry the rows changed only
+	if id, ok := documentKey(delta.Payload); ok && id != 0 && !p.mapped {
+		fields = append(fields, logging.DocID, id)
+	}
+	return fields
+}
 
-					err = es.RemoveProject(ctx, index, h.ProjectId)
-					if err != nil {
-						log.Printf("\nes.RemoveProject() failed, err: %s", err)
-						continue
-					}
+// commit persists the position & acknowledges it to the listener
+func (p *Pipeline) commit(ctx context.Context, position string) {
+	if position == "" {
+		return
+	}
+	ctx, span := tracing.Start(ctx, "pipeline.commit", trace.WithAttributes(tracing.Position.String(position)))
+	defer span.End()
+	err := p.checkpoint.Save(ctx, position)
+	if err != nil {
+		tracing.Fail(span, err)
+		p.logger.Error("checkpoint.Save() failed", logging.Position, position, logging.Err(err))
+		return
+	}
+	err = p.listener.Ack(ctx, position)
+	if err != nil {
+		tracing.Fail(span, err)
+		p.logger.Error("listener.Ack() failed", logging.Position, position, logging.Err(err))
+	}
+}
+
+// apply a single delta to elasticsearch, through bulk
+func apply(ctx context.Context, bulk contract.Bulk, documents contract.Documents, data string) error {
+	type payload struct {
+		Operation string          `json:"operation"`
+		Table     string          `json:"table"`
+		Payload   json.RawMessage `json:"payload"`
+		// ids of the row changed, in place of the payload too large to be notified
+		Keys json.RawMessage `json:"keys"`
+	}
+	type document struct {
+		UserID             int    `json:"user_id"`
+		UserName           string `json:"user_name"`
+		UserCreatedAt      string `json:"user_created_at"`
+		ProjectID          int    `json:"project_id"`
+		ProjectName        string `json:"project_name"`
+		ProjectSlug        string `json:"project_slug"`
+		ProjectDescription string `json:"project_description"`
+		ProjectCreatedAt   string `json:"project_created_at"`
+		HashtagID          int    `json:"hashtag_id"`
+		HashtagName        string `json:"hashtag_name"`
+		HashtagCreatedAt   string `json:"hashtag_created_at"`
+		Operation          string `json:"operation"`
+		Table              string `json:"table"`
+	}
+	var d payload
+	err := json.Unmarshal([]byte(data), &d)
+	if err != nil {
+		return permanent(fmt.Errorf("json.Unmarshal() failed, err: %w", err))
+	}
+	if d.Keys != nil {
+		if d.Operation != "DELETE" {
+			return rebuild(ctx, bulk, documents, d.Table, d.Keys)
+		}
+		// deletes need nothing but the ids of the row
+		d.Payload = d.Keys
+	}
+
+	switch d.Operation {
+	case "INSERT", "UPDATE":
+		// a row for every document the change affects
+		rows, err := decodeRows[document](d.Payload)
+		if err != nil {
+			return permanent(fmt.Errorf("decodeRows(d.Payload), err: %w", err))
+		}
+		for _, row := range rows {
+			if row.UserID == 0 {
+				continue
+			}
+			user, err := bulk.GetByUserId(ctx, row.UserID)
+			if err != nil && !errors.Is(err, contract.ErrNotFound) {
+				return fmt.Errorf("bulk.GetByUserId() failed, err: %w", err)
+			}
+			if user == nil {
+				user = &model.User{ID: row.UserID, Projects: []model.Project{}}
+			}
+			user.Name = row.UserName
+			user.CreatedAt = row.UserCreatedAt
+			if row.ProjectID > 0 {
+				project := upsertProject(user, row.ProjectID)
+				project.Name = row.ProjectName
+				project.Slug = row.ProjectSlug
+				project.Description = row.ProjectDescription
+				project.CreatedAt = row.ProjectCreatedAt
+				if row.HashtagID > 0 {
+					hashtag := upsertHashtag(project, row.HashtagID)
+					hashtag.Name = row.HashtagName
+					hashtag.CreatedAt = row.HashtagCreatedAt
 				}
 			}
+			bulk.Index(*user)
 		}
-	}()
+	case "DELETE":
+		switch d.Table {
+		case "users":
+			var u model.User
+			err = json.Unmarshal(d.Payload, &u)
+			if err != nil {
+				return permanent(fmt.Errorf("json.Unmarshal() failed, err: %w", err))
+			}
+
+			bulk.Delete(u.ID)
+
+		case "projects":
+			var p model.Project
+			err = json.Unmarshal(d.Payload, &p)
+			if err != nil {
+				return permanent(fmt.Errorf("json.Unmarshal() failed, err: %w", err))
+			}
+
+			err = bulk.RemoveProject(ctx, p.ID)
+			if err != nil {
+				return fmt.Errorf("bulk.RemoveProject() failed, err: %w", err)
+			}
+
+		case "hashtags":
+			var h model.Hashtag
+			err = json.Unmarshal(d.Payload, &h)
+			if err != nil {
+				return permanent(fmt.Errorf("json.Unmarshal() failed, err: %w", err))
+			}
+
+			err = bulk.RemoveHashtag(ctx, h.ID)
+			if err != nil {
+				return fmt.Errorf("bulk.RemoveHashtag() failed, err: %w", err)
+			}
+
+		case "project_hashtags":
+			var h model.ProjectHashtag
+			err = json.Unmarshal(d.Payload, &h)
+			if err != nil {
+				return permanent(fmt.Errorf("json.Unmarshal() failed, err: %w", err))
+			}
+
+			// the hashtag stays on the other projects holding it
+			err = bulk.RemoveProjectHashtag(ctx, h.ProjectId, h.HashtagId)
+			if err != nil {
+				return fmt.Errorf("bulk.RemoveProjectHashtag() failed, err: %w", err)
+			}
+		case "user_projects":
+			var h model.UserProject
+			err = json.Unmarshal(d.Payload, &h)
+			if err != nil {
+				return permanent(fmt.Errorf("json.Unmarshal() failed, err: %w", err))
+			}
+
+			// the project stays on the other users holding it
+			user, err := bulk.GetByUserId(ctx, h.UserId)
+			if errors.Is(err, contract.ErrNotFound) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("bulk.GetByUserId() failed, err: %w", err)
+			}
+			projects := []model.Project{}
+			for _, project := range user.Projects {
+				if project.ID != h.ProjectId {
+					projects = append(projects, project)
+				}
+			}
+			user.Projects = projects
+			bulk.Index(*user)
+		}
+	}
+	return nil
+}
+
+// rebuild indexes the documents holding the row of table keys identifies, as read from documents, & deletes
+// the ones no longer found
+func rebuild(ctx context.Context, bulk contract.Bulk, documents contract.Documents, table string, keys json.RawMessage) error {
+	keyed, ok := documents.(contract.KeyedDocuments)
+	if !ok {
+		return permanent(errors.New("changes notified by key can not be read back"))
+	}
+	var k map[string]int
+	err := json.Unmarshal(keys, &k)
+	if err != nil {
+		return permanent(fmt.Errorf("json.Unmarshal() failed, err: %w", err))
+	}
+	ids, err := keyed.Holding(ctx, table, k)
+	if err != nil {
+		return fmt.Errorf("documents.Holding() failed, err: %w", err)
+	}
+	docs, err := keyed.Build(ctx, ids)
+	if err != nil {
+		return fmt.Errorf("documents.Build() failed, err: %w", err)
+	}
+	for _, doc := range docs {
+		if doc.Source == nil {
+			id, err := strconv.Atoi(doc.ID)
+			if err != nil {
+				return permanent(fmt.Errorf("strconv.Atoi() failed, err: %w", err))
+			}
+			bulk.Delete(id)
+			continue
+		}
+		var user model.User
+		err = json.Unmarshal(doc.Source, &user)
+		if err != nil {
+			return permanent(fmt.Errorf("json.Unmarshal() failed, err: %w", err))
+		}
+		bulk.Index(user)
+	}
+	return nil
+}
+
+// decodeRows decodes payload, either a JSON array of rows or a single row
+func decodeRows[T any](payload json.RawMessage) ([]T, error) {
+	payload = bytes.TrimSpace(payload)
+	switch {
+	case len(payload) == 0 || bytes.Equal(payload, []byte("null")):
+		return nil, nil
+	case payload[0] == '[':
+		var rows []T
+		err := json.Unmarshal(payload, &rows)
+		return rows, err
+	}
+	var row T
+	err := json.Unmarshal(payload, &row)
+	if err != nil {
+		return nil, err
+	}
+	return []T{row}, nil
+}
+
+// upsertProject returns the project of id held by user, appending it if missing
+func upsertProject(user *model.User, id int) *model.Project {
+	for idx := range user.Projects {
+		if user.Projects[idx].ID == id {
+			return &user.Projects[idx]
+		}
+	}
+	user.Projects = append(user.Projects, model.Project{ID: id, Hashtags: []model.Hashtag{}})
+	return &user.Projects[len(user.Projects)-1]
+}
+
+// upsertHashtag returns the hashtag of id held by project, appending it if missing
+func upsertHashtag(project *model.Project, id int) *model.Hashtag {
+	for idx := range project.Hashtags {
+		if project.Hashtags[idx].ID == id {
+			return &project.Hashtags[idx]
+		}
+	}
+	project.Hashtags = append(project.Hashtags, model.Hashtag{ID: id})
+	return &project.Hashtags[len(project.Hashtags)-1]
 }
@@ -0,0 +1,564 @@
+package business
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"pg-to-es/internal/config"
+	"pg-to-es/internal/logging"
+	"pg-to-es/internal/metrics"
+	"pg-to-es/internal/mock"
+	"pg-to-es/internal/model"
+	"pg-to-es/internal/tracing"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestPipeline_Start(t *testing.T) {
+	ctx := context.Background()
+	listener := mock.NewDbListener()
+	checkpoint := mock.NewCheckpoint("1/0:0")
+	deadLetters := mock.NewDeadLetters()
+	pipeline := NewPipeline(listener, mock.NewElastic([]model.User{}), checkpoint, deadLetters, mock.NewDocuments(nil, ""), "", config.Pipeline{RetryAttempts: 3}, slog.Default())
+	err := pipeline.Start(ctx)
+	assert.NoError(t, err)
+	defer pipeline.Stop()
+	assert.Equal(t, "1/0:0", listener.From(), "pipeline must resume from checkpoint")
+
+	processed := metrics.EventsProcessed.WithLabelValues("users", "DELETE")
+	failed := metrics.EventsFailed.WithLabelValues("unknown", "unknown")
+	processedBefore, failedBefore := testutil.ToFloat64(processed), testutil.ToFloat64(failed)
+	listener.Push(model.Delta{Position: "1/0:1", Payload: `{"operation":"DELETE","table":"users","payload":{"id":1}}`})
+	assert.Eventually(t, func() bool {
+		position, _ := checkpoint.Load(ctx)
+		return position == "1/0:1"
+	}, time.Second, 10*time.Millisecond, "checkpoint must be committed")
+	assert.Equal(t, []string{"1/0:1"}, listener.Acked(), "position must be acknowledged")
+
+	listener.Push(model.Delta{Position: "1/0:2", Payload: `not json`})
+	listener.Push(model.Delta{Payload: `{"operation":"DELETE","table":"users","payload":{"id":2}}`})
+	assert.Eventually(t, func() bool {
+		position, _ := checkpoint.Load(ctx)
+		return position == "1/0:2"
+	}, time.Second, 10*time.Millisecond, "dead-lettered deltas must be committed, position-less ones must not")
+	letters, _ := deadLetters.List(ctx)
+	assert.Len(t, letters, 1, "undecodable delta must be dead-lettered")
+	assert.Equal(t, 1, letters[0].Attempts, "undecodable delta must not be retried")
+	assert.Eventually(t, func() bool { return testutil.ToFloat64(processed) == processedBefore+2 }, time.Second, 10*time.Millisecond,
+		"deltas processed must be counted by table & operation")
+	assert.Equal(t, failedBefore+1, testutil.ToFloat64(failed), "deltas dead-lettered must be counted")
+}
+
+func TestPipeline_retry(t *testing.T) {
+	ctx := context.Background()
+	es := mock.NewElastic([]model.User{})
+	listener := mock.NewDbListener()
+	checkpoint := mock.NewCheckpoint("")
+	deadLetters := mock.NewDeadLetters()
+	cfg := config.Pipeline{RetryAttempts: 3, RetryBaseDelay: time.Millisecond, RetryMaxDelay: 5 * time.Millisecond}
+	pipeline := NewPipeline(listener, es, checkpoint, deadLetters, mock.NewDocuments(nil, ""), "", cfg, slog.Default())
+	assert.NoError(t, pipeline.Start(ctx))
+	defer pipeline.Stop()
+
+	es.FailFlushes(2)
+	listener.Push(model.Delta{Position: "1/0:1", Payload: `{"operation":"DELETE","table":"users","payload":{"id":1}}`})
+	assert.Eventually(t, func() bool {
+		position, _ := checkpoint.Load(ctx)
+		return position == "1/0:1"
+	}, time.Second, 10*time.Millisecond, "flush must be retried until it succeeds")
+	letters, _ := deadLetters.List(ctx)
+	assert.Empty(t, letters, "retried delta must not be dead-lettered")
+
+	es.FailFlushes(3)
+	payload := `{"operation":"DELETE","table":"users","payload":{"id":2}}`
+	listener.Push(model.Delta{Position: "1/0:2", Payload: payload})
+	assert.Eventually(t, func() bool {
+		position, _ := checkpoint.Load(ctx)
+		return position == "1/0:2"
+	}, time.Second, 10*time.Millisecond, "dead-lettered delta must be committed")
+	letters, _ = deadLetters.List(ctx)
+	if assert.Len(t, letters, 1, "delta must be dead-lettered once retries run out") {
+		assert.Equal(t, payload, letters[0].Payload)
+		assert.Equal(t, 3, letters[0].Attempts)
+		assert.NotEmpty(t, letters[0].Error)
+	}
+}
+
+func TestPipeline_deadLetterOnce(t *testing.T) {
+	ctx := context.Background()
+	es := mock.NewElastic([]model.User{})
+	deadLetters := mock.NewDeadLetters()
+	cfg := config.Pipeline{RetryAttempts: 3, RetryBaseDelay: time.Millisecond, RetryMaxDelay: 5 * time.Millisecond}
+	pipeline := NewPipeline(mock.NewDbListener(), es, mock.NewCheckpoint(""), deadLetters, mock.NewDocuments(nil, ""), "", cfg, slog.Default())
+	deltaStream := make(chan model.Delta, 2)
+	deltaStream <- model.Delta{Position: "1", Payload: `{"operation":"UPDATE","table":"projects","keys":{"id":"x"}}`}
+	deltaStream <- model.Delta{Position: "2", Payload: `{"operation":"UPDATE","table":"users","keys":{"id":1}}`}
+	close(deltaStream)
+	es.FailFlushes(3)
+	pipeline.process(ctx, deltaStream)
+	<-pipeline.done
+
+	letters, _ := deadLetters.List(ctx)
+	var positions []string
+	for _, letter := range letters {
+		positions = append(positions, letter.Position)
+	}
+	assert.Equal(t, []string{"1", "2"}, positions, "deltas failing to apply must not be dead-lettered again along with their batch")
+}
+
+func TestPipeline_workers(t *testing.T) {
+	ctx := context.Background()
+	es := mock.NewElastic([]model.User{})
+	listener := mock.NewDbListener()
+	checkpoint := mock.NewCheckpoint("")
+	pipeline := NewPipeline(listener, es, checkpoint, mock.NewDeadLetters(), mock.NewDocuments(nil, ""), "", config.Pipeline{Workers: 4}, slog.Default())
+	assert.NoError(t, pipeline.Start(ctx))
+
+	insert := `{"operation":"INSERT","table":"users","payload":{"user_id":%d,"user_name":"%s"}}`
+	position := 0
+	push := func(payload string) {
+		position++
+		listener.Push(model.Delta{Position: fmt.Sprintf("1/0:%03d", position), Payload: payload})
+	}
+	var want []model.User
+	for id := 1; id <= 20; id++ {
+		push(fmt.Sprintf(insert, id, "first"))
+		push(fmt.Sprintf(`{"operation":"DELETE","table":"users","payload":{"id":%d}}`, id))
+		if id == 10 {
+			// may target any document
+			push(`{"operation":"DELETE","table":"projects","payload":{"id":1}}`)
+		}
+		push(fmt.Sprintf(insert, id, "final"))
+		want = append(want, model.User{ID: id, Name: "final", Projects: []model.Project{}})
+	}
+	pipeline.Stop()
+
+	got := es.Documents()
+	sort.Slice(got, func(i, j int) bool { return got[i].ID < got[j].ID })
+	assert.Equal(t, want, got, "deltas of a document must be applied in order")
+	last, _ := checkpoint.Load(ctx)
+	assert.Equal(t, fmt.Sprintf("1/0:%03d", position), last, "every delta must be committed once drained")
+	acked := listener.Acked()
+	assert.True(t, sort.StringsAreSorted(acked), "positions must be committed in order")
+}
+
+func TestPipeline_resync(t *testing.T) {
+	ctx := context.Background()
+	users := []model.User{{ID: 1, Name: "User 1", Projects: []model.Project{}}, {ID: 2, Name: "User 2", Projects: []model.Project{}}}
+	es := mock.NewElastic([]model.User{
+		// user 1 is renamed & unlinked from its project during the gap, user 2 created & user 3 deleted
+		{ID: 1, Name: "old", Projects: []model.Project{{ID: 7}}},
+		{ID: 3, Name: "User 3", Projects: []model.Project{}},
+	})
+	listener := mock.NewDbListener()
+	pipeline := NewPipeline(listener, es, mock.NewCheckpoint(""), mock.NewDeadLetters(),
+		mock.NewDocuments(users, ""), "", config.Pipeline{BackfillBatch: 10}, slog.Default())
+	assert.NoError(t, pipeline.Start(ctx))
+	defer pipeline.Stop()
+
+	gaps := testutil.ToFloat64(metrics.ListenerGaps)
+	listener.PushGap(model.Gap{From: time.Now().Add(-time.Minute), To: time.Now()})
+	assert.Eventually(t, func() bool {
+		got := es.Documents()
+		sort.Slice(got, func(i, j int) bool { return got[i].ID < got[j].ID })
+		return assert.ObjectsAreEqual(users, got)
+	}, time.Second, 10*time.Millisecond, "documents created, updated or deleted during the gap must be repaired")
+	assert.Equal(t, gaps+1, testutil.ToFloat64(metrics.ListenerGaps), "gap must be counted")
+}
+
+func TestPipeline_resyncGaps(t *testing.T) {
+	ctx := context.Background()
+	users := []model.User{{ID: 1, Name: "User 1", Projects: []model.Project{}}}
+	es := mock.NewElastic([]model.User{{ID: 1, Name: "old", Projects: []model.Project{}}})
+	listener := mock.NewDbListener()
+	pipeline := NewPipeline(listener, es, mock.NewCheckpoint(""), mock.NewDeadLetters(), mock.NewDocuments(users, ""), "",
+		config.Pipeline{BackfillBatch: 10, ResyncInterval: 300 * time.Millisecond}, slog.Default())
+	assert.NoError(t, pipeline.Start(ctx))
+	defer pipeline.Stop()
+
+	gaps := testutil.ToFloat64(metrics.ListenerGaps)
+	now := time.Now()
+	listener.PushGap(model.Gap{From: now.Add(-time.Minute), To: now})
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(users, es.Documents())
+	}, time.Second, 10*time.Millisecond, "first gap must be resynced at once")
+
+	assert.NoError(t, es.Create(ctx, "", 2, model.User{ID: 2, Name: "orphan", Projects: []model.Project{}}))
+	listener.PushGap(model.Gap{From: now, To: now.Add(time.Second)})
+	listener.PushGap(model.Gap{From: now.Add(-time.Second), To: now.Add(2 * time.Second)})
+	listener.Push(model.Delta{Payload: `{"operation":"UPDATE","table":"users","payload":[{"user_id":1,"user_name":"new"}]}`})
+	assert.Eventually(t, func() bool {
+		got := es.Documents()
+		return len(got) == 2 && got[0].Name == "new"
+	}, time.Second, 10*time.Millisecond, "deltas must be processed while gaps wait")
+	assert.Never(t, func() bool { return len(es.Documents()) == 1 }, 100*time.Millisecond, 10*time.Millisecond,
+		"gaps must not be resynced within the interval")
+	assert.Eventually(t, func() bool { return len(es.Documents()) == 1 }, time.Second, 10*time.Millisecond,
+		"merged gaps must be resynced once the interval passed")
+	assert.Equal(t, gaps+3, testutil.ToFloat64(metrics.ListenerGaps), "every gap must be counted")
+}
+
+func TestPipeline_fanOut(t *testing.T) {
+	ctx := context.Background()
+	project := func(name string, hashtags ...model.Hashtag) []model.Project {
+		return []model.Project{{ID: 7, Name: name, Slug: "p", Hashtags: append([]model.Hashtag{}, hashtags...)}}
+	}
+	es := mock.NewElastic([]model.User{
+		{ID: 1, Name: "User 1", Projects: project("old")},
+		{ID: 2, Name: "User 2", Projects: project("old")},
+	})
+	listener := mock.NewDbListener()
+	pipeline := NewPipeline(listener, es, mock.NewCheckpoint(""), mock.NewDeadLetters(), mock.NewDocuments(nil, ""), "",
+		config.Pipeline{Workers: 2}, slog.Default())
+	assert.NoError(t, pipeline.Start(ctx))
+
+	listener.Push(model.Delta{Payload: `{"operation":"UPDATE","table":"projects","payload":[
+		{"user_id":1,"user_name":"User 1","project_id":7,"project_name":"new","project_slug":"p"},
+		{"user_id":2,"user_name":"User 2","project_id":7,"project_name":"new","project_slug":"p"}]}`})
+	listener.Push(model.Delta{Payload: `{"operation":"INSERT","table":"project_hashtags","payload":[
+		{"user_id":1,"user_name":"User 1","project_id":7,"project_name":"new","project_slug":"p","hashtag_id":3,"hashtag_name":"go"},
+		{"user_id":2,"user_name":"User 2","project_id":7,"project_name":"new","project_slug":"p","hashtag_id":3,"hashtag_name":"go"}]}`})
+	listener.Push(model.Delta{Payload: `{"operation":"UPDATE","table":"projects","payload":null}`})
+	pipeline.Stop()
+
+	got := es.Documents()
+	sort.Slice(got, func(i, j int) bool { return got[i].ID < got[j].ID })
+	assert.Equal(t, []model.User{
+		{ID: 1, Name: "User 1", Projects: project("new", model.Hashtag{ID: 3, Name: "go"})},
+		{ID: 2, Name: "User 2", Projects: project("new", model.Hashtag{ID: 3, Name: "go"})},
+	}, got, "every document affected must be updated")
+}
+
+func TestPipeline_linkDeletes(t *testing.T) {
+	ctx := context.Background()
+	hashtag := model.Hashtag{ID: 3, Name: "go"}
+	es := mock.NewElastic([]model.User{
+		{ID: 1, Name: "User 1", Projects: []model.Project{{ID: 7, Hashtags: []model.Hashtag{hashtag}}}},
+		{ID: 2, Name: "User 2", Projects: []model.Project{{ID: 7, Hashtags: []model.Hashtag{hashtag}}, {ID: 8, Hashtags: []model.Hashtag{hashtag}}}},
+	})
+	listener := mock.NewDbListener()
+	pipeline := NewPipeline(listener, es, mock.NewCheckpoint(""), mock.NewDeadLetters(), mock.NewDocuments(nil, ""), "",
+		config.Pipeline{Workers: 2}, slog.Default())
+	assert.NoError(t, pipeline.Start(ctx))
+
+	listener.Push(model.Delta{Payload: `{"operation":"DELETE","table":"user_projects","payload":{"user_id":1,"project_id":7}}`})
+	listener.Push(model.Delta{Payload: `{"operation":"DELETE","table":"project_hashtags","payload":{"project_id":7,"hashtag_id":3}}`})
+	pipeline.Stop()
+
+	got := es.Documents()
+	sort.Slice(got, func(i, j int) bool { return got[i].ID < got[j].ID })
+	assert.Equal(t, []model.User{
+		{ID: 1, Name: "User 1", Projects: []model.Project{}},
+		{ID: 2, Name: "User 2", Projects: []model.Project{{ID: 7, Hashtags: []model.Hashtag{}}, {ID: 8, Hashtags: []model.Hashtag{hashtag}}}},
+	}, got, "links deleted must be removed from the documents & projects they linked only")
+}
+
+func TestPipeline_globalBatch(t *testing.T) {
+	ctx := context.Background()
+	es := mock.NewElastic([]model.User{
+		{ID: 1, Projects: []model.Project{{ID: 7, Hashtags: []model.Hashtag{}}, {ID: 8, Hashtags: []model.Hashtag{}}}},
+	})
+	listener := mock.NewDbListener()
+	pipeline := NewPipeline(listener, es, mock.NewCheckpoint(""), mock.NewDeadLetters(), mock.NewDocuments(nil, ""), "",
+		config.Pipeline{Workers: 2}, slog.Default())
+	deltaStream := make(chan model.Delta, 3)
+	deltaStream <- model.Delta{Position: "1", Payload: `{"operation":"DELETE","table":"projects","payload":{"id":7}}`}
+	deltaStream <- model.Delta{Position: "2", Payload: `{"operation":"DELETE","table":"projects","payload":{"id":8}}`}
+	deltaStream <- model.Delta{Position: "3", Payload: `{"operation":"UPDATE","table":"users","payload":{"user_id":1,"user_name":"User 1"}}`}
+	close(deltaStream)
+	pipeline.process(ctx, deltaStream)
+	<-pipeline.done
+
+	assert.Equal(t, []model.User{{ID: 1, Name: "User 1", Projects: []model.Project{}}}, es.Documents())
+	assert.Equal(t, []string{"2", "3"}, listener.Acked(), "consecutive deltas targeting any document must be flushed at once")
+}
+
+func TestPipeline_keys(t *testing.T) {
+	ctx := context.Background()
+	hashtag := model.Hashtag{ID: 3, Name: "go"}
+	es := mock.NewElastic([]model.User{
+		{ID: 1, Name: "User 1", Projects: []model.Project{{ID: 7, Name: "Old", Hashtags: []model.Hashtag{hashtag}}}},
+		{ID: 2, Name: "User 2", Projects: []model.Project{{ID: 7, Name: "Old", Hashtags: []model.Hashtag{hashtag}}}},
+		{ID: 3, Name: "User 3"},
+	})
+	documents := mock.NewDocuments([]model.User{
+		{ID: 1, Name: "User 1", Projects: []model.Project{{ID: 7, Name: "New", Hashtags: []model.Hashtag{hashtag}}}},
+		{ID: 2, Name: "User 2", Projects: []model.Project{{ID: 7, Name: "New", Hashtags: []model.Hashtag{hashtag}}}},
+	}, "")
+	listener := mock.NewDbListener()
+	deadLetters := mock.NewDeadLetters()
+	pipeline := NewPipeline(listener, es, mock.NewCheckpoint(""), deadLetters, documents, "",
+		config.Pipeline{Workers: 2}, slog.Default())
+	assert.NoError(t, pipeline.Start(ctx))
+
+	listener.Push(model.Delta{Payload: `{"operation":"UPDATE","table":"projects","keys":{"id":7}}`})
+	listener.Push(model.Delta{Payload: `{"operation":"DELETE","table":"users","keys":{"id":3}}`})
+	pipeline.Stop()
+
+	got := es.Documents()
+	sort.Slice(got, func(i, j int) bool { return got[i].ID < got[j].ID })
+	assert.Equal(t, []model.User{
+		{ID: 1, Name: "User 1", Projects: []model.Project{{ID: 7, Name: "New", Hashtags: []model.Hashtag{hashtag}}}},
+		{ID: 2, Name: "User 2", Projects: []model.Project{{ID: 7, Name: "New", Hashtags: []model.Hashtag{hashtag}}}},
+	}, got, "changes notified by key must be read back from postgres")
+	letters, _ := deadLetters.List(ctx)
+	assert.Empty(t, letters)
+}
+
+func TestDocumentKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantKey int
+		wantOk  bool
+	}{
+		{"single row", `{"operation":"UPDATE","table":"users","payload":{"user_id":4}}`, 4, true},
+		{"rows of a single document", `{"operation":"UPDATE","table":"hashtags","payload":[{"user_id":4},{"user_id":4}]}`, 4, true},
+		{"rows of several documents", `{"operation":"UPDATE","table":"projects","payload":[{"user_id":4},{"user_id":5}]}`, 0, false},
+		{"no rows", `{"operation":"UPDATE","table":"projects","payload":null}`, 0, true},
+		{"user deleted", `{"operation":"DELETE","table":"users","payload":{"id":4}}`, 4, true},
+		{"project deleted", `{"operation":"DELETE","table":"projects","payload":{"id":4}}`, 0, false},
+		{"user unlinked from project", `{"operation":"DELETE","table":"user_projects","payload":{"user_id":4,"project_id":7}}`, 4, true},
+		{"hashtag unlinked from project", `{"operation":"DELETE","table":"project_hashtags","payload":{"project_id":7,"hashtag_id":3}}`, 0, false},
+		{"user deleted by key", `{"operation":"DELETE","table":"users","keys":{"id":4}}`, 4, true},
+		{"user updated by key", `{"operation":"UPDATE","table":"users","keys":{"id":4}}`, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, ok := documentKey(tt.data)
+			assert.Equal(t, tt.wantKey, key)
+			assert.Equal(t, tt.wantOk, ok)
+		})
+	}
+}
+
+func TestPipeline_mapped(t *testing.T) {
+	ctx := context.Background()
+	es := mock.NewElastic([]model.User{{ID: 2, Name: "User 2"}})
+	documents := mock.NewMappedDocuments([]model.User{{ID: 1, Name: "User 1"}}, map[string]map[int][]string{
+		"users":    {1: {"1"}, 2: {"2"}},
+		"projects": {7: {"1", "2"}},
+	})
+	listener := mock.NewDbListener()
+	deadLetters := mock.NewDeadLetters()
+	pipeline := NewPipeline(listener, es, mock.NewCheckpoint(""), deadLetters, documents, "",
+		config.Pipeline{Workers: 2, BackfillBatch: 10}, slog.Default())
+	assert.NoError(t, pipeline.Start(ctx))
+
+	listener.Push(model.Delta{Position: "1", Payload: `{"operation":"UPDATE","table":"projects","payload":{"id":7}}`})
+	listener.Push(model.Delta{Position: "2", Payload: `{"operation":"INSERT","table":"tags","payload":{"id":1}}`})
+	pipeline.Stop()
+
+	assert.Equal(t, []model.User{{ID: 1, Name: "User 1"}}, es.Documents(),
+		"documents holding the row must be rebuilt, the ones no longer found deleted")
+	letters, _ := deadLetters.List(ctx)
+	assert.Len(t, letters, 1, "deltas of tables not mapped must be dead-lettered")
+	acked := listener.Acked()
+	assert.Equal(t, "2", acked[len(acked)-1], "every delta must be committed")
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	es := mock.NewElastic([]model.User{{ID: 1}, {ID: 2}})
+	deadLetters := mock.NewDeadLetters(
+		model.DeadLetter{ID: 1, Payload: `{"operation":"DELETE","table":"users","payload":{"id":1}}`},
+		model.DeadLetter{ID: 2, Payload: `not json`},
+		model.DeadLetter{ID: 3, Payload: `{"operation":"DELETE","table":"users","payload":{"id":2}}`},
+	)
+
+	replayed, err := ReplayDeadLetters(ctx, es, "", mock.NewDocuments(nil, ""), deadLetters, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, replayed, "only the letter asked for must be replayed")
+	assert.Equal(t, []model.User{{ID: 2}}, es.Documents())
+
+	replayed, err = ReplayDeadLetters(ctx, es, "", mock.NewDocuments(nil, ""), deadLetters)
+	assert.Error(t, err, "failed replay must be reported")
+	assert.Equal(t, 1, replayed)
+	letters, _ := deadLetters.List(ctx)
+	if assert.Len(t, letters, 1, "only failed letters must be kept") {
+		assert.Equal(t, int64(2), letters[0].ID)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 1; attempt < 100; attempt++ {
+		delay := backoff(attempt, 100*time.Millisecond, 10*time.Second)
+		want := 100 * time.Millisecond << (attempt - 1)
+		if attempt > 7 {
+			want = 10 * time.Second
+		}
+		assert.GreaterOrEqual(t, delay, want/2, "delay must keep at least half the backoff")
+		assert.LessOrEqual(t, delay, want, "delay must not exceed the backoff")
+	}
+}
+
+func TestPipeline_Backfill(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Format(time.RFC3339)
+	users := []model.User{
+		{ID: 1, Name: "User 1", CreatedAt: now, Projects: []model.Project{}},
+		{ID: 2, Name: "User 2", CreatedAt: now, Projects: []model.Project{}},
+		{ID: 3, Name: "User 3", CreatedAt: now, Projects: []model.Project{}},
+	}
+	es := mock.NewElastic([]model.User{})
+	listener := mock.NewDbListener()
+	checkpoint := mock.NewCheckpoint("")
+	documents := mock.NewDocuments(users, "0/0:0 snapshot:1/0:10:12:")
+	pipeline := NewPipeline(listener, es, checkpoint, mock.NewDeadLetters(), documents, "", config.Pipeline{BackfillBatch: 2}, slog.Default())
+	err := pipeline.Backfill(ctx)
+	assert.NoError(t, err)
+	defer pipeline.Stop()
+
+	assert.True(t, listener.Prepared(), "listener must be prepared ahead of the snapshot")
+	assert.Equal(t, users, es.Documents(), "every document must be indexed")
+	position, _ := checkpoint.Load(ctx)
+	assert.Equal(t, "0/0:0 snapshot:1/0:10:12:", position, "snapshot position must be committed")
+	assert.Equal(t, position, listener.From(), "streaming must resume right after the snapshot")
+}
+
+func TestPipeline_readFailures(t *testing.T) {
+	ctx := context.Background()
+	hashtag := model.Hashtag{ID: 3, Name: "go"}
+	es := mock.NewElastic([]model.User{
+		{ID: 1, Name: "a", Projects: []model.Project{{ID: 7, Hashtags: []model.Hashtag{hashtag}}, {ID: 8, Hashtags: []model.Hashtag{}}}},
+	})
+	listener := mock.NewDbListener()
+	deadLetters := mock.NewDeadLetters()
+	cfg := config.Pipeline{RetryAttempts: 3, RetryBaseDelay: time.Millisecond, RetryMaxDelay: 5 * time.Millisecond}
+	checkpoint := mock.NewCheckpoint("")
+	pipeline := NewPipeline(listener, es, checkpoint, deadLetters, mock.NewDocuments(nil, ""), "", cfg, slog.Default())
+	assert.NoError(t, pipeline.Start(ctx))
+	defer pipeline.Stop()
+
+	for _, delta := range []model.Delta{
+		{Position: "1/0:1", Payload: `{"operation":"UPDATE","table":"users","payload":{"user_id":1,"user_name":"b"}}`},
+		{Position: "1/0:2", Payload: `{"operation":"DELETE","table":"user_projects","payload":{"user_id":1,"project_id":8}}`},
+	} {
+		es.FailReads(2)
+		listener.Push(delta)
+		assert.Eventually(t, func() bool {
+			position, _ := checkpoint.Load(ctx)
+			return position == delta.Position
+		}, time.Second, 10*time.Millisecond, "reads must be retried until they succeed")
+	}
+
+	assert.Equal(t, []model.User{
+		{ID: 1, Name: "b", Projects: []model.Project{{ID: 7, Hashtags: []model.Hashtag{hashtag}}}},
+	}, es.Documents(), "documents failing to be read must be read again, rather than replaced or left as is")
+	letters, _ := deadLetters.List(ctx)
+	assert.Empty(t, letters)
+}
+
+func TestPipeline_conflicts(t *testing.T) {
+	ctx := context.Background()
+	es := mock.NewElastic([]model.User{})
+	listener := mock.NewDbListener()
+	checkpoint := mock.NewCheckpoint("")
+	deadLetters := mock.NewDeadLetters()
+	cfg := config.Pipeline{RetryAttempts: 3, RetryBaseDelay: time.Millisecond, RetryMaxDelay: 5 * time.Millisecond}
+	pipeline := NewPipeline(listener, es, checkpoint, deadLetters, mock.NewDocuments(nil, ""), "", cfg, slog.Default())
+	assert.NoError(t, pipeline.Start(ctx))
+	defer pipeline.Stop()
+
+	retries := testutil.ToFloat64(metrics.ConflictRetries)
+	es.ConflictFlushes(1)
+	listener.Push(model.Delta{Position: "1/0:1", Payload: `{"operation":"INSERT","table":"users","payload":{"user_id":1,"user_name":"a"}}`})
+	assert.Eventually(t, func() bool {
+		position, _ := checkpoint.Load(ctx)
+		return position == "1/0:1"
+	}, time.Second, 10*time.Millisecond, "flush must be retried until it succeeds")
+	assert.Equal(t, 2, es.Writes(), "batch must be re-applied after a conflict")
+	assert.Equal(t, retries+1, testutil.ToFloat64(metrics.ConflictRetries))
+	user, _ := es.GetByUserId(ctx, "", 1)
+	if assert.NotNil(t, user) {
+		assert.Equal(t, "a", user.Name)
+	}
+	letters, _ := deadLetters.List(ctx)
+	assert.Empty(t, letters, "conflicting delta must not be dead-lettered")
+
+	// removals flush ahead of updating by query, conflicting writes are applied anew
+	listener.Push(model.Delta{Position: "1/0:2", Payload: `{"operation":"INSERT","table":"user_projects","payload":{"user_id":1,"user_name":"a","project_id":7}}`})
+	assert.Eventually(t, func() bool {
+		position, _ := checkpoint.Load(ctx)
+		return position == "1/0:2"
+	}, time.Second, 10*time.Millisecond)
+	es.ConflictFlushes(1)
+	listener.Push(model.Delta{Position: "1/0:3", Payload: `{"operation":"DELETE","table":"projects","payload":{"id":7}}`})
+	assert.Eventually(t, func() bool {
+		position, _ := checkpoint.Load(ctx)
+		return position == "1/0:3"
+	}, time.Second, 10*time.Millisecond, "removal must be retried until its flush succeeds")
+	assert.Equal(t, retries+2, testutil.ToFloat64(metrics.ConflictRetries))
+	user, _ = es.GetByUserId(ctx, "", 1)
+	if assert.NotNil(t, user) {
+		assert.Empty(t, user.Projects, "project must be removed")
+	}
+	letters, _ = deadLetters.List(ctx)
+	assert.Empty(t, letters, "conflicting removal must not be dead-lettered")
+}
+
+func TestPipeline_tracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(prev)
+
+	ctx := context.Background()
+	listener := mock.NewDbListener()
+	checkpoint := mock.NewCheckpoint("")
+	pipeline := NewPipeline(listener, mock.NewElastic([]model.User{}), checkpoint, mock.NewDeadLetters(), mock.NewDocuments(nil, ""), "", config.Pipeline{}, slog.Default())
+	assert.NoError(t, pipeline.Start(ctx))
+	listener.Push(model.Delta{Position: "1/0:1", Payload: `{"operation":"DELETE","table":"users","txid":742,"payload":{"id":1}}`})
+	pipeline.Stop()
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	for _, name := range []string{"pipeline.receive", "pipeline.apply"} {
+		if assert.Contains(t, spans, name) {
+			assert.Contains(t, spans[name].Attributes, tracing.TxID.Int64(742), "%s must carry the transaction id", name)
+			assert.Contains(t, spans[name].Attributes, tracing.Position.String("1/0:1"), "%s must carry the position", name)
+		}
+	}
+	receive := spans["pipeline.receive"].SpanContext
+	assert.Equal(t, receive.SpanID(), spans["pipeline.apply"].Parent.SpanID(), "apply must be traced within receipt")
+	if assert.Contains(t, spans, "pipeline.flush") && assert.Len(t, spans["pipeline.flush"].Links, 1) {
+		assert.Equal(t, receive, spans["pipeline.flush"].Links[0].SpanContext, "flush must link to the deltas flushed")
+	}
+	if assert.Contains(t, spans, "pipeline.commit") {
+		assert.Equal(t, spans["pipeline.flush"].SpanContext.SpanID(), spans["pipeline.commit"].Parent.SpanID(),
+			"commit must be traced within the flush")
+	}
+}
+
+func TestPipeline_logging(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := logging.New(config.Log{Level: "debug", Format: config.LogFormatJSON}, &buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx := context.Background()
+	listener := mock.NewDbListener()
+	pipeline := NewPipeline(listener, mock.NewElastic([]model.User{}), mock.NewCheckpoint(""), mock.NewDeadLetters(), mock.NewDocuments(nil, ""), "", config.Pipeline{}, logger)
+	assert.NoError(t, pipeline.Start(ctx))
+	listener.Push(model.Delta{Position: "1/0:1", Payload: `{"operation":"DELETE","table":"users","payload":{"id":7,"name":"secret"}}`})
+	listener.Push(model.Delta{Position: "1/0:2", Payload: `{"operation":"DELETE","table":"users","payload":{"id":"secret"}}`})
+	pipeline.Stop()
+
+	logs := buf.String()
+	assert.Contains(t, logs, `"msg":"applying delta","table":"users","operation":"DELETE","position":"1/0:1","payload":"[redacted]","doc_id":7`,
+		"deltas must be logged by table, operation & document")
+	assert.Contains(t, logs, `"msg":"apply() failed, dead-lettering delta","table":"users","operation":"DELETE","position":"1/0:2"`,
+		"failures must be logged by table & operation")
+	assert.Contains(t, logs, `"error":"json.Unmarshal() failed`, "failures must be logged along with their error")
+	assert.NotContains(t, logs, "secret", "payloads must be redacted")
+}
@@ -0,0 +1,113 @@
+package business
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"pg-to-es/internal/contract"
+	"pg-to-es/internal/model"
+	"regexp"
+	"strconv"
+)
+
+// Sources the next version of the index is built from by Reindex
+const (
+	ReindexFromPostgres = "postgres"
+	ReindexFromIndex    = "index"
+)
+
+// Reindex builds the next version of the index behind alias (<alias>_v<n+1>) as per definition, from
+// documents or from the index in use as per source, catches up with the documents changed meanwhile &
+// points alias & writeAlias to it at once. The documents changed until pointed to it are caught up with
+// once more. Catching up verifies every document against postgres, repairing the ones created, updated
+// or deleted since read. Returns the index built, the previous one is left in place, as is the one built by
+// a failed reindex, skipped by the next one
+func Reindex(ctx context.Context, indices contract.Indices, es contract.Elastic, documents contract.Documents,
+	alias, writeAlias string, definition []byte, source string, batchSize int, logger *slog.Logger) (string, error) {
+	current, err := indices.Resolve(ctx, alias)
+	if err != nil {
+		return "", fmt.Errorf("indices.Resolve() failed, err: %w", err)
+	}
+	switch {
+	case source != ReindexFromPostgres && source != ReindexFromIndex:
+		return "", fmt.Errorf("unknown reindex source '%s', use %s or %s", source, ReindexFromPostgres, ReindexFromIndex)
+	case source == ReindexFromIndex && len(current) == 0:
+		return "", fmt.Errorf("no index behind '%s' to reindex from", alias)
+	}
+	// versions left by failed reindexes included
+	versions, err := indices.List(ctx, alias+"_v*")
+	if err != nil {
+		return "", fmt.Errorf("indices.List() failed, err: %w", err)
+	}
+	index := nextIndex(alias, versions)
+	err = indices.CreateIndex(ctx, index, definition)
+	if err != nil {
+		return "", fmt.Errorf("indices.CreateIndex() failed, err: %w", err)
+	}
+	logger.Info("reindexing", "alias", alias, "index", index, "source", source)
+
+	if source == ReindexFromPostgres {
+		indexed := 0
+		_, err = documents.Snapshot(ctx, batchSize, func(docs []model.Document) error {
+			err := es.BulkWrite(ctx, index, docs)
+			if err != nil {
+				return fmt.Errorf("es.BulkWrite() failed, err: %w", err)
+			}
+			indexed += len(docs)
+			logger.Info("reindex indexed documents", "documents", indexed)
+			return nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("documents.Snapshot() failed, err: %w", err)
+		}
+	} else {
+		copied, err := indices.CopyIndex(ctx, alias, index)
+		if err != nil {
+			return "", fmt.Errorf("indices.CopyIndex() failed, err: %w", err)
+		}
+		logger.Info("reindex copied documents", "documents", copied)
+	}
+
+	err = catchUp(ctx, es, documents, index, batchSize, logger)
+	if err != nil {
+		return "", err
+	}
+	err = indices.SwapAliases(ctx, index, alias, writeAlias)
+	if err != nil {
+		return "", fmt.Errorf("indices.SwapAliases() failed, err: %w", err)
+	}
+	logger.Info("aliases swapped", "alias", alias, "write_alias", writeAlias, "index", index)
+	// documents changed since caught up with were written to the previous index
+	err = catchUp(ctx, es, documents, index, batchSize, logger)
+	if err != nil {
+		return "", err
+	}
+	return index, nil
+}
+
+// catchUp repairs index as verified against documents, as neither updates nor deletes leave a trace to look
+// the documents changed up by
+func catchUp(ctx context.Context, es contract.Elastic, documents contract.Documents, index string, batchSize int,
+	logger *slog.Logger) error {
+	drift, err := Verify(ctx, es, documents, index, batchSize, true)
+	if err != nil {
+		return fmt.Errorf("Verify() failed, err: %w", err)
+	}
+	logger.Info("reindex caught up with documents changed meanwhile", "documents", drift.Repaired)
+	return nil
+}
+
+// nextIndex names the version of the index following the ones of indices, <alias>_v1 for indices not versioned
+func nextIndex(alias string, indices []string) string {
+	version := regexp.MustCompile("^" + regexp.QuoteMeta(alias) + `_v(\d+)$`)
+	last := 0
+	for _, index := range indices {
+		match := version.FindStringSubmatch(index)
+		if match == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(match[1])
+		last = max(last, n)
+	}
+	return fmt.Sprintf("%s_v%d", alias, last+1)
+}
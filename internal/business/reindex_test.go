@@ -0,0 +1,104 @@
+package business
+
+import (
+	"context"
+	"log/slog"
+	"pg-to-es/internal/mock"
+	"pg-to-es/internal/model"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReindex(t *testing.T) {
+	tests := []struct {
+		name    string
+		aliases map[string][]string
+		// indices behind no alias, left by failed reindexes
+		left    []string
+		source  string
+		want    string
+		copies  []string
+		created []string
+		wantErr bool
+	}{
+		{
+			name:    "from postgres",
+			aliases: map[string][]string{"root": {"root_v1"}, "root_write": {"root_v1"}},
+			source:  ReindexFromPostgres,
+			want:    "root_v2",
+			created: []string{"root_v1", "root_v2"},
+		},
+		{
+			name:    "from index",
+			aliases: map[string][]string{"root": {"root_v3"}, "root_write": {"root_v3"}},
+			source:  ReindexFromIndex,
+			want:    "root_v4",
+			copies:  []string{"root>root_v4"},
+			created: []string{"root_v3", "root_v4"},
+		},
+		{
+			name:    "index left by a failed reindex is skipped",
+			aliases: map[string][]string{"root": {"root_v1"}, "root_write": {"root_v1"}},
+			left:    []string{"root_v2"},
+			source:  ReindexFromPostgres,
+			want:    "root_v3",
+			created: []string{"root_v1", "root_v2", "root_v3"},
+		},
+		{
+			name:    "index not versioned is replaced",
+			aliases: map[string][]string{"root_write": {"root"}},
+			source:  ReindexFromIndex,
+			want:    "root_v1",
+			copies:  []string{"root>root_v1"},
+			created: []string{"root_v1"},
+		},
+		{
+			name:    "missing index",
+			aliases: map[string][]string{},
+			source:  ReindexFromIndex,
+			wantErr: true,
+		},
+		{
+			name:    "unknown source",
+			aliases: map[string][]string{"root": {"root_v1"}},
+			source:  "nowhere",
+			created: []string{"root_v1"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			indices := mock.NewIndices(tt.aliases)
+			es := mock.NewElastic([]model.User{})
+			documents := mock.NewDocuments([]model.User{{ID: 1, Name: "a"}, {ID: 2, Name: "b"}}, "")
+			for _, index := range tt.left {
+				assert.NoError(t, indices.CreateIndex(ctx, index, nil))
+			}
+
+			got, err := Reindex(ctx, indices, es, documents, "root", "root_write", nil, tt.source, 1, slog.Default())
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Equal(t, tt.created, indices.Created(), "no index must be created")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			for _, alias := range []string{"root", "root_write"} {
+				resolved, _ := indices.Resolve(ctx, alias)
+				assert.Equal(t, []string{tt.want}, resolved, "'%s' must point to the index built", alias)
+			}
+			assert.Equal(t, tt.copies, indices.Copies())
+			assert.Equal(t, tt.created, indices.Created())
+			assert.Len(t, es.Documents(), 2, "changed documents must be caught up with")
+		})
+	}
+}
+
+func TestNextIndex(t *testing.T) {
+	assert.Equal(t, "root_v1", nextIndex("root", nil))
+	assert.Equal(t, "root_v1", nextIndex("root", []string{"root"}))
+	assert.Equal(t, "root_v3", nextIndex("root", []string{"root_v2"}))
+	assert.Equal(t, "root_v11", nextIndex("root", []string{"root_v10", "root_v9", "root_vx", "other_v20"}))
+}
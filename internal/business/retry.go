@@ -0,0 +1,54 @@
+package business
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// errStopped is returned by retry when the pipeline stops while backing off
+var errStopped = errors.New("pipeline stopped")
+
+// permanentError marks errors which no retry can resolve, e.g. undecodable payloads
+type permanentError struct {
+	err error
+}
+
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// retry calls fn until it succeeds, up to the configured attempts, backing off exponentially
+// with jitter in between. Returns the attempts made along with the last error
+func (p *Pipeline) retry(fn func() error) (int, error) {
+	attempt := 1
+	for ; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.cfg.RetryAttempts || errors.As(err, &permanentError{}) {
+			return attempt, err
+		}
+		timer := time.NewTimer(backoff(attempt, p.cfg.RetryBaseDelay, p.cfg.RetryMaxDelay))
+		select {
+		case <-timer.C:
+		case <-p.quit:
+			timer.Stop()
+			return attempt, errStopped
+		}
+	}
+}
+
+// backoff returns the delay ahead of the attempt following attempt, doubling from base up to
+// max. Half the delay is jittered, so retries of concurrent failures spread out
+func backoff(attempt int, base, max time.Duration) time.Duration {
+	delay := max
+	if attempt < 63 && base <= max>>(attempt-1) {
+		delay = base << (attempt - 1)
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -4,8 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"pg-to-es/internal/contract"
+	"pg-to-es/internal/logging"
+	"pg-to-es/internal/metrics"
+	"pg-to-es/internal/tracing"
 	"strconv"
 	"time"
 
@@ -16,16 +20,17 @@ type Server struct {
 	srv     *http.Server
 	es      contract.Elastic
 	esIndex string
+	logger  *slog.Logger
 }
 
-func NewServer(es contract.Elastic, port int, esIndex string) *Server {
+func NewServer(es contract.Elastic, port int, esIndex string, logger *slog.Logger) *Server {
 	s := &http.Server{
 		Addr:         fmt.Sprintf(":%d", port),
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 5 * time.Second,
 		Handler:      nil,
 	}
-	return &Server{s, es, esIndex}
+	return &Server{s, es, esIndex, logger}
 }
 
 func (s *Server) InitRoutes() {
@@ -35,7 +40,10 @@ func (s *Server) InitRoutes() {
 	r.HandleFunc("/search/user/{userID}", s.SearchProjectsByUser).Methods("GET")
 	r.HandleFunc("/search/hashtags/{hashtag}", s.SearchProjectsByHashtag).Methods("GET")
 	r.HandleFunc("/search/fuzzy/{query}", s.FuzzySearchProjects).Methods("GET")
-	s.srv.Handler = r
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
+	r.Use(tracing.Middleware)
+	// wraps the router, for requests matching no route to be counted as well
+	s.srv.Handler = metrics.Middleware(r)
 }
 
 func (s *Server) Start() error {
@@ -55,6 +63,7 @@ func (s *Server) Root(w http.ResponseWriter, r *http.Request) {
 		"To search for projects that use specific hashtags visit":   "/search/hashtags/{hashtag}",
 		"To do full-text fuzzy search for projects visit":           "/search/fuzzy/{query}",
 		"To view all indexed documents":                             "/all",
+		"To scrape metrics":                                         "/metrics",
 	}
 	encode(w, res)
 }
@@ -62,7 +71,7 @@ func (s *Server) Root(w http.ResponseWriter, r *http.Request) {
 func (s *Server) GetAll(w http.ResponseWriter, r *http.Request) {
 	res, err := s.es.GetByProjectId(r.Context(), s.esIndex, 0)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.fail(w, r, http.StatusInternalServerError, err)
 		return
 	}
 	encode(w, res)
@@ -72,12 +81,12 @@ func (s *Server) SearchProjectsByUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userID, err := strconv.Atoi(vars["userID"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		s.fail(w, r, http.StatusBadRequest, err)
 		return
 	}
 	res, err := s.es.SearchByUser(r.Context(), s.esIndex, userID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.fail(w, r, http.StatusInternalServerError, err, logging.DocID, userID)
 		return
 	}
 	encode(w, res)
@@ -88,7 +97,7 @@ func (s *Server) SearchProjectsByHashtag(w http.ResponseWriter, r *http.Request)
 	hashtag := vars["hashtag"]
 	res, err := s.es.SearchByHashtags(r.Context(), s.esIndex, hashtag)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.fail(w, r, http.StatusInternalServerError, err)
 		return
 	}
 	encode(w, res)
@@ -99,12 +108,23 @@ func (s *Server) FuzzySearchProjects(w http.ResponseWriter, r *http.Request) {
 	query := vars["query"]
 	res, err := s.es.FuzzySearchProjects(r.Context(), s.esIndex, query)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.fail(w, r, http.StatusInternalServerError, err)
 		return
 	}
 	encode(w, res)
 }
 
+// fail answers r with status & err, logged along with fields. Requests refused are logged as debug only
+func (s *Server) fail(w http.ResponseWriter, r *http.Request, status int, err error, fields ...any) {
+	level := slog.LevelError
+	if status < http.StatusInternalServerError {
+		level = slog.LevelDebug
+	}
+	fields = append(fields, "method", r.Method, "path", r.URL.Path, "status", status, logging.Err(err))
+	s.logger.Log(r.Context(), level, "request failed", fields...)
+	http.Error(w, err.Error(), status)
+}
+
 func encode(w http.ResponseWriter, res interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	encoder := json.NewEncoder(w)
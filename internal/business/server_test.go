@@ -3,6 +3,7 @@ package business
 import (
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"pg-to-es/internal/contract"
@@ -21,6 +22,7 @@ func TestNewServer(t *testing.T) {
 		es      contract.Elastic
 		port    int
 		esIndex string
+		logger  *slog.Logger
 	}
 	tests := []struct {
 		name string
@@ -33,6 +35,7 @@ func TestNewServer(t *testing.T) {
 				es:      nil,
 				port:    0,
 				esIndex: "",
+				logger:  slog.Default(),
 			},
 			want: &Server{
 				srv: &http.Server{
@@ -43,12 +46,13 @@ func TestNewServer(t *testing.T) {
 				},
 				es:      nil,
 				esIndex: "",
+				logger:  slog.Default(),
 			},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := NewServer(tt.args.es, tt.args.port, tt.args.esIndex); !reflect.DeepEqual(got, tt.want) {
+			if got := NewServer(tt.args.es, tt.args.port, tt.args.esIndex, tt.args.logger); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("NewServer() = %v, want %v", got, tt.want)
 			}
 		})
@@ -68,7 +72,7 @@ func TestServer_InitRoutes(t *testing.T) {
 		{
 			name: "handler must get initialized",
 			fields: fields{
-				srv:     NewServer(nil, 0, "").srv,
+				srv:     NewServer(nil, 0, "", slog.Default()).srv,
 				es:      nil,
 				esIndex: "",
 			},
@@ -101,7 +105,7 @@ func TestServer_Start(t *testing.T) {
 		{
 			name: "nil handler should return error",
 			fields: fields{
-				srv:     NewServer(nil, 0, "").srv,
+				srv:     NewServer(nil, 0, "", slog.Default()).srv,
 				es:      nil,
 				esIndex: "",
 			},
@@ -143,7 +147,7 @@ func TestServer_Root(t *testing.T) {
 		{
 			name: "should always return 200 OK",
 			fields: fields{
-				srv:     NewServer(esMock, 0, "").srv,
+				srv:     NewServer(esMock, 0, "", slog.Default()).srv,
 				es:      esMock,
 				esIndex: "",
 			},
@@ -195,7 +199,7 @@ func TestServer_GetAll(t *testing.T) {
 			},
 		},
 	})
-	server := NewServer(esMock, 0, "")
+	server := NewServer(esMock, 0, "", slog.Default())
 	server.InitRoutes()
 	type fields struct {
 		srv     *http.Server
@@ -265,7 +269,7 @@ func TestServer_SearchProjectsByUser(t *testing.T) {
 			},
 		},
 	})
-	server := NewServer(esMock, 0, "")
+	server := NewServer(esMock, 0, "", slog.Default())
 	server.InitRoutes()
 	type fields struct {
 		srv     *http.Server
@@ -355,7 +359,7 @@ func TestServer_SearchProjectsByHashtag(t *testing.T) {
 			},
 		},
 	})
-	server := NewServer(esMock, 0, "")
+	server := NewServer(esMock, 0, "", slog.Default())
 	server.InitRoutes()
 	type fields struct {
 		srv     *http.Server
@@ -428,7 +432,7 @@ func TestServer_FuzzySearchProjects(t *testing.T) {
 			},
 		},
 	})
-	server := NewServer(esMock, 0, "")
+	server := NewServer(esMock, 0, "", slog.Default())
 	server.InitRoutes()
 	type fields struct {
 		srv     *http.Server
@@ -0,0 +1,215 @@
+package business
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"pg-to-es/internal/contract"
+	"pg-to-es/internal/logging"
+	"pg-to-es/internal/metrics"
+	"pg-to-es/internal/model"
+	"sort"
+	"time"
+)
+
+// Verify compares every document of postgres with the one held by index, by hash, & reports the ones
+// missing from index, stale or orphaned (held by index only). The documents found out of sync are compared
+// once more against their current state in postgres, for the ones changed while walked not to be reported.
+// With repair they are then reindexed, or deleted, as per postgres, unless written since compared, as by
+// the pipeline
+func Verify(ctx context.Context, es contract.Elastic, documents contract.Documents, index string, batchSize int,
+	repair bool) (model.Drift, error) {
+	var (
+		drift   model.Drift
+		suspect []string
+		// ids of the documents of postgres
+		held = map[string]bool{}
+	)
+	_, err := documents.Snapshot(ctx, batchSize, func(docs []model.Document) error {
+		ids := make([]string, len(docs))
+		for idx, doc := range docs {
+			ids[idx] = doc.ID
+			held[doc.ID] = true
+		}
+		indexed, err := es.GetDocuments(ctx, index, ids)
+		if err != nil {
+			return fmt.Errorf("es.GetDocuments() failed, err: %w", err)
+		}
+		suspect = append(suspect, drifted(docs, indexed)...)
+		drift.Checked += len(docs)
+		return nil
+	})
+	if err != nil {
+		return drift, fmt.Errorf("documents.Snapshot() failed, err: %w", err)
+	}
+	err = es.ScanIDs(ctx, index, batchSize, func(ids []string) error {
+		for _, id := range ids {
+			if !held[id] {
+				suspect = append(suspect, id)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return drift, fmt.Errorf("es.ScanIDs() failed, err: %w", err)
+	}
+
+	// confirmed against the current state of postgres
+	sort.Strings(suspect)
+	for start := 0; start < len(suspect); start += batchSize {
+		ids := suspect[start:min(start+batchSize, len(suspect))]
+		// read ahead of postgres, for a write of the pipeline made in between to fail the repair rather
+		// than be replaced by an older state
+		indexed, err := es.GetDocuments(ctx, index, ids)
+		if err != nil {
+			return drift, fmt.Errorf("es.GetDocuments() failed, err: %w", err)
+		}
+		current, err := documents.Build(ctx, ids)
+		if err != nil {
+			return drift, fmt.Errorf("documents.Build() failed, err: %w", err)
+		}
+		read := map[string]model.Document{}
+		for _, doc := range indexed {
+			read[doc.ID] = doc
+		}
+		var offenders []model.Document
+		for _, doc := range current {
+			indexed, ok := read[doc.ID]
+			switch {
+			case doc.Source == nil && !ok:
+				continue
+			case doc.Source == nil:
+				drift.Orphaned = append(drift.Orphaned, doc.ID)
+			case !ok:
+				drift.Missing = append(drift.Missing, doc.ID)
+			case !sameDocument(doc.Source, indexed.Source):
+				drift.Stale = append(drift.Stale, doc.ID)
+			default:
+				continue
+			}
+			// repaired only if left as compared, documents versioned already are ordered by their version
+			if doc.Version == 0 {
+				doc.ReadAt = indexed.ReadAt
+				if !ok {
+					doc.ReadAt = &model.ReadVersion{}
+				}
+			}
+			offenders = append(offenders, doc)
+		}
+		if !repair || len(offenders) == 0 {
+			continue
+		}
+		err = es.BulkWrite(ctx, index, offenders)
+		if err != nil {
+			return drift, fmt.Errorf("es.BulkWrite() failed, err: %w", err)
+		}
+		drift.Repaired += len(offenders)
+	}
+	metrics.DriftDocuments.WithLabelValues("missing").Add(float64(len(drift.Missing)))
+	metrics.DriftDocuments.WithLabelValues("stale").Add(float64(len(drift.Stale)))
+	metrics.DriftDocuments.WithLabelValues("orphaned").Add(float64(len(drift.Orphaned)))
+	metrics.DriftRepaired.Add(float64(drift.Repaired))
+	return drift, nil
+}
+
+// verifyEvery runs Verify every VerifyInterval, until stop is closed
+func (p *Pipeline) verifyEvery(ctx context.Context, stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	ticker := time.NewTicker(p.cfg.VerifyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		drift, err := Verify(ctx, p.es, p.documents, p.index, p.cfg.BackfillBatch, p.cfg.VerifyRepair)
+		if err != nil {
+			p.logger.Error("verify failed", logging.Err(err))
+			continue
+		}
+		p.logger.Info("verified documents", "documents", drift.Checked, "missing", len(drift.Missing),
+			"stale", len(drift.Stale), "orphaned", len(drift.Orphaned), "repaired", drift.Repaired)
+	}
+}
+
+// drifted returns the ids of docs missing from indexed or held differently
+func drifted(docs, indexed []model.Document) []string {
+	sources := map[string][]byte{}
+	for _, doc := range indexed {
+		sources[doc.ID] = doc.Source
+	}
+	var ids []string
+	for _, doc := range docs {
+		source, ok := sources[doc.ID]
+		if !ok || !sameDocument(doc.Source, source) {
+			ids = append(ids, doc.ID)
+		}
+	}
+	return ids
+}
+
+// sameDocument compares the hashes of both sources, see documentHash
+func sameDocument(a, b []byte) bool {
+	hashA, errA := documentHash(a)
+	hashB, errB := documentHash(b)
+	return errA == nil && errB == nil && hashA == hashB
+}
+
+// documentHash hashes source regardless of the order of its keys & arrays, null & empty arrays alike
+func documentHash(source []byte) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(source))
+	// keeps large numbers intact
+	dec.UseNumber()
+	var doc interface{}
+	err := dec.Decode(&doc)
+	if err != nil {
+		return "", err
+	}
+	canonical, err := json.Marshal(canonicalize(doc))
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// canonicalize drops null & empty array fields and sorts arrays, keys are sorted by json.Marshal
+func canonicalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		res := map[string]interface{}{}
+		for key, field := range v {
+			if arr, ok := field.([]interface{}); field == nil || ok && len(arr) == 0 {
+				continue
+			}
+			res[key] = canonicalize(field)
+		}
+		return res
+	case []interface{}:
+		items := make([]string, len(v))
+		for idx, item := range v {
+			raw, _ := json.Marshal(canonicalize(item))
+			items[idx] = string(raw)
+		}
+		sort.Strings(items)
+		res := make([]json.RawMessage, len(items))
+		for idx, item := range items {
+			res[idx] = json.RawMessage(item)
+		}
+		return res
+	default:
+		return v
+	}
+}
@@ -0,0 +1,89 @@
+package business
+
+import (
+	"context"
+	"pg-to-es/internal/mock"
+	"pg-to-es/internal/model"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	withProjects := func(id int, name string, projects ...model.Project) model.User {
+		return model.User{ID: id, Name: name, Projects: projects}
+	}
+	postgres := []model.User{
+		withProjects(1, "a", model.Project{ID: 1}, model.Project{ID: 2}),
+		withProjects(2, "b"),
+		withProjects(3, "c"),
+	}
+	indexed := func() []model.User {
+		return []model.User{
+			// projects in another order
+			withProjects(1, "a", model.Project{ID: 2}, model.Project{ID: 1}),
+			withProjects(2, "renamed"),
+			withProjects(4, "d"),
+		}
+	}
+	tests := []struct {
+		name   string
+		repair bool
+		want   model.Drift
+	}{
+		{
+			name: "report",
+			want: model.Drift{Checked: 3, Missing: []string{"3"}, Stale: []string{"2"}, Orphaned: []string{"4"}},
+		},
+		{
+			name:   "repair",
+			repair: true,
+			want:   model.Drift{Checked: 3, Missing: []string{"3"}, Stale: []string{"2"}, Orphaned: []string{"4"}, Repaired: 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			es := mock.NewElastic(indexed())
+
+			got, err := Verify(ctx, es, mock.NewDocuments(postgres, ""), "", 2, tt.repair)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			ids := []int{}
+			for _, doc := range es.Documents() {
+				ids = append(ids, doc.ID)
+			}
+			sort.Ints(ids)
+			if tt.repair {
+				assert.Equal(t, []int{1, 2, 3}, ids, "offenders must be reindexed or deleted")
+				again, err := Verify(ctx, es, mock.NewDocuments(postgres, ""), "", 2, false)
+				assert.NoError(t, err)
+				assert.Equal(t, model.Drift{Checked: 3}, again, "no drift must be left once repaired")
+			} else {
+				assert.Equal(t, []int{1, 2, 4}, ids, "documents must be left as is unless repairing")
+			}
+		})
+	}
+}
+
+func TestDocumentHash(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{name: "key order", a: `{"id":1,"name":"a"}`, b: `{"name":"a","id":1}`, same: true},
+		{name: "array order", a: `{"tags":[{"id":1},{"id":2}]}`, b: `{"tags":[{"id":2},{"id":1}]}`, same: true},
+		{name: "null & empty arrays", a: `{"id":1,"tags":[]}`, b: `{"id":1,"tags":null}`, same: true},
+		{name: "missing & empty arrays", a: `{"id":1,"tags":[]}`, b: `{"id":1}`, same: true},
+		{name: "value", a: `{"id":1,"name":"a"}`, b: `{"id":1,"name":"b"}`},
+		{name: "nested value", a: `{"tags":[{"id":1,"name":"a"}]}`, b: `{"tags":[{"id":1,"name":"b"}]}`},
+		{name: "large numbers", a: `{"id":9007199254740993}`, b: `{"id":9007199254740992}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.same, sameDocument([]byte(tt.a), []byte(tt.b)))
+		})
+	}
+}
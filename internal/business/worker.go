@@ -0,0 +1,397 @@
+package business
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"pg-to-es/internal/contract"
+	"pg-to-es/internal/logging"
+	"pg-to-es/internal/metrics"
+	"pg-to-es/internal/model"
+	"pg-to-es/internal/tracing"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// workerQueueSize is the number of jobs queued per worker before process() blocks
+const workerQueueSize = 64
+
+// job is either a delta to apply or, when flushed is set, a request to flush every write buffered
+type job struct {
+	seq     uint64
+	delta   model.Delta
+	flushed *sync.WaitGroup
+	// earlier deltas of the same row, superseded by delta within the coalescing window
+	merged []job
+	// set once delta failed to apply & was dead-lettered
+	deadLettered bool
+	// table & operation of delta, as labelled in metrics, & when it was received
+	table, operation string
+	received         time.Time
+	// span delta was received in, its processing is traced within
+	span trace.SpanContext
+}
+
+// trace starts a span of name processing j, a child of the span j was received in
+func (j job) trace(ctx context.Context, name string) (context.Context, trace.Span) {
+	ctx = trace.ContextWithSpanContext(ctx, j.span)
+	return tracing.Start(ctx, name, trace.WithAttributes(tracing.Delta(j.delta)...))
+}
+
+// worker applies the deltas of its partition of documents through a bulk of its own
+type worker struct {
+	p    *Pipeline
+	jobs chan job
+	bulk applier
+	// deltas applied or dead-lettered since the last flush
+	batch []job
+	// deltas held for the coalescing window, in order, nil once superseded
+	held []*job
+	// index in held of the last delta of each row
+	heldRows map[string]int
+	// set once the pipeline stopped during a retry, nothing past it may be committed
+	stopped bool
+}
+
+func (w *worker) run(ctx context.Context) {
+	ticker := time.NewTicker(w.bulk.FlushInterval())
+	defer ticker.Stop()
+	// fires once the first delta held was held for the coalescing window
+	var window <-chan time.Time
+	for {
+		select {
+		case j, ok := <-w.jobs:
+			if !ok {
+				w.release(ctx)
+				w.flush(ctx)
+				return
+			}
+			if j.flushed != nil {
+				w.release(ctx)
+				w.flush(ctx)
+				window = nil
+				j.flushed.Done()
+				continue
+			}
+			// deltas of mapped documents are collected by document already
+			if w.p.cfg.CoalesceWindow > 0 && !w.p.mapped {
+				w.hold(j)
+				if window == nil {
+					window = time.After(w.p.cfg.CoalesceWindow)
+				}
+				continue
+			}
+			w.apply(ctx, j)
+			if w.bulk.Full() {
+				w.flush(ctx)
+			}
+		case <-window:
+			window = nil
+			w.release(ctx)
+		case <-ticker.C:
+			if len(w.batch) > 0 {
+				w.flush(ctx)
+			}
+		}
+	}
+}
+
+// hold j for the coalescing window, superseding the delta held for the same row if any
+func (w *worker) hold(j job) {
+	row, operation, ok := rowKey(j.delta.Payload)
+	if !ok {
+		w.held = append(w.held, &j)
+		return
+	}
+	if w.heldRows == nil {
+		w.heldRows = map[string]int{}
+	}
+	if idx, found := w.heldRows[row]; found {
+		if merged, ok := coalesce(*w.held[idx], j, operation); ok {
+			w.held[idx] = nil
+			j = merged
+		}
+	}
+	w.heldRows[row] = len(w.held)
+	w.held = append(w.held, &j)
+}
+
+// release applies every delta held, in order
+func (w *worker) release(ctx context.Context) {
+	for _, j := range w.held {
+		if j == nil {
+			continue
+		}
+		w.apply(ctx, *j)
+		if w.bulk.Full() {
+			w.flush(ctx)
+		}
+	}
+	w.held, w.heldRows = nil, nil
+}
+
+func (w *worker) apply(ctx context.Context, j job) {
+	if w.stopped {
+		return
+	}
+	ctx, span := j.trace(ctx, "pipeline.apply")
+	defer span.End()
+	if w.p.logger.Enabled(ctx, slog.LevelDebug) {
+		w.p.logger.Debug("applying delta", w.p.deltaFields(j.delta)...)
+	}
+	// set once writes buffered conflicted while flushed ahead of an update by query, the batch is
+	// applied anew ahead of the next attempt
+	stale := false
+	attempts, err := w.p.retry(func() error {
+		if stale {
+			err := w.reapply(ctx)
+			if err != nil {
+				return err
+			}
+			stale = false
+		}
+		err := w.bulk.Apply(ctx, j.delta.Payload)
+		if errors.Is(err, contract.ErrConflict) {
+			metrics.ConflictRetries.Inc()
+			stale = true
+		}
+		return err
+	})
+	span.SetAttributes(tracing.Attempts.Int(attempts))
+	switch {
+	case errors.Is(err, errStopped):
+		w.stopped = true
+		return
+	case err != nil:
+		tracing.Fail(span, err)
+		w.p.logger.Error("apply() failed, dead-lettering delta",
+			append(w.p.deltaFields(j.delta), "attempts", attempts, logging.Err(err))...)
+		w.p.deadLetter(ctx, j.delta, attempts, err)
+		j.deadLettered = true
+	}
+	w.batch = append(w.batch, j)
+}
+
+// flush the bulk & complete the batch, dead-lettering the whole batch if the flush fails,
+// as writes can not be told apart per delta. Writes conflicting with changes made to the documents
+// since they were read are applied anew
+func (w *worker) flush(ctx context.Context) {
+	if len(w.batch) == 0 && w.bulk.Len() == 0 {
+		return
+	}
+	// the deltas of a batch belong to as many traces, each one linked to
+	links := make([]trace.Link, 0, len(w.batch))
+	for _, j := range w.batch {
+		links = append(links, trace.Link{SpanContext: j.span})
+		for _, m := range j.merged {
+			links = append(links, trace.Link{SpanContext: m.span})
+		}
+	}
+	ctx, span := tracing.Start(ctx, "pipeline.flush", trace.WithLinks(links...),
+		trace.WithAttributes(tracing.Deltas.Int(len(links))))
+	defer span.End()
+	// set once writes conflicted, the batch is applied anew ahead of the next attempt
+	stale := false
+	attempts, err := w.p.retry(func() error {
+		if stale {
+			err := w.reapply(ctx)
+			if err != nil {
+				return err
+			}
+			stale = false
+		}
+		err := w.bulk.Flush(ctx)
+		if errors.Is(err, contract.ErrConflict) {
+			metrics.ConflictRetries.Inc()
+			stale = true
+		}
+		return err
+	})
+	span.SetAttributes(tracing.Attempts.Int(attempts))
+	if errors.Is(err, errStopped) {
+		// neither completed nor dead-lettered, replayed on restart where the source allows
+		w.stopped = true
+		return
+	}
+	if err != nil {
+		tracing.Fail(span, err)
+		w.p.logger.Error("bulk.Flush() failed, dead-lettering batch", "deltas", len(w.batch), "attempts", attempts, logging.Err(err))
+		for _, j := range w.batch {
+			// dead-lettered once already, as failing to apply
+			if j.deadLettered {
+				continue
+			}
+			w.p.deadLetter(ctx, j.delta, attempts, err)
+		}
+		w.bulk.Reset()
+	}
+	w.p.complete(ctx, w.batch)
+	w.batch = nil
+}
+
+// reapply discards the writes buffered & applies the batch again, on top of the documents as they are now
+func (w *worker) reapply(ctx context.Context) error {
+	w.bulk.Reset()
+	for _, j := range w.batch {
+		if j.deadLettered {
+			continue
+		}
+		err := w.bulk.Apply(ctx, j.delta.Payload)
+		if err != nil {
+			return fmt.Errorf("reapplying delta failed, position: %s, err: %w", j.delta.Position, err)
+		}
+	}
+	return nil
+}
+
+// partition returns the index of the worker, out of n, delta goes to, false if it may target any
+// document & must be applied on its own
+func (p *Pipeline) partition(data string, n int) (int, bool) {
+	if p.mapped {
+		// documents are rebuilt from their current state, any worker will do
+		h := fnv.New32a()
+		h.Write([]byte(data))
+		return int(h.Sum32() % uint32(n)), true
+	}
+	key, ok := documentKey(data)
+	return int(uint(key) % uint(n)), ok
+}
+
+// documentKey returns the id of the only document delta targets, false if it may target any
+// or several. apply must write to no other document for deltas routed by it, as workers apply
+// deltas of distinct documents concurrently
+func documentKey(data string) (int, bool) {
+	type row struct {
+		ID     int `json:"id"`
+		UserID int `json:"user_id"`
+	}
+	var d struct {
+		Operation string          `json:"operation"`
+		Table     string          `json:"table"`
+		Payload   json.RawMessage `json:"payload"`
+		Keys      json.RawMessage `json:"keys"`
+	}
+	err := json.Unmarshal([]byte(data), &d)
+	if err != nil {
+		// dead-lettered by whichever worker picks it up
+		return 0, true
+	}
+	if d.Keys != nil {
+		if d.Operation != "DELETE" {
+			// rebuilds every document holding the row, read from postgres
+			return 0, false
+		}
+		d.Payload = d.Keys
+	}
+	rows, err := decodeRows[row](d.Payload)
+	if err != nil {
+		return 0, true
+	}
+	if d.Operation == "DELETE" {
+		switch {
+		case len(rows) == 1 && d.Table == "users":
+			return rows[0].ID, true
+		case len(rows) == 1 && d.Table == "user_projects":
+			// removes the project from the document of the user only
+			return rows[0].UserID, true
+		}
+		// projects, hashtags & links of hashtags are removed from every document holding them
+		return 0, false
+	}
+	key := 0
+	for _, r := range rows {
+		if r.UserID == 0 {
+			continue
+		}
+		if key > 0 && r.UserID != key {
+			return 0, false
+		}
+		key = r.UserID
+	}
+	// rows of a single document, or of none at all
+	return key, true
+}
+
+// rowKey identifies the row delta changed, along with the operation, false if it can not tell
+func rowKey(data string) (string, string, bool) {
+	type row struct {
+		ID        int `json:"id"`
+		UserID    int `json:"user_id"`
+		ProjectID int `json:"project_id"`
+		HashtagID int `json:"hashtag_id"`
+	}
+	var d struct {
+		Operation string          `json:"operation"`
+		Table     string          `json:"table"`
+		Payload   json.RawMessage `json:"payload"`
+	}
+	err := json.Unmarshal([]byte(data), &d)
+	if err != nil {
+		return "", "", false
+	}
+	rows, err := decodeRows[row](d.Payload)
+	if err != nil || len(rows) == 0 {
+		return "", "", false
+	}
+	// every row of a delta carries the ids of the row changed
+	r := rows[0]
+	var ids []int
+	switch {
+	case d.Operation == "DELETE" && d.Table == "users":
+		ids = []int{r.ID}
+	case d.Operation == "DELETE" && d.Table == "user_projects":
+		ids = []int{r.UserID, r.ProjectID}
+	case d.Operation == "DELETE":
+		return "", "", false
+	case d.Table == "users":
+		ids = []int{r.UserID}
+	case d.Table == "projects":
+		ids = []int{r.ProjectID}
+	case d.Table == "hashtags":
+		ids = []int{r.HashtagID}
+	case d.Table == "project_hashtags":
+		ids = []int{r.ProjectID, r.HashtagID}
+	case d.Table == "user_projects":
+		ids = []int{r.UserID, r.ProjectID}
+	default:
+		return "", "", false
+	}
+	return fmt.Sprint(d.Table, ids), d.Operation, true
+}
+
+// coalesce supersedes prev by next, a later delta of the same row. A row inserted & then updated
+// remains an insert of its latest state, a row deleted is never superseded
+func coalesce(prev, next job, operation string) (job, bool) {
+	prevOperation, _ := operationOf(prev.delta.Payload)
+	if prevOperation == "DELETE" {
+		return next, false
+	}
+	if prevOperation == "INSERT" && operation == "UPDATE" {
+		var d map[string]json.RawMessage
+		err := json.Unmarshal([]byte(next.delta.Payload), &d)
+		if err != nil {
+			return next, false
+		}
+		d["operation"], _ = json.Marshal("INSERT")
+		payload, err := json.Marshal(d)
+		if err != nil {
+			return next, false
+		}
+		next.delta.Payload = string(payload)
+	}
+	prev.merged, next.merged = nil, append(append(next.merged, prev.merged...), prev)
+	return next, true
+}
+
+func operationOf(data string) (string, error) {
+	var d struct {
+		Operation string `json:"operation"`
+	}
+	err := json.Unmarshal([]byte(data), &d)
+	return d.Operation, err
+}
@@ -0,0 +1,104 @@
+package business
+
+import (
+	"context"
+	"log/slog"
+	"pg-to-es/internal/config"
+	"pg-to-es/internal/mock"
+	"pg-to-es/internal/model"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorker_hold(t *testing.T) {
+	tests := []struct {
+		name     string
+		payloads []string
+		want     []string
+	}{
+		{
+			name: "updates of a row should merge into the last one",
+			payloads: []string{
+				`{"operation":"UPDATE","table":"projects","payload":{"user_id":1,"project_id":2,"project_name":"a"}}`,
+				`{"operation":"UPDATE","table":"projects","payload":{"user_id":1,"project_id":2,"project_name":"b"}}`,
+			},
+			want: []string{
+				`{"operation":"UPDATE","table":"projects","payload":{"user_id":1,"project_id":2,"project_name":"b"}}`,
+			},
+		},
+		{
+			name: "insert followed by update should remain an insert of the latest state",
+			payloads: []string{
+				`{"operation":"INSERT","table":"users","payload":{"user_id":1,"user_name":"a"}}`,
+				`{"operation":"UPDATE","table":"users","payload":{"user_id":1,"user_name":"b"}}`,
+			},
+			want: []string{
+				`{"operation":"INSERT","payload":{"user_id":1,"user_name":"b"},"table":"users"}`,
+			},
+		},
+		{
+			name: "delete should supersede update, but not be superseded",
+			payloads: []string{
+				`{"operation":"UPDATE","table":"users","payload":{"user_id":1,"user_name":"a"}}`,
+				`{"operation":"DELETE","table":"users","payload":{"id":1}}`,
+				`{"operation":"INSERT","table":"users","payload":{"user_id":1,"user_name":"b"}}`,
+			},
+			want: []string{
+				`{"operation":"DELETE","table":"users","payload":{"id":1}}`,
+				`{"operation":"INSERT","table":"users","payload":{"user_id":1,"user_name":"b"}}`,
+			},
+		},
+		{
+			name: "distinct rows should keep their order",
+			payloads: []string{
+				`{"operation":"UPDATE","table":"projects","payload":{"user_id":1,"project_id":2}}`,
+				`{"operation":"UPDATE","table":"projects","payload":{"user_id":1,"project_id":3}}`,
+				`{"operation":"UPDATE","table":"projects","payload":{"user_id":1,"project_id":2}}`,
+			},
+			want: []string{
+				`{"operation":"UPDATE","table":"projects","payload":{"user_id":1,"project_id":3}}`,
+				`{"operation":"UPDATE","table":"projects","payload":{"user_id":1,"project_id":2}}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &worker{}
+			for idx, payload := range tt.payloads {
+				w.hold(job{seq: uint64(idx + 1), delta: model.Delta{Payload: payload}})
+			}
+			var got []string
+			merged := 0
+			for _, j := range w.held {
+				if j != nil {
+					got = append(got, j.delta.Payload)
+					merged += 1 + len(j.merged)
+				}
+			}
+			assert.Equal(t, tt.want, got, "held deltas must match")
+			assert.Equal(t, len(tt.payloads), merged, "every delta must be either held or merged")
+		})
+	}
+}
+
+func TestPipeline_coalesce(t *testing.T) {
+	ctx := context.Background()
+	es := mock.NewElastic([]model.User{})
+	listener := mock.NewDbListener()
+	checkpoint := mock.NewCheckpoint("")
+	cfg := config.Pipeline{Workers: 2, CoalesceWindow: 50 * time.Millisecond}
+	pipeline := NewPipeline(listener, es, checkpoint, mock.NewDeadLetters(), mock.NewDocuments(nil, ""), "", cfg, slog.Default())
+	assert.NoError(t, pipeline.Start(ctx))
+	defer pipeline.Stop()
+
+	listener.Push(model.Delta{Position: "1/0:1", Payload: `{"operation":"INSERT","table":"users","payload":{"user_id":1,"user_name":"a"}}`})
+	listener.Push(model.Delta{Position: "1/0:2", Payload: `{"operation":"UPDATE","table":"users","payload":{"user_id":1,"user_name":"b"}}`})
+	assert.Eventually(t, func() bool {
+		position, _ := checkpoint.Load(ctx)
+		return position == "1/0:2"
+	}, time.Second, 10*time.Millisecond, "merged deltas must be committed")
+	assert.Equal(t, []model.User{{ID: 1, Name: "b", Projects: []model.Project{}}}, es.Documents(),
+		"only the latest state must be written")
+}
@@ -3,7 +3,6 @@ package config
 import (
 	"errors"
 	"fmt"
-	"log"
 	"net/url"
 	"time"
 
@@ -13,20 +12,150 @@ import (
 
 type App struct {
 	conf.Version
-	Pg     Pg
-	Es     Es
-	Server Server
+	Args     conf.Args
+	Pg       Pg
+	Es       Es
+	Server   Server
+	Pipeline Pipeline
+	Bus      Bus
+	Tracing  Tracing
+	Log      Log
 }
 
 type Es struct {
-	Host  string `conf:"required"`
+	Host string `conf:"required"`
+	// alias the documents are read through, in front of versioned indices (<Index>_v1, <Index>_v2...)
 	Index string `conf:"default:root"`
+	// alias the documents are written through, <Index>_write when empty
+	WriteAlias string
+	// path of the settings & mappings (JSON) the index is created with, the ones of users when empty
+	IndexMapping      string
+	BulkActions       int           `conf:"default:1000"`
+	BulkBytes         int           `conf:"default:5242880"`
+	BulkFlushInterval time.Duration `conf:"default:1s"`
+	// run updates by query as tasks polled every TaskPollInterval, rather than waiting on them
+	UpdateByQueryAsync bool          `conf:"default:false"`
+	TaskPollInterval   time.Duration `conf:"default:1s"`
+	// delay ahead of updating anew the documents changed during an update by query, doubling every attempt
+	ConflictBackoff time.Duration `conf:"default:100ms"`
 }
 
 type Server struct {
 	Port int `conf:"default:8080"`
 }
 
+type Pipeline struct {
+	CheckpointStore string `conf:"default:postgres"`
+	CheckpointFile  string `conf:"default:pipeline.checkpoint"`
+	CheckpointName  string `conf:"default:pipeline"`
+	BackfillBatch   int    `conf:"default:500"`
+	// deltas of distinct documents are applied by this many workers in parallel
+	Workers int `conf:"default:4"`
+	// deltas of the same row within this window are merged into one, 0 disables coalescing
+	CoalesceWindow time.Duration `conf:"default:0s"`
+	// attempts made at applying a delta before it is dead-lettered
+	RetryAttempts   int           `conf:"default:5"`
+	RetryBaseDelay  time.Duration `conf:"default:100ms"`
+	RetryMaxDelay   time.Duration `conf:"default:10s"`
+	DeadLetterStore string        `conf:"default:postgres"`
+	DeadLetterFile  string        `conf:"default:pipeline.dlq.ndjson"`
+	// path of a mapping file (YAML or JSON) documents are built as per, see Events
+	Mapping string
+	// what changes carry, one of Events*. Defaults to EventsRows along with a mapping, else EventsPayload
+	Events string
+	// directory of the on-disk queue deltas are buffered in, empty disables queueing
+	QueueDir          string
+	QueueSegmentBytes int64 `conf:"default:67108864"`
+	// documents are verified against postgres this often, 0 disables verifying
+	VerifyInterval time.Duration `conf:"default:0s"`
+	// documents found out of sync by verifying are repaired
+	VerifyRepair bool `conf:"default:false"`
+	// resyncs of listener gaps start this far apart at the least, gaps reported meanwhile are merged
+	ResyncInterval time.Duration `conf:"default:1m"`
+	// pipelines sharing LeaderName elect a single leader, the only one consuming deltas, through a postgres
+	// advisory lock. Empty disables leader election
+	LeaderName string `conf:"default:pipeline"`
+	// standbys attempt at leading, & the leader checks its session, this often
+	LeaderInterval time.Duration `conf:"default:2s"`
+	// port of the admin server reporting health & readiness, 0 disables it
+	AdminPort int `conf:"default:8081"`
+}
+
+// WriteIndex returns the alias the documents are written through
+func (es Es) WriteIndex() string {
+	if es.WriteAlias != "" {
+		return es.WriteAlias
+	}
+	return es.Index + "_write"
+}
+
+// Supported values of Pipeline.CheckpointStore
+const (
+	CheckpointStorePostgres = "postgres"
+	CheckpointStoreFile     = "file"
+)
+
+// Supported values of Pipeline.Events
+const (
+	// denormalized rows of the legacy tables, patched into the documents held
+	EventsPayload = "payload"
+	// the row changed, documents holding it are rebuilt from postgres
+	EventsRows = "rows"
+	// the primary key of the row changed, documents holding it are rebuilt from postgres
+	EventsKeys = "keys"
+)
+
+// Supported values of Pipeline.DeadLetterStore
+const (
+	DeadLetterStorePostgres = "postgres"
+	DeadLetterStoreFile     = "file"
+)
+
+// Bus carries deltas from the listener to the pipeline, for them to run as separate processes
+type Bus struct {
+	// one of BusMode*, empty for deltas to be handed over to the pipeline directly
+	Mode    string
+	URL     string `conf:"default:nats://localhost:4222"`
+	Stream  string `conf:"default:pg_to_es"`
+	Subject string `conf:"default:pg_to_es.deltas"`
+	// durable consumer the pipeline consumes through
+	Consumer string `conf:"default:pipeline"`
+	// deltas consumed & not acknowledged within AckWait are delivered anew
+	AckWait time.Duration `conf:"default:5m"`
+}
+
+// Supported values of Bus.Mode
+const (
+	// within the process, the listener & the pipeline can not run apart
+	BusModeMemory = "memory"
+	// through a NATS JetStream stream
+	BusModeNats = "nats"
+)
+
+// Tracing exports spans over OTLP, for a change to be followed from postgres to elasticsearch
+type Tracing struct {
+	// OTLP/HTTP endpoint spans are exported to, such as http://localhost:4318, empty disables exporting
+	Endpoint string
+	// share of the traces started which are sampled, traces continued follow their parent
+	SampleRatio float64 `conf:"default:1"`
+}
+
+// Log configures the logs of both binaries
+type Log struct {
+	// one of debug, info, warn or error
+	Level string `conf:"default:info"`
+	// one of LogFormat*
+	Format string `conf:"default:text"`
+	// log the data changed along with deltas, redacted otherwise
+	Payloads bool `conf:"default:false"`
+}
+
+// Supported values of Log.Format
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
 type Pg struct {
 	Host                         string        `conf:"required"`
 	Port                         string        `conf:"required"`
@@ -41,8 +170,23 @@ type Pg struct {
 	ListenerMinReconnectInterval time.Duration `conf:"default:1s"`
 	ListenerMaxReconnectInterval time.Duration `conf:"default:2s"`
 	ListenerChannel              string        `conf:"required"`
+	ListenerMode                 string        `conf:"default:notify"`
+	ReplicationSlot              string        `conf:"default:pg_to_es"`
+	ReplicationPublication       string        `conf:"default:pg_to_es"`
+	ReplicationPollInterval      time.Duration `conf:"default:1s"`
+	ReplicationBatchSize         int           `conf:"default:1000"`
+	OutboxPollInterval           time.Duration `conf:"default:5s"`
+	OutboxBatchSize              int           `conf:"default:1000"`
+	OutboxRetention              time.Duration `conf:"default:24h"`
 }
 
+// Supported values of Pg.ListenerMode
+const (
+	ListenerModeNotify      = "notify"
+	ListenerModeReplication = "replication"
+	ListenerModeOutbox      = "outbox"
+)
+
 func (pg Pg) String() string {
 	sslMode := "require"
 	if pg.DisableTLS {
@@ -70,7 +214,7 @@ func Load() (App, error) {
 	}
 	err := godotenv.Load(".env")
 	if err != nil {
-		log.Fatalln("error loading .env file", err)
+		return cfg, fmt.Errorf("godotenv.Load() failed, err: %w", err)
 	}
 	help, err := conf.Parse("", &cfg)
 	if err != nil {
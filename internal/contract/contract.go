@@ -2,24 +2,178 @@ package contract
 
 import (
 	"context"
+	"errors"
 	"pg-to-es/internal/model"
+	"time"
 )
 
+// ErrConflict is returned for writes rejected as the document changed since it was read
+var ErrConflict = errors.New("version conflict")
+
+// ErrNotFound is returned for reads of documents not held
+var ErrNotFound = errors.New("document not found")
+
 type Elastic interface {
 	Create(ctx context.Context, index string, id int, doc model.User) error
 	GetByProjectId(ctx context.Context, index string, projectId int) ([]model.User, error)
 	GetByHashTagId(ctx context.Context, index string, hashTagId int) ([]model.User, error)
 	GetByUserId(ctx context.Context, index string, userId int) (*model.User, error)
-	RemoveProject(ctx context.Context, index string, projectId int) error
-	RemoveHashtag(ctx context.Context, index string, hashtagId int) error
+	// RemoveProject removes the project from every document holding it, within elasticsearch
+	RemoveProject(ctx context.Context, index string, projectId int) (model.UpdateResult, error)
+	// RemoveHashtag removes the hashtag from every project holding it, within elasticsearch
+	RemoveHashtag(ctx context.Context, index string, hashtagId int) (model.UpdateResult, error)
+	// RemoveProjectHashtag removes the hashtag from the project only, in every document holding it, within elasticsearch
+	RemoveProjectHashtag(ctx context.Context, index string, projectId, hashtagId int) (model.UpdateResult, error)
 	Update(ctx context.Context, index string, id int, user model.User) error
 	Delete(ctx context.Context, index string, id int) error
+	// BulkWrite indexes, or deletes, documents in a single bulk request
+	BulkWrite(ctx context.Context, index string, docs []model.Document) error
+	// GetDocuments returns the documents of ids found, regardless of their shape
+	GetDocuments(ctx context.Context, index string, ids []string) ([]model.Document, error)
+	// ScanIDs walks the ids of every document, in batches of batchSize
+	ScanIDs(ctx context.Context, index string, batchSize int, fn func(ids []string) error) error
+	Bulk(index string) Bulk
+	// Ping checks elasticsearch is reachable
+	Ping(ctx context.Context) error
 	SearchByUser(ctx context.Context, index string, userID int) (*model.User, error)
 	SearchByHashtags(ctx context.Context, index string, hashtag string) ([]model.User, error)
 	FuzzySearchProjects(ctx context.Context, index string, query string) ([]model.FuzzyResult, error)
 }
 
+// Bulk buffers writes to a single index, sending them in bulk on Flush.
+// Reads through Bulk observe its buffered writes
+type Bulk interface {
+	Index(doc model.User)
+	Delete(id int)
+	GetByUserId(ctx context.Context, userId int) (*model.User, error)
+	RemoveProject(ctx context.Context, projectId int) error
+	RemoveHashtag(ctx context.Context, hashtagId int) error
+	RemoveProjectHashtag(ctx context.Context, projectId, hashtagId int) error
+	// Len returns the number of buffered writes
+	Len() int
+	// Full reports whether the buffer should be flushed right away
+	Full() bool
+	// FlushInterval returns the longest writes should stay buffered
+	FlushInterval() time.Duration
+	// Flush sends every buffered write, the ones which failed stay buffered for a retry.
+	// Writes of documents changed since they were read through Bulk are dropped & reported
+	// as ErrConflict, to be applied again on top of the current documents
+	Flush(ctx context.Context) error
+	// Reset discards every buffered write
+	Reset()
+}
+
+// Indices manages the versioned indices behind the aliases documents are read & written through
+type Indices interface {
+	// Resolve returns the indices name stands for, name itself when not an alias, none when missing
+	Resolve(ctx context.Context, name string) ([]string, error)
+	// List returns the indices matching pattern, wildcards included, sorted
+	List(ctx context.Context, pattern string) ([]string, error)
+	// CreateIndex creates index as per definition, its settings & mappings
+	CreateIndex(ctx context.Context, index string, definition []byte) error
+	// CopyIndex copies every document of from into to, within elasticsearch, returning their number
+	CopyIndex(ctx context.Context, from, to string) (int64, error)
+	// SwapAliases points every alias to index only, at once. Indices named like an alias are deleted
+	SwapAliases(ctx context.Context, index string, aliases ...string) error
+}
+
 type DbListener interface {
-	Start(ctx context.Context) (<-chan string, error)
+	// Prepare the source to retain every change committed from now on, ahead of Start
+	Prepare(ctx context.Context) error
+	// Start streaming deltas, resuming after position from (empty for the earliest available)
+	Start(ctx context.Context, from string) (<-chan model.Delta, error)
+	// Ack acknowledges every delta up to & including position has been indexed
+	Ack(ctx context.Context, position string) error
+	// Gaps streams the periods changes may have been missed during, nil for listeners which
+	// never miss changes
+	Gaps() <-chan model.Gap
 	Stop()
 }
+
+// EventProducer is the half of an EventBus deltas are published to, by the listener
+type EventProducer interface {
+	// Publish hands delta over to the bus, returning once the bus holds it. Deltas are consumed in order
+	Publish(ctx context.Context, delta model.Delta) error
+	// Position returns the position in its source of the last delta published, empty if none, for
+	// the listener to resume after
+	Position(ctx context.Context) (string, error)
+	// Acked returns the position in its source of the last delta the consumer acknowledged, empty if none,
+	// for the listener to release deltas only once indexed
+	Acked(ctx context.Context) (string, error)
+}
+
+// EventConsumer is the half of an EventBus deltas are consumed from, by the pipeline
+type EventConsumer interface {
+	// Consume streams the deltas published after position from, a position of the bus, or after the
+	// last one acknowledged when empty, including the ones published later, until ctx is done. Deltas
+	// carry positions of the bus
+	Consume(ctx context.Context, from string) (<-chan model.Delta, error)
+	// Ack acknowledges every delta up to & including position has been indexed
+	Ack(ctx context.Context, position string) error
+}
+
+// EventBus carries deltas from the listener to the pipeline, for them to run as separate processes
+type EventBus interface {
+	EventProducer
+	EventConsumer
+	Close() error
+}
+
+// Connection is implemented by the listeners holding a connection to their source
+type Connection interface {
+	// Connected reports whether the source was reachable, as of the last attempt at it
+	Connected() bool
+}
+
+// Backlog is implemented by the listeners buffering deltas ahead of indexing
+type Backlog interface {
+	// Depth returns the number of deltas buffered & not acknowledged yet
+	Depth() int
+}
+
+// Leader elects a single pipeline among the ones sharing a name
+type Leader interface {
+	// Campaign blocks until leading, or ctx is done
+	Campaign(ctx context.Context) error
+	IsLeader() bool
+	// Lost is closed once leadership is lost
+	Lost() <-chan struct{}
+	// Close resigns
+	Close() error
+}
+
+type Checkpoint interface {
+	// Load the last committed position, empty if none was committed yet
+	Load(ctx context.Context) (string, error)
+	Save(ctx context.Context, position string) error
+}
+
+type Documents interface {
+	// Snapshot walks every document, in batches, as of a single consistent snapshot & returns
+	// the listener position from which exactly the changes the snapshot does not cover follow
+	Snapshot(ctx context.Context, batchSize int, fn func([]model.Document) error) (string, error)
+	// Build reads the current state of the documents of ids, the ones no longer found carry no source
+	Build(ctx context.Context, ids []string) ([]model.Document, error)
+}
+
+// KeyedDocuments reads the documents holding a row from its keys alone, for the changes notified by key
+type KeyedDocuments interface {
+	Documents
+	// Holding returns the ids of the documents holding the row of table keys identifies
+	Holding(ctx context.Context, table string, keys map[string]int) ([]string, error)
+}
+
+// MappedDocuments builds documents as described by a mapping.Mapping, rather than incrementally
+type MappedDocuments interface {
+	Documents
+	// Roots returns the ids of the documents holding row, a row of table
+	Roots(ctx context.Context, table string, row map[string]interface{}) ([]string, error)
+}
+
+// DeadLetters persists the deltas the pipeline gave up on, for inspection & replay
+type DeadLetters interface {
+	Add(ctx context.Context, letter model.DeadLetter) error
+	// List every dead letter, oldest first
+	List(ctx context.Context) ([]model.DeadLetter, error)
+	Remove(ctx context.Context, id int64) error
+}
@@ -0,0 +1,79 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"fmt"
+	"pg-to-es/internal/config"
+	"strings"
+	"text/template"
+
+	"github.com/lib/pq"
+)
+
+//go:embed notify.sql
+var notifySQL string
+
+var notifyTemplate = template.Must(template.New("notify").Parse(notifySQL))
+
+// NotifySQL generates notify_trigger(), notifying changes on the configured channel, along with a
+// trigger per table, the legacy tables when none are given. Changes carry the denormalized payload
+// of the legacy tables, the row changed or its primary key only, as per events (config.Events*).
+// Triggers of tables no longer listed are dropped
+func NotifySQL(cfg config.Pg, events string, tables []string) (string, error) {
+	type table struct{ Table, Trigger, Literal string }
+	var listed []table
+	if tables != nil {
+		for _, name := range tables {
+			listed = append(listed, table{pq.QuoteIdentifier(name), pq.QuoteIdentifier(triggerName(name)), pq.QuoteLiteral(name)})
+		}
+	} else {
+		for _, t := range triggers {
+			listed = append(listed, table{t.Table, t.Trigger, pq.QuoteLiteral(t.Table)})
+		}
+	}
+	switch events {
+	case config.EventsPayload, config.EventsRows, config.EventsKeys:
+	default:
+		return "", fmt.Errorf("unknown events '%s'", events)
+	}
+	var stmt strings.Builder
+	err := notifyTemplate.Execute(&stmt, struct {
+		Channel string
+		Events  string
+		Tables  []table
+	}{pq.QuoteLiteral(cfg.ListenerChannel), events, listed})
+	if err != nil {
+		return "", fmt.Errorf("notifyTemplate.Execute() failed, err: %w", err)
+	}
+	return stmt.String(), nil
+}
+
+// InstallNotify (re)creates notify_trigger() & the triggers generated by NotifySQL
+func InstallNotify(ctx context.Context, cfg config.Pg, events string, tables []string) error {
+	stmt, err := NotifySQL(cfg, events, tables)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open("postgres", cfg.String())
+	if err != nil {
+		return fmt.Errorf("sql.Open() failed, err: %w", err)
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, stmt)
+	if err != nil {
+		return fmt.Errorf("installing notify triggers failed, err: %w", err)
+	}
+	return nil
+}
+
+// triggerName keeps the names 000001_schema.up.sql gave triggers
+func triggerName(table string) string {
+	for _, t := range triggers {
+		if t.Table == table {
+			return t.Trigger
+		}
+	}
+	return table + "_notify"
+}
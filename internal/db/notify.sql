@@ -0,0 +1,143 @@
+--*******
+-- Create Notification Function, generated for channel {{.Channel}}
+--*******
+BEGIN;
+CREATE OR REPLACE FUNCTION notify_trigger() RETURNS TRIGGER AS $$
+DECLARE notification_json jsonb;
+notification_text text;
+changed_row jsonb;
+{{- if eq .Events "keys"}}
+BEGIN IF (TG_OP = 'DELETE') THEN changed_row = to_jsonb(OLD);
+ELSE changed_row = to_jsonb(NEW);
+END IF;
+-- primary key columns only
+SELECT jsonb_object_agg(A.attname, changed_row->A.attname) INTO notification_json
+FROM pg_index I
+    JOIN pg_attribute A ON A.attrelid = I.indrelid
+    AND A.attnum = ANY(I.indkey)
+WHERE I.indrelid = TG_RELID
+    AND I.indisprimary;
+{{- else}}
+BEGIN IF (TG_OP = 'DELETE') THEN notification_json = row_to_json(OLD);
+{{- if eq .Events "rows"}}
+ELSE notification_json = row_to_json(NEW);
+{{- else}}
+ELSE changed_row = to_jsonb(NEW);
+SELECT json_agg(
+        json_build_object(
+        'user_id',
+        U.id,
+        'user_name',
+        U.name,
+        'user_created_at',
+        U.created_at,
+        'project_id',
+        P.id,
+        'project_name',
+        P.name,
+        'project_slug',
+        P.slug,
+        'project_description',
+        P.description,
+        'project_created_at',
+        P.created_at,
+        'hashtag_id',
+        H.id,
+        'hashtag_name',
+        H.name,
+        'hashtag_created_at',
+        H.created_at,
+        'operation',
+        TG_OP,
+        'table',
+        TG_TABLE_NAME
+        )
+        ORDER BY U.id,
+        P.id,
+        H.id
+    ) INTO notification_json
+FROM users U
+    -- a row per document affected, joining only what the change may affect
+    LEFT JOIN user_projects UP ON U.id = UP.user_id
+    AND TG_TABLE_NAME != 'users'
+    LEFT JOIN projects P ON UP.project_id = P.id
+    LEFT JOIN project_hashtags PH ON P.id = PH.project_id
+    AND TG_TABLE_NAME != 'projects'
+    LEFT JOIN hashtags H ON PH.hashtag_id = H.id
+WHERE CASE
+        TG_TABLE_NAME
+        WHEN 'users' THEN U.id = (changed_row->>'id')::int
+        WHEN 'projects' THEN P.id = (changed_row->>'id')::int
+        WHEN 'hashtags' THEN H.id = (changed_row->>'id')::int
+        WHEN 'project_hashtags' THEN PH.hashtag_id = (changed_row->>'hashtag_id')::int
+        AND PH.project_id = (changed_row->>'project_id')::int
+        WHEN 'user_projects' THEN UP.project_id = (changed_row->>'project_id')::int
+        AND UP.user_id = (changed_row->>'user_id')::int
+    END;
+{{- end}}
+END IF;
+{{- end}}
+notification_text = json_build_object(
+    'operation',
+    TG_OP,
+    'table',
+    TG_TABLE_NAME,
+    -- 32 bit, as logical decoding & pg_stat_activity report it
+    'txid',
+    txid_current() % 4294967296,
+    'payload',
+    notification_json
+)::text;
+{{- if eq .Events "payload"}}
+-- payloads of 8000 bytes & more fail the transaction, the change is then notified by the ids of the row
+-- changed, for the pipeline to read the documents holding it from postgres
+IF octet_length(notification_text) >= 8000 THEN
+SELECT jsonb_object_agg(C.key, C.value) INTO notification_json
+FROM jsonb_each(
+        CASE
+            WHEN TG_OP = 'DELETE' THEN to_jsonb(OLD)
+            ELSE to_jsonb(NEW)
+        END
+    ) C
+WHERE C.key = 'id'
+    OR C.key LIKE '%\_id';
+notification_text = json_build_object(
+    'operation',
+    TG_OP,
+    'table',
+    TG_TABLE_NAME,
+    'txid',
+    txid_current() % 4294967296,
+    'keys',
+    notification_json
+)::text;
+END IF;
+{{- end}}
+PERFORM pg_notify({{.Channel}}, notification_text);
+RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+--*******
+-- Drop Triggers of tables no longer listed
+--*******
+DO $$
+DECLARE t record;
+BEGIN FOR t IN
+SELECT tgname,
+    tgrelid::regclass AS rel
+FROM pg_trigger
+WHERE tgfoid = 'notify_trigger'::regproc
+    AND NOT tgrelid::regclass::text = ANY(ARRAY[{{range $idx, $t := .Tables}}{{if $idx}}, {{end}}{{$t.Literal}}{{end}}]::text[]) LOOP EXECUTE format('DROP TRIGGER %I ON %s', t.tgname, t.rel);
+END LOOP;
+END $$;
+--*******
+-- Create Triggers
+--*******
+{{range .Tables}}DROP TRIGGER IF EXISTS {{.Trigger}} ON {{.Table}};
+CREATE TRIGGER {{.Trigger}}
+AFTER
+INSERT
+    OR
+UPDATE
+    OR DELETE ON {{.Table}} FOR EACH ROW EXECUTE PROCEDURE notify_trigger();
+{{end}}COMMIT;
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"pg-to-es/internal/config"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotifySQL(t *testing.T) {
+	tests := []struct {
+		name     string
+		events   string
+		tables   []string
+		contains []string
+		excludes []string
+	}{
+		{
+			name:   "legacy tables should be notified denormalized, on the configured channel",
+			events: config.EventsPayload,
+			contains: []string{
+				"PERFORM pg_notify('pipeline_events', notification_text);",
+				"WHEN 'user_projects' THEN",
+				"DROP TRIGGER IF EXISTS user_notify ON users;",
+				"DROP TRIGGER IF EXISTS project_hashtags_notify ON project_hashtags;",
+				"ANY(ARRAY['users', 'hashtags', 'projects', 'project_hashtags', 'user_projects']::text[])",
+				"'txid',\n    txid_current() % 4294967296,",
+				"IF octet_length(notification_text) >= 8000 THEN",
+				"'keys',\n    notification_json",
+			},
+			excludes: []string{"core_db_event"},
+		},
+		{
+			name:   "rows should be notified raw",
+			events: config.EventsRows,
+			tables: []string{"users", "tasks"},
+			contains: []string{
+				"ELSE notification_json = row_to_json(NEW);",
+				`CREATE TRIGGER "user_notify"`,
+				`OR DELETE ON "tasks" FOR EACH ROW EXECUTE PROCEDURE notify_trigger();`,
+				"ANY(ARRAY['users', 'tasks']::text[])",
+			},
+			excludes: []string{"json_build_object(\n        'user_id'", "project_hashtags", "octet_length"},
+		},
+		{
+			name:   "keys should be notified alone",
+			events: config.EventsKeys,
+			tables: []string{"users"},
+			contains: []string{
+				"SELECT jsonb_object_agg(A.attname, changed_row->A.attname) INTO notification_json",
+				"AND I.indisprimary;",
+			},
+			excludes: []string{"row_to_json"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NotifySQL(config.Pg{ListenerChannel: "pipeline_events"}, tt.events, tt.tables)
+			assert.NoError(t, err)
+			for _, s := range tt.contains {
+				assert.Contains(t, got, s)
+			}
+			for _, s := range tt.excludes {
+				assert.NotContains(t, got, s)
+			}
+		})
+	}
+}
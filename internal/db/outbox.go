@@ -0,0 +1,50 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"fmt"
+	"pg-to-es/internal/config"
+	"strings"
+	"text/template"
+
+	"github.com/lib/pq"
+)
+
+//go:embed outbox.sql
+var outboxSQL string
+
+var outboxTemplate = template.Must(template.New("outbox").Parse(outboxSQL))
+
+// triggers created by 000001_schema.up.sql, by table
+var triggers = []struct{ Table, Trigger string }{
+	{"users", "user_notify"},
+	{"hashtags", "hashtag_notify"},
+	{"projects", "project_notify"},
+	{"project_hashtags", "project_hashtags_notify"},
+	{"user_projects", "user_projects_notify"},
+}
+
+// InstallOutbox creates the es_outbox table & points every trigger at outbox_trigger(),
+// which writes events to es_outbox & notifies their id only on the configured channel
+func InstallOutbox(ctx context.Context, cfg config.Pg) error {
+	var stmt strings.Builder
+	err := outboxTemplate.Execute(&stmt, struct {
+		Channel string
+		Tables  interface{}
+	}{pq.QuoteLiteral(cfg.ListenerChannel), triggers})
+	if err != nil {
+		return fmt.Errorf("outboxTemplate.Execute() failed, err: %w", err)
+	}
+	db, err := sql.Open("postgres", cfg.String())
+	if err != nil {
+		return fmt.Errorf("sql.Open() failed, err: %w", err)
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, stmt.String())
+	if err != nil {
+		return fmt.Errorf("installing outbox failed, err: %w", err)
+	}
+	return nil
+}
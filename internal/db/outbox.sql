@@ -0,0 +1,103 @@
+--*******
+-- Outbox table, events are kept until the pipeline marks them processed
+--*******
+BEGIN;
+CREATE TABLE IF NOT EXISTS es_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    processed_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS es_outbox_pending ON es_outbox (id)
+WHERE processed_at IS NULL;
+--*******
+-- Create Outbox Function, writes the event & notifies its id only
+--*******
+CREATE OR REPLACE FUNCTION outbox_trigger() RETURNS TRIGGER AS $$
+DECLARE notification_json jsonb;
+changed_row jsonb;
+event_id bigint;
+BEGIN IF (TG_OP != 'DELETE') THEN changed_row = to_jsonb(NEW);
+SELECT json_agg(
+        json_build_object(
+        'user_id',
+        U.id,
+        'user_name',
+        U.name,
+        'user_created_at',
+        U.created_at,
+        'project_id',
+        P.id,
+        'project_name',
+        P.name,
+        'project_slug',
+        P.slug,
+        'project_description',
+        P.description,
+        'project_created_at',
+        P.created_at,
+        'hashtag_id',
+        H.id,
+        'hashtag_name',
+        H.name,
+        'hashtag_created_at',
+        H.created_at,
+        'operation',
+        TG_OP,
+        'table',
+        TG_TABLE_NAME
+        )
+        ORDER BY U.id,
+        P.id,
+        H.id
+    ) INTO notification_json
+FROM users U
+    -- a row per document affected, joining only what the change may affect
+    LEFT JOIN user_projects UP ON U.id = UP.user_id
+    AND TG_TABLE_NAME != 'users'
+    LEFT JOIN projects P ON UP.project_id = P.id
+    LEFT JOIN project_hashtags PH ON P.id = PH.project_id
+    AND TG_TABLE_NAME != 'projects'
+    LEFT JOIN hashtags H ON PH.hashtag_id = H.id
+WHERE CASE
+        TG_TABLE_NAME
+        WHEN 'users' THEN U.id = (changed_row->>'id')::int
+        WHEN 'projects' THEN P.id = (changed_row->>'id')::int
+        WHEN 'hashtags' THEN H.id = (changed_row->>'id')::int
+        WHEN 'project_hashtags' THEN PH.hashtag_id = (changed_row->>'hashtag_id')::int
+        AND PH.project_id = (changed_row->>'project_id')::int
+        WHEN 'user_projects' THEN UP.project_id = (changed_row->>'project_id')::int
+        AND UP.user_id = (changed_row->>'user_id')::int
+    END;
+ELSE notification_json = row_to_json(OLD);
+END IF;
+INSERT INTO es_outbox (payload)
+VALUES (
+        json_build_object(
+            'operation',
+            TG_OP,
+            'table',
+            TG_TABLE_NAME,
+            -- 32 bit, as logical decoding & pg_stat_activity report it
+            'txid',
+            txid_current() % 4294967296,
+            'payload',
+            notification_json
+        )
+    )
+RETURNING id INTO event_id;
+PERFORM pg_notify({{.Channel}}, event_id::text);
+RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+--*******
+-- Point Triggers at the Outbox Function
+--*******
+{{range .Tables}}DROP TRIGGER IF EXISTS {{.Trigger}} ON {{.Table}};
+CREATE TRIGGER {{.Trigger}}
+AFTER
+INSERT
+    OR
+UPDATE
+    OR DELETE ON {{.Table}} FOR EACH ROW EXECUTE PROCEDURE outbox_trigger();
+{{end}}COMMIT;
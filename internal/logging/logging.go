@@ -0,0 +1,76 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"pg-to-es/internal/config"
+	"pg-to-es/internal/model"
+)
+
+// Fields logged alike by every component, for logs of a change to be searched by them
+const (
+	Table     = "table"
+	Operation = "operation"
+	DocID     = "doc_id"
+	Position  = "position"
+	Error     = "error"
+	// Payload holds the data a delta changed, redacted unless configured otherwise
+	Payload = "payload"
+)
+
+// redacted stands in for payloads
+const redacted = "[redacted]"
+
+// New returns a logger writing to w from cfg.Level up, as text or JSON as per cfg.Format. Payloads are
+// redacted unless cfg.Payloads is set
+func New(cfg config.Log, w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(cfg.Level))
+	if err != nil {
+		return nil, fmt.Errorf("invalid log level '%s', err: %w", cfg.Level, err)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	if !cfg.Payloads {
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == Payload {
+				return slog.String(Payload, redacted)
+			}
+			return a
+		}
+	}
+	switch cfg.Format {
+	case config.LogFormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case config.LogFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format '%s'", cfg.Format)
+}
+
+// Err is the field of err
+func Err(err error) slog.Attr {
+	return slog.Any(Error, err)
+}
+
+// Delta returns the fields of delta: its table, operation, position & payload, the ones delta does not carry
+// are left out
+func Delta(delta model.Delta) []any {
+	var e struct {
+		Table     string `json:"table"`
+		Operation string `json:"operation"`
+	}
+	json.Unmarshal([]byte(delta.Payload), &e)
+	var fields []any
+	if e.Table != "" {
+		fields = append(fields, Table, e.Table)
+	}
+	if e.Operation != "" {
+		fields = append(fields, Operation, e.Operation)
+	}
+	if delta.Position != "" {
+		fields = append(fields, Position, delta.Position)
+	}
+	return append(fields, Payload, delta.Payload)
+}
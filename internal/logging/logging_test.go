@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"pg-to-es/internal/config"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      config.Log
+		wantErr  bool
+		contains []string
+		excludes []string
+	}{
+		{
+			name:     "payloads should be redacted by default",
+			cfg:      config.Log{Level: "info", Format: config.LogFormatText},
+			contains: []string{`msg="delta dead-lettered" table=users operation=UPDATE doc_id=1 payload=[redacted] error="bulk failed"`},
+			excludes: []string{"secret", "debug only"},
+		},
+		{
+			name:     "payloads should be logged when configured",
+			cfg:      config.Log{Level: "debug", Format: config.LogFormatJSON, Payloads: true},
+			contains: []string{`"msg":"debug only"`, `"table":"users","operation":"UPDATE","doc_id":1,"payload":"{\"name\":\"secret\"}","error":"bulk failed"`},
+		},
+		{
+			name:     "levels below the one configured should be dropped",
+			cfg:      config.Log{Level: "error", Format: config.LogFormatJSON},
+			excludes: []string{"delta dead-lettered", "debug only"},
+		},
+		{
+			name:    "unknown levels should be refused",
+			cfg:     config.Log{Level: "verbose", Format: config.LogFormatText},
+			wantErr: true,
+		},
+		{
+			name:    "unknown formats should be refused",
+			cfg:     config.Log{Level: "info", Format: "xml"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := New(tt.cfg, &buf)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			logger.Debug("debug only")
+			logger.Warn("delta dead-lettered", Table, "users", Operation, "UPDATE", DocID, 1,
+				Payload, `{"name":"secret"}`, Err(errors.New("bulk failed")))
+			for _, s := range tt.contains {
+				assert.Contains(t, buf.String(), s)
+			}
+			for _, s := range tt.excludes {
+				assert.NotContains(t, buf.String(), s)
+			}
+		})
+	}
+}
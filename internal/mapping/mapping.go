@@ -0,0 +1,345 @@
+// Package mapping describes how rows of postgres tables are denormalized into documents:
+// a root table, one document per row, embedding collections & joins of related tables
+package mapping
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+	"gopkg.in/yaml.v3"
+)
+
+// Mapping of a root table, along with every table nested in it, to documents
+type Mapping struct {
+	Root Table `yaml:"root"`
+}
+
+type Table struct {
+	Table string `yaml:"table"`
+	// Key is the primary key column, id by default
+	Key string `yaml:"key"`
+	// Fields maps columns to document fields, a column mapped to nothing keeps its name
+	Fields map[string]string `yaml:"fields"`
+	// Collections are embedded as arrays, ordered by key
+	Collections []Relation `yaml:"collections"`
+	// Joins are embedded as a single object, null when missing
+	Joins []Relation `yaml:"joins"`
+}
+
+// Relation nests a table in its parent
+type Relation struct {
+	// Name is the document field the relation is embedded as
+	Name  string `yaml:"name"`
+	Table `yaml:",inline"`
+	// ForeignKey is the column of a collection referencing the key of the parent
+	ForeignKey string `yaml:"foreign_key"`
+	// Through links a collection to the parent, for many to many relations
+	Through *Through `yaml:"through"`
+	// LocalKey is the column of the parent referencing the key of a join
+	LocalKey string `yaml:"local_key"`
+}
+
+// Through is a table linking the rows of a collection to the rows of its parent
+type Through struct {
+	Table string `yaml:"table"`
+	// ParentKey is the column referencing the key of the parent
+	ParentKey string `yaml:"parent_key"`
+	// ChildKey is the column referencing the key of the collection
+	ChildKey string `yaml:"child_key"`
+}
+
+// Load reads a YAML (or JSON) mapping file
+func Load(path string) (*Mapping, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(b)
+}
+
+//go:embed users.yaml
+var usersMapping []byte
+
+// Users returns the mapping of users, along with their projects & the hashtags of those,
+// into documents of the shape of model.User
+func Users() *Mapping {
+	m, err := Parse(usersMapping)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// Parse a YAML (or JSON) mapping, defaulting keys to id
+func Parse(b []byte) (*Mapping, error) {
+	var m Mapping
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	err := dec.Decode(&m)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mapping, err: %w", err)
+	}
+	err = m.Root.validate("root")
+	if err != nil {
+		return nil, fmt.Errorf("invalid mapping, err: %w", err)
+	}
+	return &m, nil
+}
+
+func (t *Table) validate(path string) error {
+	if t.Table == "" {
+		return fmt.Errorf("%s: table is required", path)
+	}
+	if t.Key == "" {
+		t.Key = "id"
+	}
+	if len(t.Fields) == 0 {
+		return fmt.Errorf("%s: fields are required", path)
+	}
+	for column, field := range t.Fields {
+		if field == "" {
+			t.Fields[column] = column
+		}
+	}
+	names := map[string]bool{}
+	for _, field := range t.Fields {
+		names[field] = true
+	}
+	for idx := range t.Collections {
+		c := &t.Collections[idx]
+		if (c.ForeignKey == "") == (c.Through == nil) {
+			return fmt.Errorf("%s.%s: collections require either foreign_key or through", path, c.Name)
+		}
+		if c.Through != nil && (c.Through.Table == "" || c.Through.ParentKey == "" || c.Through.ChildKey == "") {
+			return fmt.Errorf("%s.%s: through requires table, parent_key & child_key", path, c.Name)
+		}
+	}
+	for _, j := range t.Joins {
+		if j.LocalKey == "" {
+			return fmt.Errorf("%s.%s: joins require local_key", path, j.Name)
+		}
+	}
+	for _, rel := range t.relations() {
+		if rel.Name == "" {
+			return fmt.Errorf("%s: name is required", path)
+		}
+		if names[rel.Name] {
+			return fmt.Errorf("%s.%s: field is defined twice", path, rel.Name)
+		}
+		names[rel.Name] = true
+		err := rel.Table.validate(path + "." + rel.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Table) relations() []*Relation {
+	var res []*Relation
+	for idx := range t.Collections {
+		res = append(res, &t.Collections[idx])
+	}
+	for idx := range t.Joins {
+		res = append(res, &t.Joins[idx])
+	}
+	return res
+}
+
+// Tables returns every table a change of which may change documents, link tables included
+func (m *Mapping) Tables() []string {
+	seen := map[string]bool{}
+	var tables []string
+	add := func(table string) {
+		if !seen[table] {
+			seen[table] = true
+			tables = append(tables, table)
+		}
+	}
+	var walk func(t *Table)
+	walk = func(t *Table) {
+		add(t.Table)
+		for _, rel := range t.relations() {
+			if rel.Through != nil {
+				add(rel.Through.Table)
+			}
+			walk(&rel.Table)
+		}
+	}
+	walk(&m.Root)
+	return tables
+}
+
+// Key returns the quoted key column of the root, as selected by DocumentQuery
+func (m *Mapping) Key() string {
+	return "t0." + pq.QuoteIdentifier(m.Root.Key)
+}
+
+// DocumentQuery selects the key (as text) & the document (as json text) of every root row matching
+// where, ordered by key. where refers to the root table as t0
+func (m *Mapping) DocumentQuery(where string) string {
+	n := 0
+	return fmt.Sprintf("SELECT %s::text, %s::text FROM %s t0 WHERE %s ORDER BY %s",
+		m.Key(), m.Root.object("t0", &n), pq.QuoteIdentifier(m.Root.Table), where, m.Key())
+}
+
+// object builds the json object of the row of t aliased as alias, n numbers the aliases taken
+func (t *Table) object(alias string, n *int) string {
+	columns := make([]string, 0, len(t.Fields))
+	for column := range t.Fields {
+		columns = append(columns, column)
+	}
+	sort.Slice(columns, func(i, j int) bool { return t.Fields[columns[i]] < t.Fields[columns[j]] })
+	var args []string
+	for _, column := range columns {
+		args = append(args, pq.QuoteLiteral(t.Fields[column]), alias+"."+pq.QuoteIdentifier(column))
+	}
+	for _, c := range t.Collections {
+		*n++
+		child := fmt.Sprintf("t%d", *n)
+		from := fmt.Sprintf("%s %s", pq.QuoteIdentifier(c.Table.Table), child)
+		var where string
+		if c.Through != nil {
+			link := child + "l"
+			from += fmt.Sprintf(" JOIN %s %s ON %s.%s = %s.%s", pq.QuoteIdentifier(c.Through.Table), link,
+				link, pq.QuoteIdentifier(c.Through.ChildKey), child, pq.QuoteIdentifier(c.Key))
+			where = fmt.Sprintf("%s.%s = %s.%s", link, pq.QuoteIdentifier(c.Through.ParentKey), alias, pq.QuoteIdentifier(t.Key))
+		} else {
+			where = fmt.Sprintf("%s.%s = %s.%s", child, pq.QuoteIdentifier(c.ForeignKey), alias, pq.QuoteIdentifier(t.Key))
+		}
+		args = append(args, pq.QuoteLiteral(c.Name), fmt.Sprintf(
+			"COALESCE((SELECT json_agg(%s ORDER BY %s.%s) FROM %s WHERE %s), '[]'::json)",
+			c.Table.object(child, n), child, pq.QuoteIdentifier(c.Key), from, where))
+	}
+	for _, j := range t.Joins {
+		*n++
+		child := fmt.Sprintf("t%d", *n)
+		args = append(args, pq.QuoteLiteral(j.Name), fmt.Sprintf("(SELECT %s FROM %s %s WHERE %s.%s = %s.%s)",
+			j.Table.object(child, n), pq.QuoteIdentifier(j.Table.Table), child,
+			child, pq.QuoteIdentifier(j.Key), alias, pq.QuoteIdentifier(j.LocalKey)))
+	}
+	return "json_build_object(" + strings.Join(args, ", ") + ")"
+}
+
+// node is a table within the mapping, along with the relation nesting it & its parent, nil for the root
+type node struct {
+	table  *Table
+	rel    *Relation
+	parent *node
+}
+
+func (m *Mapping) nodes() []*node {
+	var nodes []*node
+	var walk func(n *node)
+	walk = func(n *node) {
+		nodes = append(nodes, n)
+		for _, rel := range n.table.relations() {
+			walk(&node{table: &rel.Table, rel: rel, parent: n})
+		}
+	}
+	walk(&node{table: &m.Root})
+	return nodes
+}
+
+// ErrNotMapped is returned for tables the mapping does not refer to
+var ErrNotMapped = errors.New("table is not mapped")
+
+// RootsQuery returns the query selecting the keys (as text) of the roots holding row, a row of
+// table, along with its args. Rows are located through their key, foreign key & link columns,
+// rows moved from a parent to another are only found under the latter
+func (m *Mapping) RootsQuery(table string, row map[string]interface{}) (string, []interface{}, error) {
+	q := &rootsQuery{}
+	mapped := false
+	for _, n := range m.nodes() {
+		if n.table.Table == table {
+			mapped = true
+			switch {
+			case n.parent == nil:
+				if v, ok := row[n.table.Key]; ok && v != nil {
+					q.union(fmt.Sprintf("SELECT CAST(%s AS text)", q.arg(v)))
+				}
+			case n.rel.ForeignKey != "":
+				// the row carries the parent key, deleted rows included, unless it carries its key only
+				if v, ok := row[n.rel.ForeignKey]; ok && v != nil {
+					q.lift(n.parent, q.equals(v))
+				} else if v, ok := row[n.table.Key]; ok && v != nil {
+					q.lift(n.parent, parentKeys(n, q.equals(v)))
+				}
+			default:
+				if v, ok := row[n.table.Key]; ok && v != nil {
+					q.lift(n.parent, parentKeys(n, q.equals(v)))
+				}
+			}
+		}
+		if n.rel != nil && n.rel.Through != nil && n.rel.Through.Table == table {
+			mapped = true
+			if v, ok := row[n.rel.Through.ParentKey]; ok && v != nil {
+				q.lift(n.parent, q.equals(v))
+			}
+		}
+	}
+	if !mapped {
+		return "", nil, ErrNotMapped
+	}
+	return q.String(), q.args, nil
+}
+
+// rootsQuery builds the union of queries selecting root keys
+type rootsQuery struct {
+	selects []string
+	args    []interface{}
+}
+
+func (q *rootsQuery) arg(v interface{}) string {
+	q.args = append(q.args, fmt.Sprint(v))
+	return fmt.Sprintf("$%d", len(q.args))
+}
+
+// equals returns a condition on a column being v
+func (q *rootsQuery) equals(v interface{}) func(column string) string {
+	p := q.arg(v)
+	return func(column string) string { return column + " = " + p }
+}
+
+func (q *rootsQuery) union(s string) {
+	q.selects = append(q.selects, s)
+}
+
+// lift turns a condition on the keys of n into one on the keys of the root
+func (q *rootsQuery) lift(n *node, cond func(column string) string) {
+	for n.parent != nil {
+		cond, n = parentKeys(n, cond), n.parent
+	}
+	q.union(fmt.Sprintf("SELECT CAST(r.%s AS text) FROM %s r WHERE %s", pq.QuoteIdentifier(n.table.Key),
+		pq.QuoteIdentifier(n.table.Table), cond("r."+pq.QuoteIdentifier(n.table.Key))))
+}
+
+func (q *rootsQuery) String() string {
+	if len(q.selects) == 0 {
+		return ""
+	}
+	return "SELECT DISTINCT k FROM (" + strings.Join(q.selects, " UNION ") + ") roots(k)"
+}
+
+// parentKeys turns a condition on the keys of n into one on the keys of its parent
+func parentKeys(n *node, cond func(column string) string) func(column string) string {
+	var sub string
+	switch {
+	case n.rel.ForeignKey != "":
+		sub = fmt.Sprintf("SELECT c.%s FROM %s c WHERE %s", pq.QuoteIdentifier(n.rel.ForeignKey),
+			pq.QuoteIdentifier(n.table.Table), cond("c."+pq.QuoteIdentifier(n.table.Key)))
+	case n.rel.Through != nil:
+		sub = fmt.Sprintf("SELECT l.%s FROM %s l WHERE %s", pq.QuoteIdentifier(n.rel.Through.ParentKey),
+			pq.QuoteIdentifier(n.rel.Through.Table), cond("l."+pq.QuoteIdentifier(n.rel.Through.ChildKey)))
+	default:
+		sub = fmt.Sprintf("SELECT p.%s FROM %s p WHERE %s", pq.QuoteIdentifier(n.parent.table.Key),
+			pq.QuoteIdentifier(n.parent.table.Table), cond("p."+pq.QuoteIdentifier(n.rel.LocalKey)))
+	}
+	return func(column string) string { return column + " IN (" + sub + ")" }
+}
@@ -0,0 +1,165 @@
+package mapping
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const teams = `
+root:
+  table: users
+  fields: {id: , name: user_name}
+  joins:
+    - name: team
+      table: teams
+      local_key: team_id
+      fields: {id: , name: }
+  collections:
+    - name: projects
+      table: projects
+      through: {table: user_projects, parent_key: user_id, child_key: project_id}
+      fields: {id: }
+      collections:
+        - name: tasks
+          table: tasks
+          foreign_key: project_id
+          fields: {id: , title: }
+`
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping string
+		wantErr bool
+	}{
+		{name: "nested collections & joins should parse", mapping: teams},
+		{name: "unknown keys should return error", mapping: "root: {table: users, fields: {id: }, index: users}", wantErr: true},
+		{name: "missing fields should return error", mapping: "root: {table: users}", wantErr: true},
+		{
+			name:    "collection without foreign_key or through should return error",
+			mapping: "root: {table: users, fields: {id: }, collections: [{name: projects, table: projects, fields: {id: }}]}",
+			wantErr: true,
+		},
+		{
+			name:    "relation named as a field should return error",
+			mapping: "root: {table: users, fields: {id: , name: }, joins: [{name: name, table: teams, local_key: team_id, fields: {id: }}]}",
+			wantErr: true,
+		},
+		{name: "json should parse", mapping: `{"root": {"table": "users", "fields": {"id": "id"}}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.mapping))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMapping_Tables(t *testing.T) {
+	m, err := Parse([]byte(teams))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"users", "user_projects", "projects", "tasks", "teams"}, m.Tables())
+}
+
+func TestMapping_DocumentQuery(t *testing.T) {
+	m, err := Parse([]byte(teams))
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT t0."id"::text, json_build_object(`+
+		`'id', t0."id", 'user_name', t0."name", `+
+		`'projects', COALESCE((SELECT json_agg(json_build_object('id', t1."id", `+
+		`'tasks', COALESCE((SELECT json_agg(json_build_object('id', t2."id", 'title', t2."title") ORDER BY t2."id") `+
+		`FROM "tasks" t2 WHERE t2."project_id" = t1."id"), '[]'::json)) ORDER BY t1."id") `+
+		`FROM "projects" t1 JOIN "user_projects" t1l ON t1l."project_id" = t1."id" WHERE t1l."user_id" = t0."id"), '[]'::json), `+
+		`'team', (SELECT json_build_object('id', t3."id", 'name', t3."name") FROM "teams" t3 WHERE t3."id" = t0."team_id"))::text `+
+		`FROM "users" t0 WHERE true ORDER BY t0."id"`, m.DocumentQuery("true"))
+}
+
+func TestMapping_RootsQuery(t *testing.T) {
+	m, err := Parse([]byte(teams))
+	assert.NoError(t, err)
+	tests := []struct {
+		name     string
+		table    string
+		row      map[string]interface{}
+		want     string
+		wantArgs []interface{}
+		wantErr  error
+	}{
+		{
+			name:     "root row should be its own root",
+			table:    "users",
+			row:      map[string]interface{}{"id": 1},
+			want:     `SELECT DISTINCT k FROM (SELECT CAST($1 AS text)) roots(k)`,
+			wantArgs: []interface{}{"1"},
+		},
+		{
+			name:     "link row should lift its parent key",
+			table:    "user_projects",
+			row:      map[string]interface{}{"user_id": 1, "project_id": 2},
+			want:     `SELECT DISTINCT k FROM (SELECT CAST(r."id" AS text) FROM "users" r WHERE r."id" = $1) roots(k)`,
+			wantArgs: []interface{}{"1"},
+		},
+		{
+			name:  "collection row should lift through its link table",
+			table: "projects",
+			row:   map[string]interface{}{"id": 2},
+			want: `SELECT DISTINCT k FROM (SELECT CAST(r."id" AS text) FROM "users" r WHERE r."id" IN ` +
+				`(SELECT l."user_id" FROM "user_projects" l WHERE l."project_id" = $1)) roots(k)`,
+			wantArgs: []interface{}{"2"},
+		},
+		{
+			name:  "collection row should lift through its foreign key",
+			table: "tasks",
+			row:   map[string]interface{}{"id": 3, "project_id": 2},
+			want: `SELECT DISTINCT k FROM (SELECT CAST(r."id" AS text) FROM "users" r WHERE r."id" IN ` +
+				`(SELECT l."user_id" FROM "user_projects" l WHERE l."project_id" = $1)) roots(k)`,
+			wantArgs: []interface{}{"2"},
+		},
+		{
+			name:  "collection row carrying its key only should lift through its own foreign key",
+			table: "tasks",
+			row:   map[string]interface{}{"id": 3},
+			want: `SELECT DISTINCT k FROM (SELECT CAST(r."id" AS text) FROM "users" r WHERE r."id" IN ` +
+				`(SELECT l."user_id" FROM "user_projects" l WHERE l."project_id" IN ` +
+				`(SELECT c."project_id" FROM "tasks" c WHERE c."id" = $1))) roots(k)`,
+			wantArgs: []interface{}{"3"},
+		},
+		{
+			name:  "join row should lift through the parent local key",
+			table: "teams",
+			row:   map[string]interface{}{"id": 4},
+			want: `SELECT DISTINCT k FROM (SELECT CAST(r."id" AS text) FROM "users" r WHERE r."id" IN ` +
+				`(SELECT p."id" FROM "users" p WHERE p."team_id" = $1)) roots(k)`,
+			wantArgs: []interface{}{"4"},
+		},
+		{
+			name:    "unmapped table should return error",
+			table:   "audit",
+			wantErr: ErrNotMapped,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, args, err := m.RootsQuery(tt.table, tt.row)
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantArgs, args)
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	// the mapping shipped along reproduces model.User
+	m, err := Load("users.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"users", "user_projects", "projects", "project_hashtags", "hashtags"}, m.Tables())
+
+	assert.Equal(t, m, Users())
+
+	_, err = Load("missing.yaml")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,111 @@
+// Package metrics holds the prometheus metrics of the pipeline & the server, served by Handler
+package metrics
+
+import (
+	"net/http"
+	"pg-to-es/internal/route"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Pipeline
+var (
+	EventsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pipeline_events_received_total",
+		Help: "Deltas received from the listener, by table & operation.",
+	}, []string{"table", "operation"})
+	EventsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pipeline_events_processed_total",
+		Help: "Deltas indexed or dead-lettered, by table & operation.",
+	}, []string{"table", "operation"})
+	EventsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pipeline_events_failed_total",
+		Help: "Deltas dead-lettered, by table & operation.",
+	}, []string{"table", "operation"})
+	ProcessingSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pipeline_processing_seconds",
+		Help:    "Time from receiving a delta to committing it, by table & operation.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"table", "operation"})
+	ListenerGaps = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pipeline_listener_gaps_total",
+		Help: "Periods the listener may have missed changes during.",
+	})
+	ListenerGapSeconds = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pipeline_listener_gap_seconds_total",
+		Help: "Time the listener may have missed changes during.",
+	})
+	ResyncedDocuments = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pipeline_resynced_documents_total",
+		Help: "Documents reindexed to make up for listener gaps.",
+	})
+	ConflictRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pipeline_conflict_retries_total",
+		Help: "Flushes applied anew as documents changed since they were read.",
+	})
+	DriftDocuments = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pipeline_drift_documents_total",
+		Help: "Documents found out of sync by verifying, by drift (missing, stale or orphaned).",
+	}, []string{"drift"})
+	DriftRepaired = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pipeline_drift_repaired_total",
+		Help: "Documents found out of sync & repaired.",
+	})
+	Leader = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pipeline_leader",
+		Help: "1 while leading, 0 while standing by.",
+	})
+	ReplicationLagBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pipeline_replication_lag_bytes",
+		Help: "WAL written past the position the replication slot was confirmed at.",
+	})
+)
+
+// Elasticsearch
+var (
+	ElasticErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "es_errors_total",
+		Help: "Failed elasticsearch requests & bulk items, by status code (transport for requests not answered).",
+	}, []string{"code"})
+	VersionConflicts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "es_version_conflicts_total",
+		Help: "Writes rejected as the document changed since it was read.",
+	})
+)
+
+// Server
+var (
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Requests served, by route, method & status code.",
+	}, []string{"route", "method", "code"})
+	HTTPRequestSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Time spent serving requests, by route, method & status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+)
+
+// Handler serves every metric in the prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware counts & times the requests served by router by the route they match rather than their path,
+// route.Unmatched for the ones matching none (404 & 405)
+func Middleware(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		template := route.Match(router, r)
+		rec := route.NewStatusRecorder(w)
+		router.ServeHTTP(rec, r)
+		code := strconv.Itoa(rec.Status)
+		HTTPRequests.WithLabelValues(template, r.Method, code).Inc()
+		HTTPRequestSeconds.WithLabelValues(template, r.Method, code).Observe(time.Since(start).Seconds())
+	})
+}
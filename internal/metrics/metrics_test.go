@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"pg-to-es/internal/route"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/search/user/{userID}", func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["userID"] == "x" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+		}
+	}).Methods("GET")
+	r.Handle("/metrics", Handler()).Methods("GET")
+	handler := Middleware(r)
+
+	ok := HTTPRequests.WithLabelValues("/search/user/{userID}", "GET", "200")
+	bad := HTTPRequests.WithLabelValues("/search/user/{userID}", "GET", "400")
+	okBefore, badBefore := testutil.ToFloat64(ok), testutil.ToFloat64(bad)
+	notFound := HTTPRequests.WithLabelValues(route.Unmatched, "GET", "404")
+	notAllowed := HTTPRequests.WithLabelValues(route.Unmatched, "POST", "405")
+	notFoundBefore, notAllowedBefore := testutil.ToFloat64(notFound), testutil.ToFloat64(notAllowed)
+	for _, target := range []string{"/search/user/1", "/search/user/2", "/search/user/x", "/unknown", "/other"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/search/user/1", nil))
+	assert.Equal(t, okBefore+2, testutil.ToFloat64(ok), "requests must be counted by route rather than path")
+	assert.Equal(t, badBefore+1, testutil.ToFloat64(bad), "requests must be counted by status code")
+	assert.Equal(t, notFoundBefore+2, testutil.ToFloat64(notFound), "requests matching no route must be counted alike")
+	assert.Equal(t, notAllowedBefore+1, testutil.ToFloat64(notAllowed), "requests matching no method must be counted alike")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), `http_request_duration_seconds_count{code="200",method="GET",route="/search/user/{userID}"}`),
+		"latency must be exported by route")
+}
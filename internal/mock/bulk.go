@@ -0,0 +1,83 @@
+package mock
+
+import (
+	"context"
+	"fmt"
+	"pg-to-es/internal/contract"
+	"pg-to-es/internal/model"
+	"time"
+)
+
+// Bulk applies every write right away, thus never holds buffered writes
+type Bulk struct {
+	e *Elastic
+}
+
+func (b *Bulk) Index(doc model.User) {
+	b.e.writes.Add(1)
+	b.e.mu.Lock()
+	defer b.e.mu.Unlock()
+	b.e.index(doc)
+}
+
+func (b *Bulk) Delete(id int) {
+	b.e.Delete(context.Background(), "", id)
+}
+
+func (b *Bulk) GetByUserId(ctx context.Context, userId int) (*model.User, error) {
+	return b.e.GetByUserId(ctx, "", userId)
+}
+
+// RemoveProject flushes ahead of updating every document by query, as the actual bulk does
+func (b *Bulk) RemoveProject(ctx context.Context, projectId int) error {
+	err := b.Flush(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = b.e.RemoveProject(ctx, "", projectId)
+	return err
+}
+
+// RemoveHashtag flushes ahead of updating every document by query, as the actual bulk does
+func (b *Bulk) RemoveHashtag(ctx context.Context, hashtagId int) error {
+	err := b.Flush(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = b.e.RemoveHashtag(ctx, "", hashtagId)
+	return err
+}
+
+// RemoveProjectHashtag flushes ahead of updating every document by query, as the actual bulk does
+func (b *Bulk) RemoveProjectHashtag(ctx context.Context, projectId, hashtagId int) error {
+	err := b.Flush(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = b.e.RemoveProjectHashtag(ctx, "", projectId, hashtagId)
+	return err
+}
+
+func (b *Bulk) Len() int {
+	return 0
+}
+
+func (b *Bulk) Full() bool {
+	return false
+}
+
+func (b *Bulk) FlushInterval() time.Duration {
+	return 10 * time.Millisecond
+}
+
+func (b *Bulk) Flush(ctx context.Context) error {
+	if b.e.flushConflicts.Add(-1) >= 0 {
+		return fmt.Errorf("flush failed: %w", contract.ErrConflict)
+	}
+	if b.e.flushFailures.Add(-1) >= 0 {
+		return fmt.Errorf("flush failed")
+	}
+	return nil
+}
+
+func (b *Bulk) Reset() {}
@@ -0,0 +1,28 @@
+package mock
+
+import (
+	"context"
+	"sync"
+)
+
+type Checkpoint struct {
+	mu       sync.Mutex
+	position string
+}
+
+func NewCheckpoint(position string) *Checkpoint {
+	return &Checkpoint{position: position}
+}
+
+func (c *Checkpoint) Load(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.position, nil
+}
+
+func (c *Checkpoint) Save(ctx context.Context, position string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.position = position
+	return nil
+}
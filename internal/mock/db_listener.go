@@ -0,0 +1,82 @@
+package mock
+
+import (
+	"context"
+	"pg-to-es/internal/model"
+	"sync"
+)
+
+type DbListener struct {
+	deltaStream chan model.Delta
+	gaps        chan model.Gap
+	mu          sync.Mutex
+	prepared    bool
+	from        string
+	acked       []string
+	closeOnce   sync.Once
+}
+
+// NewDbListener returns a listener streaming deltas as they are pushed through Push
+func NewDbListener() *DbListener {
+	return &DbListener{deltaStream: make(chan model.Delta), gaps: make(chan model.Gap)}
+}
+
+func (l *DbListener) Prepare(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prepared = true
+	return nil
+}
+
+func (l *DbListener) Start(ctx context.Context, from string) (<-chan model.Delta, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.from = from
+	return l.deltaStream, nil
+}
+
+func (l *DbListener) Ack(ctx context.Context, position string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.acked = append(l.acked, position)
+	return nil
+}
+
+func (l *DbListener) Gaps() <-chan model.Gap {
+	return l.gaps
+}
+
+func (l *DbListener) Stop() {
+	l.closeOnce.Do(func() {
+		close(l.deltaStream)
+	})
+}
+
+// Push hands a delta over to the pipeline, blocking until it is received
+func (l *DbListener) Push(delta model.Delta) {
+	l.deltaStream <- delta
+}
+
+// PushGap reports a gap to the pipeline, blocking until it is received
+func (l *DbListener) PushGap(gap model.Gap) {
+	l.gaps <- gap
+}
+
+func (l *DbListener) Prepared() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.prepared
+}
+
+// From returns the position Start was called with
+func (l *DbListener) From() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.from
+}
+
+func (l *DbListener) Acked() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string{}, l.acked...)
+}
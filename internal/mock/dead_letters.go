@@ -0,0 +1,45 @@
+package mock
+
+import (
+	"context"
+	"pg-to-es/internal/model"
+	"sync"
+)
+
+type DeadLetters struct {
+	mu      sync.Mutex
+	letters []model.DeadLetter
+}
+
+func NewDeadLetters(letters ...model.DeadLetter) *DeadLetters {
+	return &DeadLetters{letters: letters}
+}
+
+func (d *DeadLetters) Add(ctx context.Context, letter model.DeadLetter) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	letter.ID = 1
+	if n := len(d.letters); n > 0 {
+		letter.ID = d.letters[n-1].ID + 1
+	}
+	d.letters = append(d.letters, letter)
+	return nil
+}
+
+func (d *DeadLetters) List(ctx context.Context) ([]model.DeadLetter, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]model.DeadLetter{}, d.letters...), nil
+}
+
+func (d *DeadLetters) Remove(ctx context.Context, id int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for idx, letter := range d.letters {
+		if letter.ID == id {
+			d.letters = append(d.letters[:idx], d.letters[idx+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package mock
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"pg-to-es/internal/mapping"
+	"pg-to-es/internal/model"
+	"strconv"
+	"sync"
+)
+
+type Documents struct {
+	documents []model.User
+	position  string
+}
+
+// NewDocuments returns documents whose snapshot holds documents & is taken at position
+func NewDocuments(documents []model.User, position string) *Documents {
+	return &Documents{documents, position}
+}
+
+func (d *Documents) Snapshot(ctx context.Context, batchSize int, fn func([]model.Document) error) (string, error) {
+	docs, err := userDocuments(d.documents)
+	if err != nil {
+		return "", err
+	}
+	for start := 0; start < len(docs); start += batchSize {
+		end := start + batchSize
+		if end > len(docs) {
+			end = len(docs)
+		}
+		err := fn(docs[start:end])
+		if err != nil {
+			return "", err
+		}
+	}
+	return d.position, nil
+}
+
+// Build returns the documents of ids held, the ones not held without source
+func (d *Documents) Build(ctx context.Context, ids []string) ([]model.Document, error) {
+	held, err := userDocuments(d.documents)
+	if err != nil {
+		return nil, err
+	}
+	sources := map[string][]byte{}
+	for _, doc := range held {
+		sources[doc.ID] = doc.Source
+	}
+	docs := make([]model.Document, len(ids))
+	for idx, id := range ids {
+		docs[idx] = model.Document{ID: id, Source: sources[id]}
+	}
+	return docs, nil
+}
+
+// Holding returns the ids of the documents held holding the row of table keys identifies
+func (d *Documents) Holding(ctx context.Context, table string, keys map[string]int) ([]string, error) {
+	switch table {
+	case "users":
+		return []string{strconv.Itoa(keys["id"])}, nil
+	case "user_projects":
+		return []string{strconv.Itoa(keys["user_id"])}, nil
+	case "projects", "project_hashtags", "hashtags":
+	default:
+		return nil, fmt.Errorf("unknown table '%s'", table)
+	}
+	var ids []string
+	for _, user := range d.documents {
+		holds := false
+		for _, project := range user.Projects {
+			switch table {
+			case "projects":
+				holds = holds || project.ID == keys["id"]
+			case "project_hashtags":
+				holds = holds || project.ID == keys["project_id"]
+			case "hashtags":
+				for _, hashtag := range project.Hashtags {
+					holds = holds || hashtag.ID == keys["id"]
+				}
+			}
+		}
+		if holds {
+			ids = append(ids, strconv.Itoa(user.ID))
+		}
+	}
+	return ids, nil
+}
+
+// MappedDocuments builds the documents it is set with, rows are mapped to documents through roots
+type MappedDocuments struct {
+	*Documents
+	mu sync.Mutex
+	// ids of the documents holding each row, by table & row id
+	roots  map[string][]string
+	tables map[string]bool
+	built  [][]string
+}
+
+// NewMappedDocuments returns documents whose rows of each table, by id, are held by the documents of roots
+func NewMappedDocuments(documents []model.User, roots map[string]map[int][]string) *MappedDocuments {
+	d := &MappedDocuments{Documents: NewDocuments(documents, ""), roots: map[string][]string{}, tables: map[string]bool{}}
+	for table, rows := range roots {
+		d.tables[table] = true
+		for id, ids := range rows {
+			d.roots[table+":"+fmt.Sprint(id)] = ids
+		}
+	}
+	return d
+}
+
+// SetDocuments replaces the documents held, as if postgres changed
+func (d *MappedDocuments) SetDocuments(documents []model.User) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.documents = documents
+}
+
+func (d *MappedDocuments) Roots(ctx context.Context, table string, row map[string]interface{}) ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.tables[table] {
+		return nil, mapping.ErrNotMapped
+	}
+	return d.roots[table+":"+fmt.Sprint(row["id"])], nil
+}
+
+func (d *MappedDocuments) Build(ctx context.Context, ids []string) ([]model.Document, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.built = append(d.built, ids)
+	var docs []model.Document
+	for _, id := range ids {
+		doc := model.Document{ID: id}
+		for _, user := range d.documents {
+			if strconv.Itoa(user.ID) == id {
+				source, err := json.Marshal(user)
+				if err != nil {
+					return nil, err
+				}
+				doc.Source = source
+			}
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// Built returns the ids of every Build call
+func (d *MappedDocuments) Built() [][]string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([][]string{}, d.built...)
+}
+
+func userDocuments(users []model.User) ([]model.Document, error) {
+	docs := make([]model.Document, 0, len(users))
+	for _, user := range users {
+		source, err := json.Marshal(user)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, model.Document{ID: strconv.Itoa(user.ID), Source: source})
+	}
+	return docs, nil
+}
@@ -2,25 +2,77 @@ package mock
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"pg-to-es/internal/contract"
 	"pg-to-es/internal/model"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 type Elastic struct {
+	mu        sync.Mutex
 	documents []model.User
+	// number of bulk flushes left to fail
+	flushFailures atomic.Int32
+	// number of bulk flushes left to fail on a version conflict
+	flushConflicts atomic.Int32
+	// number of document reads left to fail
+	readFailures atomic.Int32
+	// number of documents written through bulks
+	writes atomic.Int32
+	// set for pings to fail
+	unreachable atomic.Bool
 }
 
 func NewElastic(documents []model.User) *Elastic {
 	return &Elastic{documents: documents}
 }
 
+// FailReads makes the next n reads of documents by user id fail
+func (e *Elastic) FailReads(n int) {
+	e.readFailures.Store(int32(n))
+}
+
+// FailFlushes makes the next n bulk flushes fail
+func (e *Elastic) FailFlushes(n int) {
+	e.flushFailures.Store(int32(n))
+}
+
+// ConflictFlushes makes the next n bulk flushes fail on a version conflict
+func (e *Elastic) ConflictFlushes(n int) {
+	e.flushConflicts.Store(int32(n))
+}
+
+// Writes returns the number of documents written through bulks
+func (e *Elastic) Writes() int {
+	return int(e.writes.Load())
+}
+
+// SetUnreachable makes pings fail, or succeed again
+func (e *Elastic) SetUnreachable(unreachable bool) {
+	e.unreachable.Store(unreachable)
+}
+
+// Documents returns every document held
+func (e *Elastic) Documents() []model.User {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]model.User{}, e.documents...)
+}
+
 func (e *Elastic) Create(ctx context.Context, index string, id int, doc model.User) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	e.documents = append(e.documents, doc)
 	return nil
 }
 
 func (e *Elastic) GetByProjectId(ctx context.Context, index string, projectId int) ([]model.User, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	var res []model.User
 	for _, document := range e.documents {
 		for _, project := range document.Projects {
@@ -33,19 +85,106 @@ func (e *Elastic) GetByProjectId(ctx context.Context, index string, projectId in
 }
 
 func (e *Elastic) GetByHashTagId(ctx context.Context, index string, hashTagId int) ([]model.User, error) {
-	return nil, nil
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var res []model.User
+	for _, document := range e.documents {
+		for _, project := range document.Projects {
+			for _, hashtag := range project.Hashtags {
+				if hashtag.ID == hashTagId {
+					res = append(res, document)
+				}
+			}
+		}
+	}
+	return res, nil
 }
 
 func (e *Elastic) GetByUserId(ctx context.Context, index string, userId int) (*model.User, error) {
-	return nil, nil
+	if e.readFailures.Add(-1) >= 0 {
+		return nil, fmt.Errorf("read failed")
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, document := range e.documents {
+		if document.ID == userId {
+			return &document, nil
+		}
+	}
+	return nil, contract.ErrNotFound
 }
 
-func (e *Elastic) RemoveProject(ctx context.Context, index string, projectId int) error {
-	return nil
+func (e *Elastic) RemoveProject(ctx context.Context, index string, projectId int) (model.UpdateResult, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var result model.UpdateResult
+	for idx, document := range e.documents {
+		projects := []model.Project{}
+		for _, project := range document.Projects {
+			if project.ID != projectId {
+				projects = append(projects, project)
+			}
+		}
+		if len(projects) != len(document.Projects) {
+			e.documents[idx].Projects = projects
+			result.Updated++
+		}
+	}
+	return result, nil
 }
 
-func (e *Elastic) RemoveHashtag(ctx context.Context, index string, hashtagId int) error {
-	return nil
+func (e *Elastic) RemoveHashtag(ctx context.Context, index string, hashtagId int) (model.UpdateResult, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var result model.UpdateResult
+	for idx, document := range e.documents {
+		updated := false
+		projects := make([]model.Project, len(document.Projects))
+		for pIdx, project := range document.Projects {
+			hashtags := []model.Hashtag{}
+			for _, hashtag := range project.Hashtags {
+				if hashtag.ID != hashtagId {
+					hashtags = append(hashtags, hashtag)
+				}
+			}
+			updated = updated || len(hashtags) != len(project.Hashtags)
+			project.Hashtags = hashtags
+			projects[pIdx] = project
+		}
+		if updated {
+			e.documents[idx].Projects = projects
+			result.Updated++
+		}
+	}
+	return result, nil
+}
+
+func (e *Elastic) RemoveProjectHashtag(ctx context.Context, index string, projectId, hashtagId int) (model.UpdateResult, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var result model.UpdateResult
+	for idx, document := range e.documents {
+		updated := false
+		projects := make([]model.Project, len(document.Projects))
+		for pIdx, project := range document.Projects {
+			if project.ID == projectId {
+				hashtags := []model.Hashtag{}
+				for _, hashtag := range project.Hashtags {
+					if hashtag.ID != hashtagId {
+						hashtags = append(hashtags, hashtag)
+					}
+				}
+				updated = updated || len(hashtags) != len(project.Hashtags)
+				project.Hashtags = hashtags
+			}
+			projects[pIdx] = project
+		}
+		if updated {
+			e.documents[idx].Projects = projects
+			result.Updated++
+		}
+	}
+	return result, nil
 }
 
 func (e *Elastic) Update(ctx context.Context, index string, id int, user model.User) error {
@@ -53,10 +192,105 @@ func (e *Elastic) Update(ctx context.Context, index string, id int, user model.U
 }
 
 func (e *Elastic) Delete(ctx context.Context, index string, id int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.remove(id)
 	return nil
 }
 
+// GetDocuments returns the documents of ids held, rendered as JSON
+func (e *Elastic) GetDocuments(ctx context.Context, index string, ids []string) ([]model.Document, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var docs []model.Document
+	for _, id := range ids {
+		for _, document := range e.documents {
+			if strconv.Itoa(document.ID) != id {
+				continue
+			}
+			source, err := json.Marshal(document)
+			if err != nil {
+				return nil, err
+			}
+			docs = append(docs, model.Document{ID: id, Source: source})
+		}
+	}
+	return docs, nil
+}
+
+func (e *Elastic) ScanIDs(ctx context.Context, index string, batchSize int, fn func(ids []string) error) error {
+	e.mu.Lock()
+	var ids []string
+	for _, document := range e.documents {
+		ids = append(ids, strconv.Itoa(document.ID))
+	}
+	e.mu.Unlock()
+	for start := 0; start < len(ids); start += batchSize {
+		err := fn(ids[start:min(start+batchSize, len(ids))])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BulkWrite indexes docs as model.User, deleting the ones without source
+func (e *Elastic) BulkWrite(ctx context.Context, index string, docs []model.Document) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, doc := range docs {
+		if doc.Source == nil {
+			id, err := strconv.Atoi(doc.ID)
+			if err != nil {
+				return err
+			}
+			e.remove(id)
+			continue
+		}
+		var user model.User
+		err := json.Unmarshal(doc.Source, &user)
+		if err != nil {
+			return err
+		}
+		e.index(user)
+	}
+	return nil
+}
+
+func (e *Elastic) Bulk(index string) contract.Bulk {
+	return &Bulk{e}
+}
+
+func (e *Elastic) Ping(ctx context.Context) error {
+	if e.unreachable.Load() {
+		return fmt.Errorf("elasticsearch unreachable")
+	}
+	return nil
+}
+
+// index replaces the document with the same id, if any, else appends doc
+func (e *Elastic) index(doc model.User) {
+	for idx := range e.documents {
+		if e.documents[idx].ID == doc.ID {
+			e.documents[idx] = doc
+			return
+		}
+	}
+	e.documents = append(e.documents, doc)
+}
+
+func (e *Elastic) remove(id int) {
+	for idx, document := range e.documents {
+		if document.ID == id {
+			e.documents = append(e.documents[:idx], e.documents[idx+1:]...)
+			return
+		}
+	}
+}
+
 func (e *Elastic) SearchByUser(ctx context.Context, index string, userID int) (*model.User, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	for _, document := range e.documents {
 		if document.ID == userID {
 			return &document, nil
@@ -70,6 +304,8 @@ func (e *Elastic) SearchByHashtags(ctx context.Context, index string, hashtag st
 }
 
 func (e *Elastic) FuzzySearchProjects(ctx context.Context, index string, query string) ([]model.FuzzyResult, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	var res []model.FuzzyResult
 	for _, document := range e.documents {
 		for _, project := range document.Projects {
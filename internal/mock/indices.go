@@ -0,0 +1,100 @@
+package mock
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+)
+
+// Indices tracks the indices each alias stands for, documents are held by Elastic regardless
+type Indices struct {
+	mu      sync.Mutex
+	aliases map[string][]string
+	created map[string]bool
+	copies  []string
+}
+
+// NewIndices returns indices whose aliases stand for the given indices
+func NewIndices(aliases map[string][]string) *Indices {
+	created := map[string]bool{}
+	for _, indices := range aliases {
+		for _, index := range indices {
+			created[index] = true
+		}
+	}
+	return &Indices{aliases: aliases, created: created}
+}
+
+func (i *Indices) Resolve(ctx context.Context, name string) ([]string, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if indices, ok := i.aliases[name]; ok {
+		return indices, nil
+	}
+	if i.created[name] {
+		return []string{name}, nil
+	}
+	return nil, nil
+}
+
+func (i *Indices) List(ctx context.Context, pattern string) ([]string, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	var indices []string
+	for index := range i.created {
+		if ok, _ := path.Match(pattern, index); ok {
+			indices = append(indices, index)
+		}
+	}
+	sort.Strings(indices)
+	return indices, nil
+}
+
+func (i *Indices) CreateIndex(ctx context.Context, index string, definition []byte) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.created[index] {
+		return fmt.Errorf("index '%s' exists", index)
+	}
+	i.created[index] = true
+	return nil
+}
+
+// CopyIndex records the copy, see Copies
+func (i *Indices) CopyIndex(ctx context.Context, from, to string) (int64, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.copies = append(i.copies, from+">"+to)
+	return 0, nil
+}
+
+func (i *Indices) SwapAliases(ctx context.Context, index string, aliases ...string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for _, alias := range aliases {
+		delete(i.created, alias)
+		i.aliases[alias] = []string{index}
+	}
+	return nil
+}
+
+// Created returns every index, sorted
+func (i *Indices) Created() []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	var indices []string
+	for index := range i.created {
+		indices = append(indices, index)
+	}
+	sort.Strings(indices)
+	return indices
+}
+
+// Copies returns the copies made, as "from>to"
+func (i *Indices) Copies() []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.copies
+}
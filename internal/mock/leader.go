@@ -0,0 +1,44 @@
+package mock
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+type Leader struct {
+	leader   atomic.Bool
+	lost     chan struct{}
+	lostOnce sync.Once
+}
+
+// NewLeader returns a leader leading as per leading, Campaign succeeding right away
+func NewLeader(leading bool) *Leader {
+	l := &Leader{lost: make(chan struct{})}
+	l.leader.Store(leading)
+	return l
+}
+
+func (l *Leader) Campaign(ctx context.Context) error {
+	l.leader.Store(true)
+	return nil
+}
+
+func (l *Leader) IsLeader() bool {
+	return l.leader.Load()
+}
+
+func (l *Leader) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Lose ends leadership, closing Lost
+func (l *Leader) Lose() {
+	l.leader.Store(false)
+	l.lostOnce.Do(func() { close(l.lost) })
+}
+
+func (l *Leader) Close() error {
+	l.leader.Store(false)
+	return nil
+}
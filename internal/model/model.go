@@ -1,5 +1,10 @@
 package model
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type User struct {
 	ID        int       `json:"id"`
 	Name      string    `json:"name"`
@@ -23,8 +28,8 @@ type Hashtag struct {
 }
 
 type UserProject struct {
-	ProjectId int    `json:"project_id"`
-	UserId    string `json:"user_id"`
+	ProjectId int `json:"project_id"`
+	UserId    int `json:"user_id"`
 }
 
 type ProjectHashtag struct {
@@ -42,3 +47,88 @@ type FuzzyUser struct {
 	Name      string `json:"name"`
 	CreatedAt string `json:"created_at"`
 }
+
+// UpdateResult counts the documents an update by query updated & the ones it failed to
+type UpdateResult struct {
+	Updated int64 `json:"updated"`
+	Failed  int64 `json:"failed"`
+}
+
+// Drift lists the documents of elasticsearch found out of sync with postgres by a verification
+type Drift struct {
+	// number of documents of postgres compared
+	Checked int `json:"checked"`
+	// held by postgres only
+	Missing []string `json:"missing"`
+	// held by both, differently
+	Stale []string `json:"stale"`
+	// held by elasticsearch only
+	Orphaned []string `json:"orphaned"`
+	// number of documents reindexed or deleted to repair the drift
+	Repaired int `json:"repaired"`
+}
+
+// Delta is a single change captured from postgres
+type Delta struct {
+	// Position of the change in its source, opaque to everyone but the source.
+	// Empty when the source can not replay changes (LISTEN/NOTIFY)
+	Position string
+	Payload  string
+}
+
+// DeadLetter is a delta the pipeline gave up on once its retries ran out
+type DeadLetter struct {
+	ID        int64     `json:"id"`
+	Position  string    `json:"position"`
+	Payload   string    `json:"payload"`
+	Error     string    `json:"error"`
+	Attempts  int       `json:"attempts"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Gap is a period during which the listener may have missed changes
+type Gap struct {
+	From time.Time
+	To   time.Time
+}
+
+// Document is a document as indexed, regardless of its shape
+type Document struct {
+	ID string
+	// Version orders writes of the document, writes older than the one indexed are dropped.
+	// 0 writes unconditionally
+	Version int64
+	// ReadAt is the version of the document as read from elasticsearch, writes carrying it are dropped
+	// if the document was written since. Ignored for writes carrying a Version
+	ReadAt *ReadVersion
+	// Source is nil for documents to delete
+	Source json.RawMessage
+}
+
+// ReadVersion is the sequence number & primary term a document was read at, zero for a document read as missing
+type ReadVersion struct {
+	SeqNo       int64
+	PrimaryTerm int64
+}
+
+// Health is the state of the pipeline, as reported by its admin server
+type Health struct {
+	Status string `json:"status"`
+	// whether deltas are processed, false once the listener stopped streaming them
+	Running         bool       `json:"running"`
+	LastEventAt     *time.Time `json:"last_event_at,omitempty"`
+	EventsReceived  int64      `json:"events_received"`
+	EventsProcessed int64      `json:"events_processed"`
+	EventsFailed    int64      `json:"events_failed"`
+	// deltas buffered ahead of indexing, omitted for listeners buffering none
+	QueueDepth *int `json:"queue_depth,omitempty"`
+}
+
+// Readiness tells whether the pipeline indexes deltas, as reported by its admin server
+type Readiness struct {
+	Status                 string `json:"status"`
+	Leader                 bool   `json:"leader"`
+	ListenerConnected      bool   `json:"listener_connected"`
+	ElasticsearchReachable bool   `json:"elasticsearch_reachable"`
+	Error                  string `json:"error,omitempty"`
+}
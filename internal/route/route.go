@@ -0,0 +1,47 @@
+package route
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Unmatched names the route of requests matching none
+const Unmatched = "unmatched"
+
+// Template returns the path template of the route r matched, Unmatched if none
+func Template(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if tpl, err := current.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return Unmatched
+}
+
+// Match returns the path template of the route of router r matches, Unmatched if none, as for requests
+// served through router rather than by it
+func Match(router *mux.Router, r *http.Request) string {
+	var match mux.RouteMatch
+	if router.Match(r, &match) && match.Route != nil {
+		if tpl, err := match.Route.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return Unmatched
+}
+
+// StatusRecorder records the status code written through it, 200 unless written otherwise
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status int
+}
+
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (r *StatusRecorder) WriteHeader(status int) {
+	r.Status = status
+	r.ResponseWriter.WriteHeader(status)
+}
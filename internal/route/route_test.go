@@ -0,0 +1,65 @@
+package route
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplate(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		wantStatus int
+	}{
+		{name: "requests should be named by the route they matched", target: "/search/user/1", wantStatus: http.StatusOK},
+		{name: "status codes written should be recorded", target: "/search/user/x", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var route string
+			var rec *StatusRecorder
+			r := mux.NewRouter()
+			r.HandleFunc("/search/user/{userID}", func(w http.ResponseWriter, r *http.Request) {
+				if mux.Vars(r)["userID"] == "x" {
+					w.WriteHeader(http.StatusBadRequest)
+				}
+			})
+			r.Use(func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					rec = NewStatusRecorder(w)
+					next.ServeHTTP(rec, r)
+					route = Template(r)
+				})
+			})
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.target, nil))
+			assert.Equal(t, "/search/user/{userID}", route)
+			assert.Equal(t, tt.wantStatus, rec.Status)
+		})
+	}
+	assert.Equal(t, Unmatched, Template(httptest.NewRequest(http.MethodGet, "/unknown", nil)),
+		"requests matching no route must be named alike")
+}
+
+func TestMatch(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/search/user/{userID}", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+	tests := []struct {
+		name   string
+		method string
+		target string
+		want   string
+	}{
+		{name: "requests should be named by the route they match", method: http.MethodGet, target: "/search/user/1", want: "/search/user/{userID}"},
+		{name: "requests matching no path should be unmatched", method: http.MethodGet, target: "/unknown", want: Unmatched},
+		{name: "requests matching no method should be unmatched", method: http.MethodPost, target: "/search/user/1", want: Unmatched},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Match(r, httptest.NewRequest(tt.method, tt.target, nil)))
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"pg-to-es/internal/contract"
+	"pg-to-es/internal/metrics"
+	"pg-to-es/internal/model"
+	"pg-to-es/internal/tracing"
+	"strconv"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// Bulk buffers writes to a single index & sends them in a single bulk request on Flush.
+// Only the last write of each document is kept, reads through Bulk observe buffered writes.
+// Bulk is not safe for concurrent use.
+type Bulk struct {
+	es            *Elastic
+	index         string
+	maxActions    int
+	maxBytes      int
+	flushInterval time.Duration
+	// ids in the order they were first written, with their last buffered write
+	order   []int
+	pending map[int]*bulkWrite
+	bytes   int
+	// versions of the documents read from elasticsearch, writes apply only if they did not change since
+	versions map[int]docVersion
+}
+
+type bulkWrite struct {
+	// doc is nil for deletes
+	doc   *model.User
+	bytes int
+}
+
+// Bulk returns a bulk writer to index, sized as per config.Es
+func (c *Elastic) Bulk(index string) contract.Bulk {
+	return &Bulk{
+		es:            c,
+		index:         index,
+		maxActions:    c.cfg.BulkActions,
+		maxBytes:      c.cfg.BulkBytes,
+		flushInterval: c.cfg.BulkFlushInterval,
+		pending:       map[int]*bulkWrite{},
+		versions:      map[int]docVersion{},
+	}
+}
+
+// Index buffers a create or full replace of doc
+func (b *Bulk) Index(doc model.User) {
+	body, _ := json.Marshal(doc)
+	doc = cloneUser(doc)
+	b.buffer(doc.ID, &bulkWrite{&doc, len(body)})
+}
+
+// Delete buffers a delete of document id
+func (b *Bulk) Delete(id int) {
+	b.buffer(id, &bulkWrite{nil, 0})
+}
+
+func (b *Bulk) buffer(id int, w *bulkWrite) {
+	if prev, ok := b.pending[id]; ok {
+		b.bytes -= prev.bytes
+	} else {
+		b.order = append(b.order, id)
+	}
+	b.pending[id] = w
+	b.bytes += w.bytes
+}
+
+// Len returns the number of buffered writes
+func (b *Bulk) Len() int {
+	return len(b.order)
+}
+
+// Full reports whether either the max actions or the max bytes are reached
+func (b *Bulk) Full() bool {
+	return len(b.order) >= b.maxActions || b.bytes >= b.maxBytes
+}
+
+// FlushInterval returns the longest writes should stay buffered
+func (b *Bulk) FlushInterval() time.Duration {
+	return b.flushInterval
+}
+
+// Flush sends every buffered write, the ones which failed stay buffered for a retry
+func (b *Bulk) Flush(ctx context.Context) (err error) {
+	if len(b.order) == 0 {
+		return nil
+	}
+	ctx, end := b.es.startSpan(ctx, "Bulk.Flush", b.index, tracing.Documents.Int(len(b.order)))
+	defer end(&err)
+	bulk := b.es.c.Bulk().Index(b.index)
+	for _, id := range b.order {
+		w := b.pending[id]
+		version, read := b.versions[id]
+		if w.doc == nil {
+			req := elastic.NewBulkDeleteRequest().Id(strconv.Itoa(id))
+			if read && version.found {
+				req.IfSeqNo(version.seqNo).IfPrimaryTerm(version.primaryTerm)
+			}
+			bulk.Add(req)
+			continue
+		}
+		req := elastic.NewBulkIndexRequest().Id(strconv.Itoa(id)).Doc(w.doc)
+		switch {
+		case read && version.found:
+			req.IfSeqNo(version.seqNo).IfPrimaryTerm(version.primaryTerm)
+		case read:
+			// read as missing, must still be
+			req.OpType("create")
+		}
+		bulk.Add(req)
+	}
+	n := len(b.order)
+	res, err := bulk.Do(ctx)
+	if err != nil {
+		return err
+	}
+	var failed []*elastic.BulkResponseItem
+	retained := map[int]bool{}
+	conflicts := 0
+	for _, item := range res.Failed() {
+		// deleting a missing document is not a failure
+		if item.Status == 404 && item.Result == "not_found" {
+			continue
+		}
+		failed = append(failed, item)
+		if item.Status == 409 {
+			// dropped, to be applied again on top of the document as it is now
+			conflicts++
+			continue
+		}
+		metrics.ElasticErrors.WithLabelValues(strconv.Itoa(item.Status)).Inc()
+		id, _ := strconv.Atoi(item.Id)
+		retained[id] = true
+	}
+	metrics.VersionConflicts.Add(float64(conflicts))
+	b.retain(retained)
+	if conflicts > 0 {
+		return fmt.Errorf("%d of %d writes conflicted, first failure: %s: %w", conflicts, n, bulkError(failed[0]), contract.ErrConflict)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d writes failed, first failure: %s", len(failed), n, bulkError(failed[0]))
+	}
+	return nil
+}
+
+// Reset discards every buffered write
+func (b *Bulk) Reset() {
+	b.retain(nil)
+}
+
+// retain discards every buffered write but the ones of ids, along with the versions read
+// of the others, as documents are read anew ahead of every write
+func (b *Bulk) retain(ids map[int]bool) {
+	for id := range b.versions {
+		if !ids[id] {
+			delete(b.versions, id)
+		}
+	}
+	order := b.order[:0]
+	b.bytes = 0
+	for _, id := range b.order {
+		if !ids[id] {
+			delete(b.pending, id)
+			continue
+		}
+		order = append(order, id)
+		b.bytes += b.pending[id].bytes
+	}
+	b.order = order
+}
+
+// GetByUserId returns the buffered document if any, else the indexed one
+func (b *Bulk) GetByUserId(ctx context.Context, userId int) (*model.User, error) {
+	if w, ok := b.pending[userId]; ok {
+		if w.doc == nil {
+			return nil, contract.ErrNotFound
+		}
+		doc := cloneUser(*w.doc)
+		return &doc, nil
+	}
+	doc, version, err := b.es.getUser(ctx, b.index, userId)
+	if err == nil || errors.Is(err, contract.ErrNotFound) {
+		b.versions[userId] = version
+	}
+	return doc, err
+}
+
+// RemoveProject removes the project from every document holding it, through an update by query. Buffered
+// writes are flushed ahead, for the update to observe them
+func (b *Bulk) RemoveProject(ctx context.Context, projectId int) error {
+	err := b.Flush(ctx)
+	if err != nil {
+		return fmt.Errorf("b.Flush() failed, err: %w", err)
+	}
+	_, err = b.es.RemoveProject(ctx, b.index, projectId)
+	return err
+}
+
+// RemoveHashtag removes the hashtag from every project holding it, through an update by query. Buffered
+// writes are flushed ahead, for the update to observe them
+func (b *Bulk) RemoveHashtag(ctx context.Context, hashtagId int) error {
+	err := b.Flush(ctx)
+	if err != nil {
+		return fmt.Errorf("b.Flush() failed, err: %w", err)
+	}
+	_, err = b.es.RemoveHashtag(ctx, b.index, hashtagId)
+	return err
+}
+
+// RemoveProjectHashtag removes the hashtag from the project only, in every document holding it, through an
+// update by query. Buffered writes are flushed ahead, for the update to observe them
+func (b *Bulk) RemoveProjectHashtag(ctx context.Context, projectId, hashtagId int) error {
+	err := b.Flush(ctx)
+	if err != nil {
+		return fmt.Errorf("b.Flush() failed, err: %w", err)
+	}
+	_, err = b.es.RemoveProjectHashtag(ctx, b.index, projectId, hashtagId)
+	return err
+}
+
+// cloneUser deep copies doc, so buffered writes are never mutated through the documents read
+func cloneUser(doc model.User) model.User {
+	if doc.Projects == nil {
+		return doc
+	}
+	projects := make([]model.Project, len(doc.Projects))
+	for idx, project := range doc.Projects {
+		if project.Hashtags != nil {
+			project.Hashtags = append([]model.Hashtag{}, project.Hashtags...)
+		}
+		projects[idx] = project
+	}
+	doc.Projects = projects
+	return doc
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"pg-to-es/internal/config"
+	"pg-to-es/internal/model"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBulk_buffer(t *testing.T) {
+	es := &Elastic{cfg: config.Es{BulkActions: 2, BulkBytes: 1 << 20}}
+	b := es.Bulk("root").(*Bulk)
+
+	b.Index(model.User{ID: 1, Name: "User 1"})
+	b.Index(model.User{ID: 1, Name: "User 1 renamed"})
+	assert.Equal(t, 1, b.Len(), "only the last write of a document must be kept")
+	assert.False(t, b.Full())
+
+	b.Delete(2)
+	assert.Equal(t, 2, b.Len())
+	assert.True(t, b.Full(), "max actions must fill the buffer")
+	assert.Equal(t, []int{1, 2}, b.order, "writes must keep their order")
+	assert.Equal(t, "User 1 renamed", b.pending[1].doc.Name)
+	assert.Nil(t, b.pending[2].doc, "delete must carry no document")
+}
+
+func TestBulk_retain(t *testing.T) {
+	es := &Elastic{cfg: config.Es{BulkActions: 100, BulkBytes: 1 << 20}}
+	b := es.Bulk("root").(*Bulk)
+	b.Index(model.User{ID: 1})
+	b.Delete(2)
+	b.Index(model.User{ID: 3})
+
+	b.retain(map[int]bool{1: true, 3: true})
+	assert.Equal(t, []int{1, 3}, b.order, "failed writes must stay buffered in order")
+	assert.Equal(t, b.pending[1].bytes+b.pending[3].bytes, b.bytes)
+	_, ok := b.pending[2]
+	assert.False(t, ok, "flushed writes must be discarded")
+
+	b.Reset()
+	assert.Equal(t, 0, b.Len())
+	assert.Equal(t, 0, b.bytes)
+}
+
+func TestBulk_RemoveProject(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/root/_bulk":
+			fmt.Fprint(w, `{"items":[{"index":{"_id":"1","status":200}}]}`)
+		case "/root/_update_by_query":
+			fmt.Fprint(w, `{"total":25,"updated":25}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	es, err := NewElastic(config.Es{Host: server.URL, BulkActions: 100, BulkBytes: 1 << 20}, slog.Default())
+	if !assert.NoError(t, err) {
+		return
+	}
+	b := es.Bulk("root").(*Bulk)
+	b.Index(model.User{ID: 1, Projects: []model.Project{{ID: 7}}})
+
+	err = b.RemoveProject(context.Background(), 7)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/root/_bulk", "/root/_update_by_query"}, paths,
+		"buffered writes must be flushed ahead of removing the project from every document, within elasticsearch")
+	assert.Equal(t, 0, b.Len())
+}
@@ -0,0 +1,335 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"pg-to-es/internal/contract"
+	"pg-to-es/internal/logging"
+	"pg-to-es/internal/model"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// busPositionPrefix marks the positions of the deltas consumed from an EventBus, as opposed to the ones
+// of the listener publishing them
+const busPositionPrefix = "bus:"
+
+// gapPrefix starts the payloads of gaps carried over an EventBus, as marshalled from gapEvent
+const gapPrefix = `{"gap":`
+
+// gapEvent is the payload a gap of the listener publishing is carried over an EventBus as, in order with deltas
+type gapEvent struct {
+	Gap model.Gap `json:"gap"`
+}
+
+// relayAckInterval is how often Relay looks up the deltas the consumer acknowledged, to acknowledge them
+// to the listener
+const relayAckInterval = 100 * time.Millisecond
+
+// MemoryBus is an EventBus held in memory, for the listener & the pipeline to be decoupled within a single
+// process. Deltas not acknowledged are lost on exit
+type MemoryBus struct {
+	mu sync.Mutex
+	// deltas published & not acknowledged yet, the first one of sequence acked+1
+	deltas   []model.Delta
+	acked    uint64
+	position string
+	// position in its source of the last delta acknowledged
+	ackedPosition string
+	// closed & replaced on every publish, waking consumers up
+	published chan struct{}
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{published: make(chan struct{})}
+}
+
+func (b *MemoryBus) Publish(ctx context.Context, delta model.Delta) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.deltas = append(b.deltas, delta)
+	b.position = delta.Position
+	close(b.published)
+	b.published = make(chan struct{})
+	return nil
+}
+
+func (b *MemoryBus) Position(ctx context.Context) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.position, nil
+}
+
+func (b *MemoryBus) Consume(ctx context.Context, from string) (<-chan model.Delta, error) {
+	var after uint64
+	if from != "" {
+		var ok bool
+		after, ok = parseBusPosition(from)
+		if !ok {
+			return nil, fmt.Errorf("invalid bus position '%s'", from)
+		}
+	}
+	b.mu.Lock()
+	// positions past the last delta published are left by a previous process
+	if after > b.acked+uint64(len(b.deltas)) {
+		after = b.acked
+	}
+	b.mu.Unlock()
+	stream := make(chan model.Delta)
+	go func() {
+		defer close(stream)
+		for {
+			b.mu.Lock()
+			after = max(after, b.acked)
+			var (
+				delta     model.Delta
+				found     = after-b.acked < uint64(len(b.deltas))
+				published = b.published
+			)
+			if found {
+				delta = b.deltas[after-b.acked]
+			}
+			b.mu.Unlock()
+			if !found {
+				select {
+				case <-published:
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case stream <- model.Delta{Position: busPosition(after + 1), Payload: delta.Payload}:
+				after++
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return stream, nil
+}
+
+func (b *MemoryBus) Ack(ctx context.Context, position string) error {
+	seq, ok := parseBusPosition(position)
+	if !ok {
+		return fmt.Errorf("invalid bus position '%s'", position)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if seq <= b.acked {
+		return nil
+	}
+	drop := min(seq-b.acked, uint64(len(b.deltas)))
+	for _, delta := range b.deltas[:drop] {
+		if delta.Position != "" {
+			b.ackedPosition = delta.Position
+		}
+	}
+	b.deltas = b.deltas[drop:]
+	b.acked += drop
+	return nil
+}
+
+func (b *MemoryBus) Acked(ctx context.Context) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ackedPosition, nil
+}
+
+// Depth returns the number of deltas published & not acknowledged yet
+func (b *MemoryBus) Depth() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.deltas)
+}
+
+func (b *MemoryBus) Close() error {
+	return nil
+}
+
+// BusListener streams the deltas of an EventBus to the pipeline, in place of the listener publishing them,
+// along with its gaps
+type BusListener struct {
+	consumer contract.EventConsumer
+	gaps     chan model.Gap
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+	logger   *slog.Logger
+}
+
+func NewBusListener(consumer contract.EventConsumer, logger *slog.Logger) *BusListener {
+	return &BusListener{consumer: consumer, gaps: make(chan model.Gap), cancel: func() {}, logger: logger}
+}
+
+// Prepare is left to the listener publishing to the bus
+func (l *BusListener) Prepare(ctx context.Context) error {
+	return nil
+}
+
+// Start consumes the deltas published after from, a position of the bus. Any other position, such as the
+// one of a backfill, can not be handed over to the listener publishing, deltas are consumed from the last
+// one acknowledged instead
+func (l *BusListener) Start(ctx context.Context, from string) (<-chan model.Delta, error) {
+	if _, ok := parseBusPosition(from); !ok && from != "" {
+		l.logger.Warn("position is not one of the bus, consuming from the last delta acknowledged", logging.Position, from)
+		from = ""
+	}
+	l.mu.Lock()
+	ctx, l.cancel = context.WithCancel(ctx)
+	l.mu.Unlock()
+	deltas, err := l.consumer.Consume(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+	stream := make(chan model.Delta)
+	go func() {
+		defer close(stream)
+		for delta := range deltas {
+			var e gapEvent
+			if strings.HasPrefix(delta.Payload, gapPrefix) && json.Unmarshal([]byte(delta.Payload), &e) == nil {
+				// acknowledged along with the deltas following it
+				select {
+				case l.gaps <- e.Gap:
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+			select {
+			case stream <- delta:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return stream, nil
+}
+
+func (l *BusListener) Ack(ctx context.Context, position string) error {
+	return l.consumer.Ack(ctx, position)
+}
+
+// Connected reports whether the bus is, when holding a connection to a broker
+func (l *BusListener) Connected() bool {
+	if c, ok := l.consumer.(contract.Connection); ok {
+		return c.Connected()
+	}
+	return true
+}
+
+// Depth returns the number of deltas published & not acknowledged yet, 0 when the bus does not tell
+func (l *BusListener) Depth() int {
+	if b, ok := l.consumer.(contract.Backlog); ok {
+		return b.Depth()
+	}
+	return 0
+}
+
+// Gaps streams the gaps of the listener publishing, as carried by the bus
+func (l *BusListener) Gaps() <-chan model.Gap {
+	return l.gaps
+}
+
+func (l *BusListener) Stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cancel()
+}
+
+// Relay publishes every delta & gap of listener to producer, resuming after the last delta published, &
+// acknowledges deltas to the listener once the consumer acknowledged them, as indexed. Publishing is retried
+// until done, Relay returns once ctx is done or the listener stopped
+func Relay(ctx context.Context, listener contract.DbListener, producer contract.EventProducer, logger *slog.Logger) error {
+	from, err := producer.Position(ctx)
+	if err != nil {
+		return fmt.Errorf("producer.Position() failed, err: %w", err)
+	}
+	if from == "" {
+		// changes committed from now on are retained, until published
+		err = listener.Prepare(ctx)
+		if err != nil {
+			return fmt.Errorf("listener.Prepare() failed, err: %w", err)
+		}
+	}
+	deltaStream, err := listener.Start(ctx, from)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(relayAckInterval)
+	defer ticker.Stop()
+	// position last acknowledged to the listener
+	var acked string
+	for {
+		var delta model.Delta
+		select {
+		case d, ok := <-deltaStream:
+			if !ok {
+				return nil
+			}
+			delta = d
+			if delta.Position != "" {
+				from = delta.Position
+			}
+		case gap := <-listener.Gaps():
+			payload, err := json.Marshal(gapEvent{Gap: gap})
+			if err != nil {
+				return fmt.Errorf("json.Marshal() failed, err: %w", err)
+			}
+			// carries the position of the last delta published, for the listener to resume after it still
+			delta = model.Delta{Position: from, Payload: string(payload)}
+		case <-ticker.C:
+			acked = relayAck(ctx, listener, producer, acked, logger)
+			continue
+		case <-ctx.Done():
+			return nil
+		}
+		for {
+			err := producer.Publish(ctx, delta)
+			if err == nil {
+				break
+			}
+			logger.Error("producer.Publish() failed, retrying", logging.Err(err))
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+// relayAck acknowledges to listener the last delta the consumer of producer acknowledged, unless it is
+// acked already. Returns the position acknowledged last
+func relayAck(ctx context.Context, listener contract.DbListener, producer contract.EventProducer, acked string,
+	logger *slog.Logger) string {
+	position, err := producer.Acked(ctx)
+	if err != nil {
+		logger.Warn("producer.Acked() failed", logging.Err(err))
+		return acked
+	}
+	if position == "" || position == acked {
+		return acked
+	}
+	err = listener.Ack(ctx, position)
+	if err != nil {
+		logger.Warn("listener.Ack() failed", logging.Position, position, logging.Err(err))
+		return acked
+	}
+	return position
+}
+
+func busPosition(seq uint64) string {
+	return busPositionPrefix + strconv.FormatUint(seq, 10)
+}
+
+func parseBusPosition(position string) (uint64, bool) {
+	if !strings.HasPrefix(position, busPositionPrefix) {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(strings.TrimPrefix(position, busPositionPrefix), 10, 64)
+	return seq, err == nil
+}
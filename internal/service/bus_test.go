@@ -0,0 +1,182 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"pg-to-es/internal/config"
+	"pg-to-es/internal/contract"
+	"pg-to-es/internal/mock"
+	"pg-to-es/internal/model"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventBus(t *testing.T) {
+	tests := []struct {
+		name string
+		open func(t *testing.T) contract.EventBus
+	}{
+		{
+			name: "memory",
+			open: func(t *testing.T) contract.EventBus {
+				bus := NewMemoryBus()
+				return &reopenedBus{EventBus: bus, reopen: func() contract.EventBus { return bus }}
+			},
+		},
+		{
+			name: "nats",
+			open: func(t *testing.T) contract.EventBus {
+				cfg := startNats(t)
+				reopen := func() contract.EventBus {
+					bus, err := NewNatsBus(context.Background(), cfg, slog.Default())
+					if err != nil {
+						t.Fatal(err)
+					}
+					t.Cleanup(func() { bus.Close() })
+					return bus
+				}
+				return &reopenedBus{EventBus: reopen(), reopen: reopen}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			bus := tt.open(t)
+			position, err := bus.Position(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, "", position)
+
+			listener := mock.NewDbListener()
+			relayed := make(chan error, 1)
+			go func() { relayed <- Relay(ctx, listener, bus, slog.Default()) }()
+			listener.Push(model.Delta{Position: "0/1", Payload: "a"})
+			listener.Push(model.Delta{Position: "0/2", Payload: "b"})
+			listener.Push(model.Delta{Position: "0/3", Payload: "c"})
+			gap := model.Gap{From: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC), To: time.Date(2024, 5, 1, 10, 1, 0, 0, time.UTC)}
+			listener.PushGap(gap)
+			assert.Eventually(t, func() bool {
+				position, _ := bus.Position(ctx)
+				return position == "0/3"
+			}, 5*time.Second, time.Millisecond, "the listener must resume after the last delta published")
+			assert.True(t, listener.Prepared(), "the listener must be prepared when nothing was published yet")
+			time.Sleep(3 * relayAckInterval)
+			assert.Empty(t, listener.Acked(), "deltas must not be acknowledged to the listener until consumed")
+
+			consumeCtx, cancel := context.WithCancel(ctx)
+			l := NewBusListener(bus, slog.Default())
+			stream, err := l.Start(consumeCtx, "")
+			if !assert.NoError(t, err) {
+				cancel()
+				return
+			}
+			assert.Equal(t, model.Delta{Position: "bus:1", Payload: "a"}, <-stream)
+			assert.Equal(t, model.Delta{Position: "bus:2", Payload: "b"}, <-stream)
+			assert.NoError(t, l.Ack(ctx, "bus:2"))
+			assert.Eventually(t, func() bool {
+				acked := listener.Acked()
+				return len(acked) > 0 && acked[len(acked)-1] == "0/2"
+			}, 5*time.Second, time.Millisecond, "deltas must be acknowledged to the listener once acknowledged by the consumer")
+			l.Stop()
+			cancel()
+			for range stream {
+			}
+			listener.Stop()
+			assert.NoError(t, <-relayed)
+
+			// deltas not acknowledged are consumed anew, past the ones acknowledged
+			bus = bus.(*reopenedBus).reopen()
+			consumeCtx, cancel = context.WithCancel(ctx)
+			defer cancel()
+			l = NewBusListener(bus, slog.Default())
+			stream, err = l.Start(consumeCtx, "0/9")
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer l.Stop()
+			assert.Equal(t, model.Delta{Position: "bus:3", Payload: "c"}, <-stream)
+			select {
+			case got := <-l.Gaps():
+				assert.True(t, gap.From.Equal(got.From) && gap.To.Equal(got.To), "gaps must be carried over the bus")
+			case <-time.After(5 * time.Second):
+				t.Fatal("gap not consumed")
+			}
+			assert.NoError(t, bus.Publish(ctx, model.Delta{Position: "0/4", Payload: "d"}))
+			select {
+			case delta := <-stream:
+				assert.Equal(t, model.Delta{Position: "bus:5", Payload: "d"}, delta, "deltas published later must be consumed")
+			case <-time.After(5 * time.Second):
+				t.Fatal("delta published later not consumed")
+			}
+		})
+	}
+}
+
+func TestNatsBus_Ack(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bus, err := NewNatsBus(ctx, startNats(t), slog.Default())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer bus.Close()
+	for _, position := range []string{"0/1", "0/2", "0/3"} {
+		assert.NoError(t, bus.Publish(ctx, model.Delta{Position: position, Payload: position}))
+	}
+	stream, err := bus.Consume(ctx, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	<-stream
+	<-stream
+	assert.NoError(t, bus.Ack(ctx, "bus:2"))
+
+	info, err := bus.stream.Info(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint64(2), info.State.FirstSeq, "messages acknowledged must be removed from the stream")
+		assert.Equal(t, uint64(2), info.State.Msgs)
+	}
+	assert.Eventually(t, func() bool {
+		acked, _ := bus.Acked(ctx)
+		return acked == "0/2"
+	}, 5*time.Second, 10*time.Millisecond, "the message acknowledged last must be kept")
+	position, err := bus.Position(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "0/3", position)
+}
+
+// startNats runs a nats server with JetStream for the test, returning the config of a bus on it
+func startNats(t *testing.T) config.Bus {
+	srv, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Start()
+	t.Cleanup(srv.Shutdown)
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	return config.Bus{
+		URL:      srv.ClientURL(),
+		Stream:   "pg_to_es",
+		Subject:  "pg_to_es.deltas",
+		Consumer: "pipeline",
+		AckWait:  time.Minute,
+	}
+}
+
+// reopenedBus is a bus which can be reopened, as by a restart
+type reopenedBus struct {
+	contract.EventBus
+	reopen func() contract.EventBus
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"pg-to-es/internal/config"
+	"strings"
+)
+
+// PgCheckpoint persists the pipeline position in the es_checkpoint table
+type PgCheckpoint struct {
+	db   *sql.DB
+	name string
+}
+
+// Initialize Postgres Checkpoint, name identifies the pipeline owning the checkpoint
+func NewPgCheckpoint(ctx context.Context, cfg config.Pg, name string) (*PgCheckpoint, error) {
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS es_checkpoint (
+		name VARCHAR PRIMARY KEY,
+		position VARCHAR NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating es_checkpoint failed, err: %w", err)
+	}
+	return &PgCheckpoint{db, name}, nil
+}
+
+func (c *PgCheckpoint) Load(ctx context.Context) (string, error) {
+	var position string
+	err := c.db.QueryRowContext(ctx, "SELECT position FROM es_checkpoint WHERE name = $1", c.name).Scan(&position)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return position, err
+}
+
+func (c *PgCheckpoint) Save(ctx context.Context, position string) error {
+	_, err := c.db.ExecContext(ctx, `INSERT INTO es_checkpoint (name, position) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET position = EXCLUDED.position, updated_at = CURRENT_TIMESTAMP`,
+		c.name, position)
+	return err
+}
+
+func (c *PgCheckpoint) Close() error {
+	return c.db.Close()
+}
+
+// FileCheckpoint persists the pipeline position in a local file
+type FileCheckpoint struct {
+	path string
+}
+
+func NewFileCheckpoint(path string) *FileCheckpoint {
+	return &FileCheckpoint{path}
+}
+
+func (c *FileCheckpoint) Load(ctx context.Context) (string, error) {
+	b, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// Save writes to a temporary file which then replaces the checkpoint,
+// so a crash never leaves a torn checkpoint behind
+func (c *FileCheckpoint) Save(ctx context.Context, position string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(position)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
@@ -0,0 +1,25 @@
+package service
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	c := NewFileCheckpoint(filepath.Join(t.TempDir(), "pipeline.checkpoint"))
+
+	position, err := c.Load(ctx)
+	assert.NoError(t, err, "missing checkpoint must not fail")
+	assert.Equal(t, "", position, "missing checkpoint must be empty")
+
+	for _, want := range []string{"16/B374D848:0", "16/B374D848:1"} {
+		assert.NoError(t, c.Save(ctx, want))
+		position, err = c.Load(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, want, position, "position must match last saved")
+	}
+}
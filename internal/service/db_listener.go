@@ -2,42 +2,52 @@ package service
 
 import (
 	"context"
-	"fmt"
+	"log/slog"
 	"pg-to-es/internal/config"
+	"pg-to-es/internal/logging"
+	"pg-to-es/internal/model"
+	"pg-to-es/internal/tracing"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type DbListener struct {
 	cfg         config.Pg
 	lstnr       *pq.Listener
-	deltaStream chan string
+	deltaStream chan model.Delta
+	gaps        chan model.Gap
+	quit        chan struct{}
 	closeOnce   sync.Once
+	connected   atomic.Bool
+	logger      *slog.Logger
+
+	mu sync.Mutex
+	// when the last notification was received, or listening started if none was
+	lastSeen time.Time
 }
 
 // Initialize Listener
-func NewDbListener(cfg config.Pg) (*DbListener, error) {
-	var listenerErr error
-	listener := pq.NewListener(cfg.String(), cfg.ListenerMinReconnectInterval,
-		cfg.ListenerMaxReconnectInterval, func(event pq.ListenerEventType, err error) {
-			if err != nil {
-				listenerErr = fmt.Errorf("pq.NewListener() failed, err: %s", err)
-			}
-		})
-	if listenerErr != nil {
-		return nil, listenerErr
-	}
-	return &DbListener{
+func NewDbListener(cfg config.Pg, logger *slog.Logger) (*DbListener, error) {
+	l := &DbListener{
 		cfg:         cfg,
-		lstnr:       listener,
-		deltaStream: make(chan string),
-	}, listenerErr
+		logger:      logger,
+		deltaStream: make(chan model.Delta),
+		gaps:        make(chan model.Gap, 1),
+		quit:        make(chan struct{}),
+		lastSeen:    time.Now(),
+	}
+	l.lstnr = pq.NewListener(cfg.String(), cfg.ListenerMinReconnectInterval,
+		cfg.ListenerMaxReconnectInterval, l.event)
+	return l, nil
 }
 
-// Start Listening to CRUD operations
-func (l *DbListener) Start(ctx context.Context) (<-chan string, error) {
-	err := l.lstnr.Listen(l.cfg.ListenerChannel)
+// Start Listening to CRUD operations, notifications can not be replayed thus from is ignored
+func (l *DbListener) Start(ctx context.Context, from string) (<-chan model.Delta, error) {
+	err := l.Prepare(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -45,19 +55,104 @@ func (l *DbListener) Start(ctx context.Context) (<-chan string, error) {
 	return l.deltaStream, nil
 }
 
+// Prepare starts listening, notifications are queued until Start
+func (l *DbListener) Prepare(ctx context.Context) error {
+	err := l.lstnr.Listen(l.cfg.ListenerChannel)
+	if err == pq.ErrChannelAlreadyOpen {
+		return nil
+	}
+	return err
+}
+
+// Ack is a no-op, notifications can not be replayed
+func (l *DbListener) Ack(ctx context.Context, position string) error {
+	return nil
+}
+
+// Gaps streams the periods notifications were missed during, from the last notification
+// received ahead of a lost connection up to the reconnect. Gaps not yet received are merged
+func (l *DbListener) Gaps() <-chan model.Gap {
+	return l.gaps
+}
+
 // Stop listening
 func (l *DbListener) Stop() {
 	l.closeOnce.Do(func() {
-		close(l.deltaStream)
+		close(l.quit)
 		l.lstnr.Close()
 	})
 }
 
+// Connected reports whether listening, notifications are missed otherwise
+func (l *DbListener) Connected() bool {
+	return l.connected.Load()
+}
+
+func (l *DbListener) event(event pq.ListenerEventType, err error) {
+	if err != nil {
+		l.logger.Warn("db listener event", "event", event, logging.Err(err))
+	}
+	switch event {
+	case pq.ListenerEventConnected:
+		l.connected.Store(true)
+	case pq.ListenerEventDisconnected, pq.ListenerEventConnectionAttemptFailed:
+		l.connected.Store(false)
+	}
+	if event != pq.ListenerEventReconnected {
+		return
+	}
+	l.connected.Store(true)
+	l.mu.Lock()
+	gap := model.Gap{From: l.lastSeen, To: time.Now()}
+	l.mu.Unlock()
+	l.logger.Warn("db listener reconnected, notifications sent meanwhile were missed", "since", gap.From.Format(time.RFC3339))
+	for {
+		select {
+		case l.gaps <- gap:
+			return
+		default:
+		}
+		select {
+		case prev := <-l.gaps:
+			gap.From = prev.From
+		default:
+		}
+	}
+}
+
 func (l *DbListener) listen(ctx context.Context) {
+	defer close(l.deltaStream)
 	for {
 		select {
-		case n := <-l.lstnr.Notify:
-			l.deltaStream <- n.Extra
+		case n, ok := <-l.lstnr.Notify:
+			if !ok {
+				return
+			}
+			// nil follows a reconnect, notifications sent meanwhile are lost & reported as a gap
+			if n == nil {
+				continue
+			}
+			l.mu.Lock()
+			l.lastSeen = time.Now()
+			l.mu.Unlock()
+			delta := model.Delta{Payload: n.Extra}
+			if l.logger.Enabled(ctx, slog.LevelDebug) {
+				l.logger.Debug("notification received", logging.Delta(delta)...)
+			}
+			// spans the receipt of the notification up to its hand over
+			_, span := tracing.Start(ctx, "notify.receive", trace.WithAttributes(tracing.Delta(delta)...))
+			select {
+			case l.deltaStream <- delta:
+				span.End()
+			case <-l.quit:
+				span.End()
+				return
+			case <-ctx.Done():
+				span.End()
+				return
+			}
+		case <-l.quit:
+			return
 		case <-ctx.Done():
 			return
 		}
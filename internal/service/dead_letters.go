@@ -0,0 +1,195 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"pg-to-es/internal/config"
+	"pg-to-es/internal/model"
+	"sync"
+	"time"
+)
+
+// PgDeadLetters persists dead letters in the es_dead_letter table
+type PgDeadLetters struct {
+	db *sql.DB
+}
+
+// Initialize Postgres Dead Letters
+func NewPgDeadLetters(ctx context.Context, cfg config.Pg) (*PgDeadLetters, error) {
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS es_dead_letter (
+		id BIGSERIAL PRIMARY KEY,
+		position VARCHAR NOT NULL,
+		payload TEXT NOT NULL,
+		error TEXT NOT NULL,
+		attempts INT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating es_dead_letter failed, err: %w", err)
+	}
+	return &PgDeadLetters{db}, nil
+}
+
+func (d *PgDeadLetters) Add(ctx context.Context, letter model.DeadLetter) error {
+	_, err := d.db.ExecContext(ctx, "INSERT INTO es_dead_letter (position, payload, error, attempts) VALUES ($1, $2, $3, $4)",
+		letter.Position, letter.Payload, letter.Error, letter.Attempts)
+	return err
+}
+
+func (d *PgDeadLetters) List(ctx context.Context) ([]model.DeadLetter, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT id, position, payload, error, attempts, created_at FROM es_dead_letter ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("es_dead_letter query failed, err: %w", err)
+	}
+	defer rows.Close()
+	var letters []model.DeadLetter
+	for rows.Next() {
+		var l model.DeadLetter
+		err = rows.Scan(&l.ID, &l.Position, &l.Payload, &l.Error, &l.Attempts, &l.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan() failed, err: %w", err)
+		}
+		letters = append(letters, l)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err(), err: %w", err)
+	}
+	return letters, nil
+}
+
+func (d *PgDeadLetters) Remove(ctx context.Context, id int64) error {
+	_, err := d.db.ExecContext(ctx, "DELETE FROM es_dead_letter WHERE id = $1", id)
+	return err
+}
+
+func (d *PgDeadLetters) Close() error {
+	return d.db.Close()
+}
+
+// FileDeadLetters persists dead letters in a local NDJSON file, one letter per line
+type FileDeadLetters struct {
+	path string
+	mu   sync.Mutex
+	// id of the last letter added, read from the file on the first Add only
+	lastID int64
+	loaded bool
+}
+
+func NewFileDeadLetters(path string) *FileDeadLetters {
+	return &FileDeadLetters{path: path}
+}
+
+// Add appends letter, ids follow the last id added, the highest id held on start
+func (d *FileDeadLetters) Add(ctx context.Context, letter model.DeadLetter) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.loaded {
+		letters, err := d.read()
+		if err != nil {
+			return err
+		}
+		if n := len(letters); n > 0 {
+			d.lastID = letters[n-1].ID
+		}
+		d.loaded = true
+	}
+	letter.ID = d.lastID + 1
+	letter.CreatedAt = time.Now().UTC()
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(d.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	d.lastID = letter.ID
+	return nil
+}
+
+func (d *FileDeadLetters) List(ctx context.Context) ([]model.DeadLetter, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.read()
+}
+
+// Remove rewrites the file without the letter, through a temporary file replacing it
+func (d *FileDeadLetters) Remove(ctx context.Context, id int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	letters, err := d.read()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(d.path), filepath.Base(d.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, letter := range letters {
+		if letter.ID == id {
+			continue
+		}
+		if err = enc.Encode(letter); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), d.path)
+}
+
+func (d *FileDeadLetters) read() ([]model.DeadLetter, error) {
+	f, err := os.Open(d.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var letters []model.DeadLetter
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var letter model.DeadLetter
+		err = dec.Decode(&letter)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s failed, err: %w", d.path, err)
+		}
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
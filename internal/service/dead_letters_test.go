@@ -0,0 +1,39 @@
+package service
+
+import (
+	"context"
+	"path/filepath"
+	"pg-to-es/internal/model"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "dead_letters.ndjson")
+	d := NewFileDeadLetters(path)
+	for _, payload := range []string{"a", "b", "c"} {
+		assert.NoError(t, d.Add(ctx, model.DeadLetter{Payload: payload}))
+	}
+	assert.NoError(t, d.Remove(ctx, 3))
+	assert.NoError(t, d.Add(ctx, model.DeadLetter{Payload: "d"}))
+
+	ids := func(letters []model.DeadLetter) []int64 {
+		var ids []int64
+		for _, letter := range letters {
+			ids = append(ids, letter.ID)
+		}
+		return ids
+	}
+	letters, err := d.List(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1, 2, 4}, ids(letters), "ids of letters removed must not be reused")
+
+	// reopened, ids follow the highest held
+	d = NewFileDeadLetters(path)
+	assert.NoError(t, d.Add(ctx, model.DeadLetter{Payload: "e"}))
+	letters, err = d.List(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1, 2, 4, 5}, ids(letters))
+}
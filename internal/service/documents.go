@@ -0,0 +1,329 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"pg-to-es/internal/config"
+	"pg-to-es/internal/model"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// PgDocuments builds complete model.User documents straight from postgres
+type PgDocuments struct {
+	db *sql.DB
+}
+
+// Initialize Postgres Documents
+func NewPgDocuments(cfg config.Pg) (*PgDocuments, error) {
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &PgDocuments{db}, nil
+}
+
+func (d *PgDocuments) Close() error {
+	return d.db.Close()
+}
+
+// Snapshot walks every user, in batches of batchSize, as of a single consistent snapshot.
+// Returns the position of the snapshot, from which ReplicationListener streams exactly
+// the changes the snapshot does not cover
+func (d *PgDocuments) Snapshot(ctx context.Context, batchSize int, fn func([]model.Document) error) (string, error) {
+	return snapshot(ctx, d.db, func(tx *sql.Tx) error {
+		return d.walk(func(afterID int) ([]model.User, error) {
+			return d.users(ctx, tx, afterID, batchSize)
+		}, fn)
+	})
+}
+
+// snapshot calls fn within a repeatable read transaction, returning the position of its snapshot
+func snapshot(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) (string, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return "", fmt.Errorf("db.BeginTx() failed, err: %w", err)
+	}
+	defer tx.Rollback()
+
+	// the first statement takes the snapshot, every later one reads from it
+	var s, lsn string
+	err = tx.QueryRowContext(ctx, "SELECT pg_current_snapshot()::text, pg_current_wal_lsn()::text").Scan(&s, &lsn)
+	if err != nil {
+		return "", fmt.Errorf("snapshot lookup failed, err: %w", err)
+	}
+	snap, err := parsePgSnapshot(lsn, s)
+	if err != nil {
+		return "", err
+	}
+	err = fn(tx)
+	if err != nil {
+		return "", err
+	}
+	return replicationPosition{snapshot: &snap}.String(), tx.Commit()
+}
+
+func (d *PgDocuments) Build(ctx context.Context, ids []string) ([]model.Document, error) {
+	var userIDs []int64
+	for _, id := range ids {
+		userID, err := strconv.ParseInt(id, 10, 64)
+		if err == nil {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	var found []model.Document
+	if len(userIDs) > 0 {
+		users, err := d.query(ctx, d.db, `SELECT id, COALESCE(name, ''), COALESCE(to_json(created_at) #>> '{}', '')
+			FROM users WHERE id = ANY($1) ORDER BY id`, pq.Array(userIDs))
+		if err != nil {
+			return nil, err
+		}
+		found, err = userDocuments(users)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sources := map[string][]byte{}
+	for _, doc := range found {
+		sources[doc.ID] = doc.Source
+	}
+	docs := make([]model.Document, len(ids))
+	for idx, id := range ids {
+		docs[idx] = model.Document{ID: id, Source: sources[id]}
+	}
+	return docs, nil
+}
+
+// Holding returns the ids of the users holding the row of table keys identifies, as of now
+func (d *PgDocuments) Holding(ctx context.Context, table string, keys map[string]int) ([]string, error) {
+	var query string
+	var key int
+	switch table {
+	case "users":
+		return []string{strconv.Itoa(keys["id"])}, nil
+	case "user_projects":
+		return []string{strconv.Itoa(keys["user_id"])}, nil
+	case "projects":
+		query, key = `SELECT user_id FROM user_projects WHERE project_id = $1 ORDER BY user_id`, keys["id"]
+	case "project_hashtags":
+		query, key = `SELECT user_id FROM user_projects WHERE project_id = $1 ORDER BY user_id`, keys["project_id"]
+	case "hashtags":
+		query, key = `SELECT DISTINCT UP.user_id FROM project_hashtags PH
+			JOIN user_projects UP ON UP.project_id = PH.project_id
+			WHERE PH.hashtag_id = $1 ORDER BY UP.user_id`, keys["id"]
+	default:
+		return nil, fmt.Errorf("unknown table '%s'", table)
+	}
+	rows, err := d.db.QueryContext(ctx, query, key)
+	if err != nil {
+		return nil, fmt.Errorf("holders query failed, err: %w", err)
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan() failed, err: %w", err)
+		}
+		ids = append(ids, strconv.Itoa(id))
+	}
+	return ids, rows.Err()
+}
+
+// walk reads batches in id order, each after the last id of the previous, until one is empty
+func (d *PgDocuments) walk(batch func(afterID int) ([]model.User, error), fn func([]model.Document) error) error {
+	lastID := 0
+	for {
+		users, err := batch(lastID)
+		if err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			return nil
+		}
+		docs, err := userDocuments(users)
+		if err != nil {
+			return err
+		}
+		err = fn(docs)
+		if err != nil {
+			return err
+		}
+		lastID = users[len(users)-1].ID
+	}
+}
+
+// userDocuments renders users as they are indexed
+func userDocuments(users []model.User) ([]model.Document, error) {
+	docs := make([]model.Document, len(users))
+	for idx, user := range users {
+		source, err := json.Marshal(user)
+		if err != nil {
+			return nil, err
+		}
+		docs[idx] = model.Document{ID: strconv.Itoa(user.ID), Source: source}
+	}
+	return docs, nil
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// users reads a batch of users with id greater than afterID, along with their projects & hashtags
+func (d *PgDocuments) users(ctx context.Context, q queryer, afterID, limit int) ([]model.User, error) {
+	return d.query(ctx, q, `SELECT id, COALESCE(name, ''), COALESCE(to_json(created_at) #>> '{}', '')
+		FROM users WHERE id > $1 ORDER BY id LIMIT $2`, afterID, limit)
+}
+
+// query reads the users selected by query, as id, name & created_at, along with their projects & hashtags
+func (d *PgDocuments) query(ctx context.Context, q queryer, query string, args ...interface{}) ([]model.User, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("users query failed, err: %w", err)
+	}
+	var users []model.User
+	index := map[int]int{}
+	ids := []int64{}
+	for rows.Next() {
+		u := model.User{Projects: []model.Project{}}
+		err = rows.Scan(&u.ID, &u.Name, &u.CreatedAt)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("rows.Scan() failed, err: %w", err)
+		}
+		index[u.ID] = len(users)
+		ids = append(ids, int64(u.ID))
+		users = append(users, u)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err(), err: %w", err)
+	}
+	if len(users) == 0 {
+		return nil, nil
+	}
+
+	rows, err = q.QueryContext(ctx, `SELECT UP.user_id, P.id, COALESCE(P.name, ''), COALESCE(P.slug, ''),
+			COALESCE(P.description, ''), COALESCE(to_json(P.created_at) #>> '{}', ''),
+			H.id, COALESCE(H.name, ''), COALESCE(to_json(H.created_at) #>> '{}', '')
+		FROM user_projects UP
+			JOIN projects P ON UP.project_id = P.id
+			LEFT JOIN project_hashtags PH ON P.id = PH.project_id
+			LEFT JOIN hashtags H ON PH.hashtag_id = H.id
+		WHERE UP.user_id = ANY($1)
+		ORDER BY UP.user_id, P.id, H.id`, pq.Array(ids))
+	if err != nil {
+		return nil, fmt.Errorf("projects query failed, err: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			userID    int
+			p         model.Project
+			hashtagID sql.NullInt64
+			h         model.Hashtag
+		)
+		err = rows.Scan(&userID, &p.ID, &p.Name, &p.Slug, &p.Description, &p.CreatedAt, &hashtagID, &h.Name, &h.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan() failed, err: %w", err)
+		}
+		u := &users[index[userID]]
+		if n := len(u.Projects); n == 0 || u.Projects[n-1].ID != p.ID {
+			p.Hashtags = []model.Hashtag{}
+			u.Projects = append(u.Projects, p)
+		}
+		if hashtagID.Valid {
+			h.ID = int(hashtagID.Int64)
+			project := &u.Projects[len(u.Projects)-1]
+			project.Hashtags = append(project.Hashtags, h)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err(), err: %w", err)
+	}
+	return users, nil
+}
+
+// pgSnapshot describes which transactions an MVCC snapshot sees, see pg_current_snapshot()
+type pgSnapshot struct {
+	// wal insert position right after the snapshot was taken, transactions
+	// committed past it are never visible
+	lsn  uint64
+	xmin uint32
+	xmax uint32
+	xip  map[uint32]bool
+}
+
+// parsePgSnapshot parses lsn & the textual snapshot, e.g. 10:20:10,14,15
+func parsePgSnapshot(lsn, snapshot string) (pgSnapshot, error) {
+	s := pgSnapshot{xip: map[uint32]bool{}}
+	var err error
+	s.lsn, err = parseLSN(lsn)
+	if err != nil {
+		return s, err
+	}
+	parts := strings.Split(snapshot, ":")
+	if len(parts) != 3 {
+		return s, fmt.Errorf("invalid snapshot '%s'", snapshot)
+	}
+	// xid8 values carry the epoch in their upper half, wal carries 32 bit xids only
+	xid := func(v string) (uint32, error) {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid snapshot '%s', err: %w", snapshot, err)
+		}
+		return uint32(n), nil
+	}
+	if s.xmin, err = xid(parts[0]); err != nil {
+		return s, err
+	}
+	if s.xmax, err = xid(parts[1]); err != nil {
+		return s, err
+	}
+	if parts[2] != "" {
+		for _, v := range strings.Split(parts[2], ",") {
+			x, err := xid(v)
+			if err != nil {
+				return s, err
+			}
+			s.xip[x] = true
+		}
+	}
+	return s, nil
+}
+
+// visible reports whether transaction xid committed at commit lsn is seen by the snapshot
+func (s pgSnapshot) visible(xid uint32, commit uint64) bool {
+	if commit > s.lsn {
+		return false
+	}
+	if xidBefore(xid, s.xmin) {
+		return true
+	}
+	return xidBefore(xid, s.xmax) && !s.xip[xid]
+}
+
+func (s pgSnapshot) String() string {
+	xip := make([]uint32, 0, len(s.xip))
+	for x := range s.xip {
+		xip = append(xip, x)
+	}
+	sort.Slice(xip, func(i, j int) bool { return xidBefore(xip[i], xip[j]) })
+	parts := make([]string, len(xip))
+	for i, x := range xip {
+		parts[i] = strconv.FormatUint(uint64(x), 10)
+	}
+	return fmt.Sprintf("%s:%d:%d:%s", formatLSN(s.lsn), s.xmin, s.xmax, strings.Join(parts, ","))
+}
+
+// xidBefore compares xids the way postgres does, modulo 2^32
+func xidBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
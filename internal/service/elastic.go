@@ -3,31 +3,122 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
 	"pg-to-es/internal/config"
+	"pg-to-es/internal/contract"
+	"pg-to-es/internal/logging"
+	"pg-to-es/internal/metrics"
 	"pg-to-es/internal/model"
+	"pg-to-es/internal/tracing"
+	"strconv"
+	"time"
 
 	"github.com/olivere/elastic/v7"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// maxConflictAttempts is the number of times documents are updated before giving up on conflicts
+const maxConflictAttempts = 5
+
+// docVersion is the sequence number & primary term of a document as read, for writes to apply only if
+// it did not change since. found is false for documents read as missing
+type docVersion struct {
+	seqNo       int64
+	primaryTerm int64
+	found       bool
+}
+
+func newDocVersion(seqNo, primaryTerm *int64) docVersion {
+	if seqNo == nil || primaryTerm == nil {
+		return docVersion{}
+	}
+	return docVersion{*seqNo, *primaryTerm, true}
+}
+
 type Elastic struct {
-	c *elastic.Client
+	c      *elastic.Client
+	cfg    config.Es
+	logger *slog.Logger
 }
 
-func NewElastic(cfg config.Es) (*Elastic, error) {
+func NewElastic(cfg config.Es, logger *slog.Logger) (*Elastic, error) {
 	client, err := elastic.NewClient(
 		elastic.SetURL(cfg.Host),
+		elastic.SetHttpClient(&http.Client{Transport: errorsTransport{http.DefaultTransport}}),
 		elastic.SetHealthcheck(false),
 		elastic.SetSniff(false))
 	if err != nil {
 		return nil, err
 	}
-	return &Elastic{client}, nil
+	return &Elastic{client, cfg, logger}, nil
+}
+
+// errorsTransport counts the requests elasticsearch failed, or did not answer
+type errorsTransport struct {
+	next http.RoundTripper
+}
+
+func (t errorsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	switch {
+	case err != nil:
+		metrics.ElasticErrors.WithLabelValues("transport").Inc()
+	// missing documents, indices & aliases are looked up routinely, conflicts are counted apart
+	case res.StatusCode >= 400 && res.StatusCode != http.StatusNotFound && res.StatusCode != http.StatusConflict:
+		metrics.ElasticErrors.WithLabelValues(strconv.Itoa(res.StatusCode)).Inc()
+	}
+	return res, err
+}
+
+// startSpan traces the call op to elasticsearch, the returned func ends the span along with the error the
+// call returned & logs the call as debug. Documents found missing are not failures
+func (c *Elastic) startSpan(ctx context.Context, op, index string, attrs ...attribute.KeyValue) (context.Context, func(*error)) {
+	attrs = append(attrs, semconv.DBSystemElasticsearch)
+	if index != "" {
+		attrs = append(attrs, tracing.Index.String(index))
+	}
+	ctx, span := tracing.Start(ctx, "elastic."+op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	start := time.Now()
+	return ctx, func(err *error) {
+		e := *err
+		if errors.Is(e, contract.ErrNotFound) {
+			e = nil
+		}
+		tracing.End(span, e)
+		if !c.logger.Enabled(ctx, slog.LevelDebug) {
+			return
+		}
+		fields := []any{"op", op, "index", index}
+		for _, attr := range attrs {
+			if attr.Key == tracing.DocID {
+				fields = append(fields, logging.DocID, attr.Value.AsString())
+			}
+		}
+		fields = append(fields, "duration", time.Since(start))
+		if e != nil {
+			fields = append(fields, logging.Err(e))
+		}
+		c.logger.Debug("elasticsearch call", fields...)
+	}
+}
+
+// docID is the attribute of the document of id
+func docID(id int) attribute.KeyValue {
+	return tracing.DocID.String(strconv.Itoa(id))
 }
 
 // Function to create a document
-func (c *Elastic) Create(ctx context.Context, index string, id int, doc model.User) error {
-	_, err := c.c.Index().
+func (c *Elastic) Create(ctx context.Context, index string, id int, doc model.User) (err error) {
+	ctx, end := c.startSpan(ctx, "Create", index, docID(id))
+	defer end(&err)
+	_, err = c.c.Index().
 		Index(index).
 		Type("_doc").
 		Id(fmt.Sprintf("%d", id)).
@@ -36,119 +127,245 @@ func (c *Elastic) Create(ctx context.Context, index string, id int, doc model.Us
 	return err
 }
 
-func (c *Elastic) GetByProjectId(ctx context.Context, index string, projectId int) ([]model.User, error) {
-	var (
-		query         *elastic.TermQuery
-		searchService *elastic.SearchService
-	)
-	if projectId != 0 {
-		query = elastic.NewTermQuery("projects.id", projectId)
-		searchService = c.c.Search().Index(index).Query(query)
-	} else {
-		searchService = c.c.Search().Index(index)
-	}
-	searchResult, err := searchService.Do(ctx)
+func (c *Elastic) Ping(ctx context.Context) (err error) {
+	ctx, end := c.startSpan(ctx, "Ping", "")
+	defer end(&err)
+	_, err = c.c.PerformRequest(ctx, elastic.PerformRequestOptions{Method: "HEAD", Path: "/"})
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("elasticsearch unreachable, err: %w", err)
 	}
-	var results []model.User
-	for _, hit := range searchResult.Hits.Hits {
-		var result model.User
-		err := json.Unmarshal(hit.Source, &result)
-		if err != nil {
-			return nil, err
-		}
-		results = append(results, result)
+	return nil
+}
+
+// projectsQuery matches documents holding a project matching query
+func projectsQuery(query elastic.Query) elastic.Query {
+	return elastic.NewNestedQuery("projects", query)
+}
+
+// hashtagsQuery matches documents holding a hashtag matching query
+func hashtagsQuery(query elastic.Query) elastic.Query {
+	return projectsQuery(elastic.NewNestedQuery("projects.hashtags", query))
+}
+
+func (c *Elastic) GetByProjectId(ctx context.Context, index string, projectId int) (docs []model.User, err error) {
+	ctx, end := c.startSpan(ctx, "GetByProjectId", index, attribute.Int("project.id", projectId))
+	defer end(&err)
+	var query elastic.Query
+	if projectId != 0 {
+		query = projectsQuery(elastic.NewTermQuery("projects.id", projectId))
 	}
-	return results, nil
+	docs, _, err = c.searchUsers(ctx, index, query)
+	return docs, err
 }
 
-func (c *Elastic) GetByHashTagId(ctx context.Context, index string, hashTagId int) ([]model.User, error) {
-	query := elastic.NewTermQuery("projects.hashtags.id", hashTagId)
-	searchService := c.c.Search().Index(index).Query(query)
+func (c *Elastic) GetByHashTagId(ctx context.Context, index string, hashTagId int) (docs []model.User, err error) {
+	ctx, end := c.startSpan(ctx, "GetByHashTagId", index, attribute.Int("hashtag.id", hashTagId))
+	defer end(&err)
+	docs, _, err = c.searchUsers(ctx, index, hashtagsQuery(elastic.NewTermQuery("projects.hashtags.id", hashTagId)))
+	return docs, err
+}
+
+// searchUsers returns the documents matching query, every one when nil, along with their versions
+func (c *Elastic) searchUsers(ctx context.Context, index string, query elastic.Query) ([]model.User, []docVersion, error) {
+	searchService := c.c.Search().Index(index).SeqNoAndPrimaryTerm(true)
+	if query != nil {
+		searchService = searchService.Query(query)
+	}
 	searchResult, err := searchService.Do(ctx)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	var results []model.User
+	var (
+		results  []model.User
+		versions []docVersion
+	)
 	for _, hit := range searchResult.Hits.Hits {
 		var result model.User
 		err := json.Unmarshal(hit.Source, &result)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		results = append(results, result)
+		versions = append(versions, newDocVersion(hit.SeqNo, hit.PrimaryTerm))
 	}
-	return results, nil
+	return results, versions, nil
 }
 
 // Function to get a document
-func (c *Elastic) GetByUserId(ctx context.Context, index string, userId int) (*model.User, error) {
+func (c *Elastic) GetByUserId(ctx context.Context, index string, userId int) (doc *model.User, err error) {
+	ctx, end := c.startSpan(ctx, "GetByUserId", index, docID(userId))
+	defer end(&err)
+	doc, _, err = c.getUser(ctx, index, userId)
+	return doc, err
+}
+
+// getUser returns the document of userId along with its version, contract.ErrNotFound if missing
+func (c *Elastic) getUser(ctx context.Context, index string, userId int) (*model.User, docVersion, error) {
 	doc, err := c.c.Get().
 		Index(index).
 		Type("_doc").
 		Id(fmt.Sprintf("%d", userId)).
 		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, docVersion{}, contract.ErrNotFound
+	}
 	if err != nil {
-		return nil, err
+		return nil, docVersion{}, err
+	}
+	if !doc.Found {
+		return nil, docVersion{}, contract.ErrNotFound
+	}
+	var u model.User
+	err = json.Unmarshal(doc.Source, &u)
+	if err != nil {
+		return nil, docVersion{}, err
 	}
-	if doc.Found {
-		var u model.User
-		err = json.Unmarshal(doc.Source, &u)
+	return &u, newDocVersion(doc.SeqNo, doc.PrimaryTerm), nil
+}
+
+// removeProjectScript drops the project of params.id from the document
+const removeProjectScript = `if (ctx._source.projects != null) { ctx._source.projects.removeIf(p -> p.id == params.id) }`
+
+// removeHashtagScript drops the hashtag of params.id from every project of the document
+const removeHashtagScript = `if (ctx._source.projects != null) {
+  for (p in ctx._source.projects) { if (p.hashtags != null) { p.hashtags.removeIf(h -> h.id == params.id) } }
+}`
+
+// removeProjectHashtagScript drops the hashtag of params.id from the project of params.project
+const removeProjectHashtagScript = `if (ctx._source.projects != null) {
+  for (p in ctx._source.projects) { if (p.id == params.project && p.hashtags != null) { p.hashtags.removeIf(h -> h.id == params.id) } }
+}`
+
+func (c *Elastic) RemoveProject(ctx context.Context, index string, projectId int) (res model.UpdateResult, err error) {
+	ctx, end := c.startSpan(ctx, "RemoveProject", index, attribute.Int("project.id", projectId))
+	defer end(&err)
+	return c.updateByQuery(ctx, index, projectsQuery(elastic.NewTermQuery("projects.id", projectId)),
+		elastic.NewScript(removeProjectScript).Param("id", projectId))
+}
+
+func (c *Elastic) RemoveHashtag(ctx context.Context, index string, hashtagId int) (res model.UpdateResult, err error) {
+	ctx, end := c.startSpan(ctx, "RemoveHashtag", index, attribute.Int("hashtag.id", hashtagId))
+	defer end(&err)
+	return c.updateByQuery(ctx, index, hashtagsQuery(elastic.NewTermQuery("projects.hashtags.id", hashtagId)),
+		elastic.NewScript(removeHashtagScript).Param("id", hashtagId))
+}
+
+func (c *Elastic) RemoveProjectHashtag(ctx context.Context, index string, projectId, hashtagId int) (res model.UpdateResult, err error) {
+	ctx, end := c.startSpan(ctx, "RemoveProjectHashtag", index, attribute.Int("project.id", projectId), attribute.Int("hashtag.id", hashtagId))
+	defer end(&err)
+	query := projectsQuery(elastic.NewBoolQuery().Must(
+		elastic.NewTermQuery("projects.id", projectId),
+		elastic.NewNestedQuery("projects.hashtags", elastic.NewTermQuery("projects.hashtags.id", hashtagId)),
+	))
+	return c.updateByQuery(ctx, index, query,
+		elastic.NewScript(removeProjectHashtagScript).Param("project", projectId).Param("id", hashtagId))
+}
+
+// updateByQuery runs script over every document matching query, within elasticsearch. Documents changed
+// while updated are updated anew by running it again after backing off, as they still match query until updated
+func (c *Elastic) updateByQuery(ctx context.Context, index string, query elastic.Query, script *elastic.Script) (model.UpdateResult, error) {
+	var result model.UpdateResult
+	for attempt := 1; ; attempt++ {
+		res, err := c.runUpdateByQuery(ctx, index, query, script)
 		if err != nil {
-			return nil, err
+			return result, err
+		}
+		result.Updated += res.Updated
+		if len(res.Failures) > 0 {
+			result.Failed = int64(len(res.Failures)) + res.VersionConflicts
+			f := res.Failures[0]
+			return result, fmt.Errorf("%d of %d documents failed, first failure: id %s, status %d", result.Failed, res.Total, f.Id, f.Status)
+		}
+		if res.VersionConflicts == 0 {
+			return result, nil
+		}
+		metrics.VersionConflicts.Add(float64(res.VersionConflicts))
+		if attempt == maxConflictAttempts {
+			result.Failed = res.VersionConflicts
+			return result, fmt.Errorf("%d documents changed %d times while updated: %w", res.VersionConflicts, attempt, contract.ErrConflict)
+		}
+		// documents still being written to are left to settle, a little longer every attempt
+		timer := time.NewTimer(c.cfg.ConflictBackoff << (attempt - 1))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return result, ctx.Err()
+		case <-timer.C:
 		}
-		return &u, nil
 	}
-	return nil, fmt.Errorf("not found")
 }
 
-func (c *Elastic) RemoveProject(ctx context.Context, index string, projectId int) error {
-	documents, err := c.GetByProjectId(ctx, index, projectId)
+// runUpdateByQuery runs a single update by query, as a task polled until completed when configured so
+func (c *Elastic) runUpdateByQuery(ctx context.Context, index string, query elastic.Query, script *elastic.Script) (*elastic.BulkIndexByScrollResponse, error) {
+	service := c.c.UpdateByQuery(index).
+		Query(query).
+		Script(script).
+		ProceedOnVersionConflict()
+	if !c.cfg.UpdateByQueryAsync {
+		res, err := service.Do(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("update by query failed, err: %w", err)
+		}
+		return res, nil
+	}
+	task, err := service.DoAsync(ctx)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("update by query failed, err: %w", err)
 	}
-	for _, document := range documents {
-		remainigProjects := []model.Project{}
-		for _, project := range document.Projects {
-			if project.ID != projectId {
-				remainigProjects = append(remainigProjects, project)
-			}
+	return c.awaitTask(ctx, task.TaskId)
+}
+
+// awaitTask polls the task of id every TaskPollInterval until completed, returning its response
+func (c *Elastic) awaitTask(ctx context.Context, id string) (*elastic.BulkIndexByScrollResponse, error) {
+	ticker := time.NewTicker(c.cfg.TaskPollInterval)
+	defer ticker.Stop()
+	for {
+		res, err := c.task(ctx, id)
+		if err != nil || res != nil {
+			return res, err
 		}
-		document.Projects = remainigProjects
-		err = c.Update(ctx, index, document.ID, document)
-		if err != nil {
-			return err
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
 		}
 	}
-	return nil
 }
 
-func (c *Elastic) RemoveHashtag(ctx context.Context, index string, hashtagId int) error {
-	documents, err := c.GetByHashTagId(ctx, index, hashtagId)
+// task returns the response of the task of id, nil while running
+func (c *Elastic) task(ctx context.Context, id string) (*elastic.BulkIndexByScrollResponse, error) {
+	res, err := c.c.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "GET",
+		Path:   "/_tasks/" + url.PathEscape(id),
+	})
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("task %s lookup failed, err: %w", id, err)
 	}
-	for idx, document := range documents {
-		for idx2, project := range document.Projects {
-			remainigHashtags := []model.Hashtag{}
-			for _, hashtag := range project.Hashtags {
-				if hashtag.ID != hashtagId {
-					remainigHashtags = append(remainigHashtags, hashtag)
-				}
-			}
-			documents[idx].Projects[idx2].Hashtags = remainigHashtags
-			err = c.Update(ctx, index, document.ID, documents[idx])
-			if err != nil {
-				return err
-			}
-		}
+	var status struct {
+		Completed bool                               `json:"completed"`
+		Error     *elastic.ErrorDetails              `json:"error"`
+		Response  *elastic.BulkIndexByScrollResponse `json:"response"`
 	}
-	return nil
+	err = json.Unmarshal(res.Body, &status)
+	if err != nil {
+		return nil, fmt.Errorf("json.Unmarshal() failed, err: %w", err)
+	}
+	if !status.Completed {
+		return nil, nil
+	}
+	if status.Error != nil {
+		return nil, fmt.Errorf("task %s failed, %s: %s", id, status.Error.Type, status.Error.Reason)
+	}
+	if status.Response == nil {
+		return nil, fmt.Errorf("task %s completed without response", id)
+	}
+	return status.Response, nil
 }
 
 // Function to update a document
-func (c *Elastic) Update(ctx context.Context, index string, id int, user model.User) error {
+func (c *Elastic) Update(ctx context.Context, index string, id int, user model.User) (err error) {
+	ctx, end := c.startSpan(ctx, "Update", index, docID(id))
+	defer end(&err)
 	updateResult, err := c.c.Update().
 		Index(index).
 		Id(fmt.Sprintf("%d", id)).
@@ -168,8 +385,10 @@ func (c *Elastic) Update(ctx context.Context, index string, id int, user model.U
 }
 
 // Function to delete a document
-func (c *Elastic) Delete(ctx context.Context, index string, id int) error {
-	_, err := c.c.Delete().
+func (c *Elastic) Delete(ctx context.Context, index string, id int) (err error) {
+	ctx, end := c.startSpan(ctx, "Delete", index, docID(id))
+	defer end(&err)
+	_, err = c.c.Delete().
 		Index(index).
 		Type("_doc").
 		Id(fmt.Sprintf("%d", id)).
@@ -177,18 +396,131 @@ func (c *Elastic) Delete(ctx context.Context, index string, id int) error {
 	return err
 }
 
+// Function to index, or delete, documents in bulk. Versioned writes older than the
+// document indexed, or writes of documents written since they were read, are dropped silently
+func (c *Elastic) BulkWrite(ctx context.Context, index string, docs []model.Document) (err error) {
+	if len(docs) == 0 {
+		return nil
+	}
+	ctx, end := c.startSpan(ctx, "BulkWrite", index, tracing.Documents.Int(len(docs)))
+	defer end(&err)
+	bulk := c.c.Bulk().Index(index)
+	for _, doc := range docs {
+		if doc.Source == nil {
+			req := elastic.NewBulkDeleteRequest().Id(doc.ID)
+			switch {
+			case doc.Version > 0:
+				req.VersionType("external_gte").Version(doc.Version)
+			case doc.ReadAt != nil && doc.ReadAt.PrimaryTerm > 0:
+				req.IfSeqNo(doc.ReadAt.SeqNo).IfPrimaryTerm(doc.ReadAt.PrimaryTerm)
+			}
+			bulk.Add(req)
+			continue
+		}
+		req := elastic.NewBulkIndexRequest().Id(doc.ID).Doc(doc.Source)
+		switch {
+		case doc.Version > 0:
+			req.VersionType("external_gte").Version(doc.Version)
+		case doc.ReadAt != nil && doc.ReadAt.PrimaryTerm > 0:
+			req.IfSeqNo(doc.ReadAt.SeqNo).IfPrimaryTerm(doc.ReadAt.PrimaryTerm)
+		case doc.ReadAt != nil:
+			// read as missing, must still be
+			req.OpType("create")
+		}
+		bulk.Add(req)
+	}
+	res, err := bulk.Do(ctx)
+	if err != nil {
+		return err
+	}
+	var failed []*elastic.BulkResponseItem
+	for _, item := range res.Failed() {
+		// deleting a missing document, or writing a stale version, is not a failure
+		if (item.Status == 404 && item.Result == "not_found") || item.Status == 409 {
+			continue
+		}
+		metrics.ElasticErrors.WithLabelValues(strconv.Itoa(item.Status)).Inc()
+		failed = append(failed, item)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d documents failed, first failure: %s", len(failed), len(docs), bulkError(failed[0]))
+	}
+	return nil
+}
+
+func (c *Elastic) GetDocuments(ctx context.Context, index string, ids []string) (docs []model.Document, err error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	ctx, end := c.startSpan(ctx, "GetDocuments", index, tracing.Documents.Int(len(ids)))
+	defer end(&err)
+	mget := c.c.Mget()
+	for _, id := range ids {
+		mget.Add(elastic.NewMultiGetItem().Index(index).Id(id))
+	}
+	res, err := mget.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range res.Docs {
+		if doc.Error != nil {
+			return nil, fmt.Errorf("get of document %s failed, %s: %s", doc.Id, doc.Error.Type, doc.Error.Reason)
+		}
+		if doc.Found {
+			read := &model.ReadVersion{}
+			if doc.SeqNo != nil && doc.PrimaryTerm != nil {
+				read = &model.ReadVersion{SeqNo: *doc.SeqNo, PrimaryTerm: *doc.PrimaryTerm}
+			}
+			docs = append(docs, model.Document{ID: doc.Id, ReadAt: read, Source: doc.Source})
+		}
+	}
+	return docs, nil
+}
+
+func (c *Elastic) ScanIDs(ctx context.Context, index string, batchSize int, fn func(ids []string) error) (err error) {
+	ctx, end := c.startSpan(ctx, "ScanIDs", index)
+	defer end(&err)
+	scroll := c.c.Scroll(index).Size(batchSize).FetchSource(false)
+	defer scroll.Clear(context.Background())
+	for {
+		res, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		ids := make([]string, len(res.Hits.Hits))
+		for idx, hit := range res.Hits.Hits {
+			ids[idx] = hit.Id
+		}
+		err = fn(ids)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func bulkError(item *elastic.BulkResponseItem) string {
+	if item.Error == nil {
+		return fmt.Sprintf("id %s, status %d", item.Id, item.Status)
+	}
+	return fmt.Sprintf("id %s, status %d, %s: %s", item.Id, item.Status, item.Error.Type, item.Error.Reason)
+}
+
 func (c *Elastic) SearchByUser(ctx context.Context, index string, userID int) (*model.User, error) {
 	return c.GetByUserId(ctx, index, userID)
 }
 
-func (c *Elastic) SearchByHashtags(ctx context.Context, index string, hashtag string) ([]model.User, error) {
-	query := elastic.NewQueryStringQuery(fmt.Sprintf("_source.projects.hashtags.name=%s", hashtag))
+func (c *Elastic) SearchByHashtags(ctx context.Context, index string, hashtag string) (results []model.User, err error) {
+	ctx, end := c.startSpan(ctx, "SearchByHashtags", index)
+	defer end(&err)
+	query := hashtagsQuery(elastic.NewTermQuery("projects.hashtags.name.keyword", hashtag))
 	searchService := c.c.Search().Index(index).Query(query)
 	searchResult, err := searchService.Do(ctx)
 	if err != nil {
 		return nil, err
 	}
-	var results []model.User
 	for _, hit := range searchResult.Hits.Hits {
 		var result model.User
 		err := json.Unmarshal(hit.Source, &result)
@@ -200,19 +532,16 @@ func (c *Elastic) SearchByHashtags(ctx context.Context, index string, hashtag st
 	return results, nil
 }
 
-func (c *Elastic) FuzzySearchProjects(ctx context.Context, index string, query string) ([]model.FuzzyResult, error) {
-	qry := elastic.NewBoolQuery().
-		Should(
-			elastic.NewFuzzyQuery("projects.slug", query).
-				Fuzziness(5),
-			elastic.NewFuzzyQuery("projects.description", query).
-				Fuzziness(5))
-	searchService := c.c.Search().Query(qry)
+func (c *Elastic) FuzzySearchProjects(ctx context.Context, index string, query string) (results []model.FuzzyResult, err error) {
+	ctx, end := c.startSpan(ctx, "FuzzySearchProjects", index)
+	defer end(&err)
+	qry := projectsQuery(elastic.NewMultiMatchQuery(query, "projects.slug", "projects.description").
+		Fuzziness("AUTO"))
+	searchService := c.c.Search().Index(index).Query(qry)
 	searchResult, err := searchService.Do(ctx)
 	if err != nil {
 		return nil, err
 	}
-	var results []model.FuzzyResult
 	for _, hit := range searchResult.Hits.Hits {
 		var user model.User
 		err := json.Unmarshal(hit.Source, &user)
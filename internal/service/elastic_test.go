@@ -0,0 +1,131 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"pg-to-es/internal/config"
+	"pg-to-es/internal/contract"
+	"pg-to-es/internal/model"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestElastic_updateByQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		async bool
+		// responses of the update by query, in turn
+		responses []string
+		want      model.UpdateResult
+		wantErr   error
+	}{
+		{
+			name:      "sync",
+			responses: []string{`{"total":2,"updated":2}`},
+			want:      model.UpdateResult{Updated: 2},
+		},
+		{
+			name:      "async",
+			async:     true,
+			responses: []string{`{"total":3,"updated":3}`},
+			want:      model.UpdateResult{Updated: 3},
+		},
+		{
+			name:      "conflicts are updated anew",
+			responses: []string{`{"total":3,"updated":2,"version_conflicts":1}`, `{"total":1,"updated":1}`},
+			want:      model.UpdateResult{Updated: 3},
+		},
+		{
+			name:      "failures",
+			responses: []string{`{"total":3,"updated":2,"failures":[{"id":"7","status":400}]}`},
+			want:      model.UpdateResult{Updated: 2, Failed: 1},
+		},
+		{
+			name:      "conflicts until attempts run out",
+			responses: []string{`{"total":1,"version_conflicts":1}`},
+			want:      model.UpdateResult{Failed: 1},
+			wantErr:   contract.ErrConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var runs, polls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				switch {
+				case r.URL.Path == "/root/_update_by_query":
+					response := tt.responses[min(int(runs.Add(1)), len(tt.responses))-1]
+					if r.URL.Query().Get("wait_for_completion") == "false" {
+						response = `{"task":"node:1"}`
+					}
+					fmt.Fprint(w, response)
+				case r.URL.Path == "/_tasks/node:1":
+					if polls.Add(1) == 1 {
+						fmt.Fprint(w, `{"completed":false}`)
+						return
+					}
+					fmt.Fprintf(w, `{"completed":true,"response":%s}`, tt.responses[0])
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer server.Close()
+			es, err := NewElastic(config.Es{Host: server.URL, UpdateByQueryAsync: tt.async, TaskPollInterval: time.Millisecond, ConflictBackoff: time.Millisecond}, slog.Default())
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			got, err := es.RemoveProject(context.Background(), "root", 1)
+			assert.Equal(t, tt.want, got)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else if tt.want.Failed > 0 {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			if tt.async {
+				assert.Equal(t, int32(2), polls.Load(), "task must be polled until completed")
+			}
+		})
+	}
+}
+
+func TestElastic_BulkWrite(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		raw, _ := io.ReadAll(r.Body)
+		body = string(raw)
+		fmt.Fprint(w, `{"items":[{"index":{"_id":"1","status":409}},{"create":{"_id":"2","status":201}},{"delete":{"_id":"3","status":200}},{"index":{"_id":"4","status":200}}]}`)
+	}))
+	defer server.Close()
+	es, err := NewElastic(config.Es{Host: server.URL}, slog.Default())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	err = es.BulkWrite(context.Background(), "root", []model.Document{
+		{ID: "1", ReadAt: &model.ReadVersion{SeqNo: 5, PrimaryTerm: 1}, Source: []byte(`{"id":1}`)},
+		{ID: "2", ReadAt: &model.ReadVersion{}, Source: []byte(`{"id":2}`)},
+		{ID: "3", ReadAt: &model.ReadVersion{SeqNo: 7, PrimaryTerm: 2}},
+		{ID: "4", Version: 42, ReadAt: &model.ReadVersion{SeqNo: 1, PrimaryTerm: 1}, Source: []byte(`{"id":4}`)},
+	})
+	assert.NoError(t, err, "documents written since read must be left as is")
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	if !assert.Len(t, lines, 7) {
+		return
+	}
+	assert.Contains(t, lines[0], `"if_seq_no":5,"if_primary_term":1`, "documents read must be written only if unchanged since")
+	assert.Contains(t, lines[2], `"create"`, "documents read as missing must be written only if still missing")
+	assert.Contains(t, lines[4], `"if_seq_no":7,"if_primary_term":2`)
+	assert.Contains(t, lines[5], `"version":42,"version_type":"external_gte"`, "versioned documents must be ordered by version")
+}
@@ -0,0 +1,245 @@
+package service
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/olivere/elastic/v7"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// usersIndex is the definition of the index of users, nesting projects & their hashtags
+//
+//go:embed index.json
+var usersIndex []byte
+
+// IndexDefinition reads the settings & mappings of the index from path, the ones of users when empty
+func IndexDefinition(path string) ([]byte, error) {
+	if path == "" {
+		return usersIndex, nil
+	}
+	definition, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile() failed, err: %w", err)
+	}
+	return definition, nil
+}
+
+// EnsureIndex creates the first version of the index (<alias>_v1) as per definition, settings & mappings,
+// behind alias & writeAlias, unless alias exists. The mappings of the index behind alias must hold every
+// one of definition, fields mapped dynamically on top of them are fine. An index named alias, predating
+// versioned indices, gets writeAlias pointed to it until reindexed
+func (c *Elastic) EnsureIndex(ctx context.Context, alias, writeAlias string, definition []byte) (err error) {
+	ctx, end := c.startSpan(ctx, "EnsureIndex", alias)
+	defer end(&err)
+	var want struct {
+		Mappings map[string]interface{} `json:"mappings"`
+	}
+	err = json.Unmarshal(definition, &want)
+	if err != nil {
+		return fmt.Errorf("invalid index definition, err: %w", err)
+	}
+	indices, err := c.Resolve(ctx, alias)
+	if err != nil {
+		return err
+	}
+	if len(indices) == 0 {
+		index := alias + "_v1"
+		err = c.CreateIndex(ctx, index, definition)
+		// unless created meanwhile, by the other binary
+		if err != nil && !isAlreadyExists(err) {
+			return err
+		}
+		return c.SwapAliases(ctx, index, alias, writeAlias)
+	}
+	res, err := c.c.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "GET",
+		Path:   "/" + url.PathEscape(alias) + "/_mapping",
+	})
+	if err != nil {
+		return fmt.Errorf("mapping lookup failed, err: %w", err)
+	}
+	var mappings map[string]struct {
+		Mappings map[string]interface{} `json:"mappings"`
+	}
+	err = json.Unmarshal(res.Body, &mappings)
+	if err != nil {
+		return fmt.Errorf("json.Unmarshal() failed, err: %w", err)
+	}
+	// keyed by the index behind alias
+	for name, got := range mappings {
+		diffs := mappingDiff(want.Mappings, got.Mappings, "")
+		if len(diffs) > 0 {
+			return fmt.Errorf("mapping of index '%s' does not match, reindex it: %s", name, strings.Join(diffs, ", "))
+		}
+	}
+	writes, err := c.Resolve(ctx, writeAlias)
+	if err != nil || len(writes) > 0 {
+		return err
+	}
+	if len(indices) != 1 {
+		return fmt.Errorf("alias '%s' stands for %d indices, can not point '%s' to one of them", alias, len(indices), writeAlias)
+	}
+	_, err = c.c.Alias().Add(indices[0], writeAlias).Do(ctx)
+	if err != nil {
+		return fmt.Errorf("adding alias '%s' failed, err: %w", writeAlias, err)
+	}
+	return nil
+}
+
+func (c *Elastic) Resolve(ctx context.Context, name string) (indices []string, err error) {
+	ctx, end := c.startSpan(ctx, "Resolve", name)
+	defer end(&err)
+	res, err := c.c.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method:       "GET",
+		Path:         "/" + url.PathEscape(name) + "/_alias",
+		IgnoreErrors: []int{http.StatusNotFound},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("resolving '%s' failed, err: %w", name, err)
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	// keyed by the indices name stands for
+	var aliases map[string]json.RawMessage
+	err = json.Unmarshal(res.Body, &aliases)
+	if err != nil {
+		return nil, fmt.Errorf("json.Unmarshal() failed, err: %w", err)
+	}
+	indices = make([]string, 0, len(aliases))
+	for index := range aliases {
+		indices = append(indices, index)
+	}
+	sort.Strings(indices)
+	return indices, nil
+}
+
+func (c *Elastic) List(ctx context.Context, pattern string) (indices []string, err error) {
+	ctx, end := c.startSpan(ctx, "List", pattern)
+	defer end(&err)
+	res, err := c.c.CatIndices().Index(pattern).Columns("index").Do(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing '%s' failed, err: %w", pattern, err)
+	}
+	indices = make([]string, 0, len(res))
+	for _, row := range res {
+		indices = append(indices, row.Index)
+	}
+	sort.Strings(indices)
+	return indices, nil
+}
+
+func (c *Elastic) CreateIndex(ctx context.Context, index string, definition []byte) (err error) {
+	ctx, end := c.startSpan(ctx, "CreateIndex", index)
+	defer end(&err)
+	_, err = c.c.CreateIndex(index).BodyString(string(definition)).Do(ctx)
+	if err != nil {
+		return fmt.Errorf("creating index '%s' failed, err: %w", index, err)
+	}
+	return nil
+}
+
+// CopyIndex runs a reindex task, polled until completed. Versions are copied along with documents
+func (c *Elastic) CopyIndex(ctx context.Context, from, to string) (copied int64, err error) {
+	ctx, end := c.startSpan(ctx, "CopyIndex", to, attribute.String("es.source_index", from))
+	defer end(&err)
+	task, err := c.c.Reindex().
+		SourceIndex(from).
+		Destination(elastic.NewReindexDestination().Index(to).VersionType("external")).
+		ProceedOnVersionConflict().
+		DoAsync(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("reindex failed, err: %w", err)
+	}
+	res, err := c.awaitTask(ctx, task.TaskId)
+	if err != nil {
+		return 0, err
+	}
+	if len(res.Failures) > 0 {
+		f := res.Failures[0]
+		return res.Created, fmt.Errorf("%d of %d documents failed, first failure: id %s, status %d", len(res.Failures), res.Total, f.Id, f.Status)
+	}
+	return res.Created, nil
+}
+
+func (c *Elastic) SwapAliases(ctx context.Context, index string, aliases ...string) (err error) {
+	ctx, end := c.startSpan(ctx, "SwapAliases", index, attribute.StringSlice("es.aliases", aliases))
+	defer end(&err)
+	current := map[string][]string{}
+	deleted := map[string]bool{}
+	for _, alias := range aliases {
+		names, err := c.Resolve(ctx, alias)
+		if err != nil {
+			return err
+		}
+		current[alias] = names
+		for _, name := range names {
+			if name == alias {
+				deleted[name] = true
+			}
+		}
+	}
+	actions := c.c.Alias()
+	for name := range deleted {
+		actions.Action(elastic.NewAliasRemoveIndexAction(name))
+	}
+	for _, alias := range aliases {
+		for _, name := range current[alias] {
+			if name != index && !deleted[name] {
+				actions.Action(elastic.NewAliasRemoveAction(alias).Index(name))
+			}
+		}
+		actions.Action(elastic.NewAliasAddAction(alias).Index(index))
+	}
+	_, err = actions.Do(ctx)
+	if err != nil {
+		return fmt.Errorf("swapping aliases to '%s' failed, err: %w", index, err)
+	}
+	return nil
+}
+
+// isAlreadyExists reports whether err is elasticsearch refusing to create an index which exists
+func isAlreadyExists(err error) bool {
+	var e *elastic.Error
+	return errors.As(err, &e) && e.Details != nil && e.Details.Type == "resource_already_exists_exception"
+}
+
+// mappingDiff returns the paths at which got does not hold want
+func mappingDiff(want interface{}, got interface{}, path string) []string {
+	wantObj, ok := want.(map[string]interface{})
+	if !ok {
+		if !reflect.DeepEqual(want, got) {
+			return []string{fmt.Sprintf("%s is %v, want %v", path, got, want)}
+		}
+		return nil
+	}
+	gotObj, _ := got.(map[string]interface{})
+	keys := make([]string, 0, len(wantObj))
+	for key := range wantObj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var diffs []string
+	for _, key := range keys {
+		keyPath := key
+		if path != "" {
+			keyPath = path + "." + key
+		}
+		if _, ok := gotObj[key]; !ok {
+			diffs = append(diffs, keyPath+" is missing")
+			continue
+		}
+		diffs = append(diffs, mappingDiff(wantObj[key], gotObj[key], keyPath)...)
+	}
+	return diffs
+}
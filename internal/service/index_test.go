@@ -0,0 +1,199 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"pg-to-es/internal/config"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexDefinition(t *testing.T) {
+	definition, err := IndexDefinition("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	var field interface{}
+	assert.NoError(t, json.Unmarshal(definition, &field))
+	for _, key := range strings.Split("mappings.properties.projects.properties.hashtags.properties.name.fields.keyword", ".") {
+		obj, _ := field.(map[string]interface{})
+		field = obj[key]
+	}
+	assert.Equal(t, map[string]interface{}{"type": "keyword", "ignore_above": float64(256)}, field,
+		"hashtags must be searched by their exact name")
+}
+
+func TestMappingDiff(t *testing.T) {
+	want := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"id":       map[string]interface{}{"type": "integer"},
+			"projects": map[string]interface{}{"type": "nested"},
+		},
+	}
+	tests := []struct {
+		name string
+		got  string
+		want []string
+	}{
+		{
+			name: "same",
+			got:  `{"properties":{"id":{"type":"integer"},"projects":{"type":"nested"}}}`,
+		},
+		{
+			name: "dynamic fields on top",
+			got:  `{"properties":{"id":{"type":"integer"},"projects":{"type":"nested"},"extra":{"type":"text"}}}`,
+		},
+		{
+			name: "type guessed",
+			got:  `{"properties":{"id":{"type":"long"},"projects":{"properties":{"id":{"type":"long"}}}}}`,
+			want: []string{"properties.id.type is long, want integer", "properties.projects.type is missing"},
+		},
+		{
+			name: "no mappings",
+			got:  `{}`,
+			want: []string{"properties is missing"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got map[string]interface{}
+			assert.NoError(t, json.Unmarshal([]byte(tt.got), &got))
+			assert.Equal(t, tt.want, mappingDiff(want, got, ""))
+		})
+	}
+}
+
+func TestElastic_EnsureIndex(t *testing.T) {
+	var definition struct {
+		Mappings json.RawMessage `json:"mappings"`
+	}
+	assert.NoError(t, json.Unmarshal(usersIndex, &definition))
+	tests := []struct {
+		name string
+		// indices each name stands for
+		names    map[string]string
+		mappings string
+		created  string
+		actions  string
+		wantErr  string
+	}{
+		{
+			name:    "created when missing",
+			created: "root_v1",
+			actions: `{"actions":[{"add":{"alias":"root","index":"root_v1"}},{"add":{"alias":"root_write","index":"root_v1"}}]}`,
+		},
+		{
+			name:     "existing matching",
+			names:    map[string]string{"root": "root_v2", "root_write": "root_v2"},
+			mappings: string(definition.Mappings),
+		},
+		{
+			name:     "existing not versioned",
+			names:    map[string]string{"root": "root"},
+			mappings: string(definition.Mappings),
+			actions:  `{"actions":[{"add":{"alias":"root_write","index":"root"}}]}`,
+		},
+		{
+			name:     "existing mapped dynamically",
+			names:    map[string]string{"root": "root_v1", "root_write": "root_v1"},
+			mappings: `{"properties":{"projects":{"properties":{"id":{"type":"long"}}}}}`,
+			wantErr:  "properties.projects.type is missing",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			es, fake := newFakeIndices(t, tt.names, tt.mappings)
+
+			err := es.EnsureIndex(context.Background(), "root", "root_write", usersIndex)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.created, fake.created)
+			if tt.actions != "" {
+				assert.JSONEq(t, tt.actions, fake.actions)
+			} else {
+				assert.Empty(t, fake.actions)
+			}
+		})
+	}
+}
+
+func TestElastic_SwapAliases(t *testing.T) {
+	es, fake := newFakeIndices(t, map[string]string{"root": "root", "root_write": "root"}, "")
+
+	err := es.SwapAliases(context.Background(), "root_v1", "root", "root_write")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"actions":[
+		{"remove_index":{"index":"root"}},
+		{"add":{"alias":"root","index":"root_v1"}},
+		{"add":{"alias":"root_write","index":"root_v1"}}
+	]}`, fake.actions, "index named like the alias must be deleted as the alias is added")
+}
+
+func TestElastic_List(t *testing.T) {
+	es, fake := newFakeIndices(t, map[string]string{"a": "root_v2", "b": "root_v10"}, "")
+
+	got, err := es.List(context.Background(), "root_v*")
+	assert.NoError(t, err)
+	assert.Equal(t, "root_v*", fake.listed)
+	assert.Equal(t, []string{"root_v10", "root_v2"}, got, "indices must be sorted")
+}
+
+// fakeIndices records the indices created, the alias actions sent to it & the pattern listed
+type fakeIndices struct {
+	created string
+	actions string
+	listed  string
+}
+
+// newFakeIndices returns an Elastic served by a fake elasticsearch, whose names each stand for an index,
+// mapped as per mappings
+func newFakeIndices(t *testing.T, names map[string]string, mappings string) (*Elastic, *fakeIndices) {
+	fake := &fakeIndices{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		body, _ := io.ReadAll(r.Body)
+		name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		switch {
+		case action == "_alias" && names[name] == "":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"type":"index_not_found_exception"},"status":404}`)
+		case action == "_alias":
+			fmt.Fprintf(w, `{"%s":{"aliases":{}}}`, names[name])
+		case action == "_mapping":
+			fmt.Fprintf(w, `{"%s":{"mappings":%s}}`, names[name], mappings)
+		case name == "_cat":
+			// every name standing for an index, regardless of the pattern listed
+			fake.listed = strings.TrimPrefix(action, "indices/")
+			var rows []string
+			for _, index := range names {
+				rows = append(rows, fmt.Sprintf(`{"index":"%s"}`, index))
+			}
+			fmt.Fprintf(w, `[%s]`, strings.Join(rows, ","))
+		case name == "_aliases":
+			fake.actions = string(body)
+			fmt.Fprint(w, `{"acknowledged":true}`)
+		case r.Method == http.MethodPut:
+			fake.created = name
+			assert.JSONEq(t, string(usersIndex), string(body), "index must be created as per its definition")
+			fmt.Fprintf(w, `{"acknowledged":true,"index":"%s"}`, name)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	es, err := NewElastic(config.Es{Host: server.URL}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return es, fake
+}
@@ -0,0 +1,201 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"pg-to-es/internal/config"
+	"pg-to-es/internal/logging"
+	"pg-to-es/internal/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PgLeader elects a single leader among the pipelines sharing a name, through a session level advisory lock
+// held on a dedicated connection. Leadership ends along with the session, releasing the lock for a standby
+// to take over
+type PgLeader struct {
+	sessions lockSessions
+	name     string
+	interval time.Duration
+
+	// the dedicated session, held while campaigning & leading
+	conn   lockSession
+	leader atomic.Bool
+	// closed once leadership is lost
+	lost     chan struct{}
+	lostOnce sync.Once
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	logger   *slog.Logger
+}
+
+// NewPgLeader returns a candidate to the leadership of name, attempting at it & checking its session every interval
+func NewPgLeader(cfg config.Pg, name string, interval time.Duration, logger *slog.Logger) (*PgLeader, error) {
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return nil, err
+	}
+	// the connection holding the lock must outlive the pool's limits
+	db.SetMaxOpenConns(1)
+	db.SetConnMaxLifetime(0)
+	db.SetConnMaxIdleTime(0)
+	return newPgLeader(pgLockSessions{db: db}, name, interval, logger), nil
+}
+
+func newPgLeader(sessions lockSessions, name string, interval time.Duration, logger *slog.Logger) *PgLeader {
+	return &PgLeader{sessions: sessions, name: name, interval: interval, lost: make(chan struct{}), cancel: func() {},
+		logger: logger}
+}
+
+// lockSessions opens the sessions advisory locks are held by, closing it ends every session
+type lockSessions interface {
+	Open(ctx context.Context) (lockSession, error)
+	Close() error
+}
+
+// lockSession is a session advisory locks are held by
+type lockSession interface {
+	// TryLock attempts at the lock of name, without waiting
+	TryLock(ctx context.Context, name string) (bool, error)
+	// Ping checks the session is alive
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// pgLockSessions opens the sessions of a pool of a single connection
+type pgLockSessions struct {
+	db *sql.DB
+}
+
+func (s pgLockSessions) Open(ctx context.Context) (lockSession, error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return pgLockSession{conn: conn}, nil
+}
+
+func (s pgLockSessions) Close() error {
+	return s.db.Close()
+}
+
+type pgLockSession struct {
+	conn *sql.Conn
+}
+
+func (s pgLockSession) TryLock(ctx context.Context, name string) (bool, error) {
+	var acquired bool
+	err := s.conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock(hashtextextended($1, 0))", name).Scan(&acquired)
+	return acquired, err
+}
+
+func (s pgLockSession) Ping(ctx context.Context) error {
+	_, err := s.conn.ExecContext(ctx, "SELECT 1")
+	return err
+}
+
+func (s pgLockSession) Close() error {
+	return s.conn.Close()
+}
+
+// Campaign blocks until leading, or ctx is done. Once leading the session is checked every interval, Lost
+// reporting when it died
+func (l *PgLeader) Campaign(ctx context.Context) error {
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	standby := false
+	for {
+		acquired, err := l.tryLock(ctx)
+		if err != nil {
+			l.logger.Warn("leader.tryLock() failed, retrying", logging.Err(err))
+		}
+		if acquired {
+			break
+		}
+		if !standby && err == nil {
+			l.logger.Info("standing by, led by another pipeline", "name", l.name)
+			standby = true
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	l.logger.Info("leading", "name", l.name)
+	l.leader.Store(true)
+	metrics.Leader.Set(1)
+	ctx, l.cancel = context.WithCancel(ctx)
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		l.watch(ctx)
+	}()
+	return nil
+}
+
+// tryLock attempts at the lock once, on a fresh connection when the previous one failed
+func (l *PgLeader) tryLock(ctx context.Context) (bool, error) {
+	if l.conn == nil {
+		conn, err := l.sessions.Open(ctx)
+		if err != nil {
+			return false, fmt.Errorf("sessions.Open() failed, err: %w", err)
+		}
+		l.conn = conn
+	}
+	acquired, err := l.conn.TryLock(ctx, l.name)
+	if err != nil {
+		l.conn.Close()
+		l.conn = nil
+		return false, fmt.Errorf("pg_try_advisory_lock() failed, err: %w", err)
+	}
+	return acquired, nil
+}
+
+// watch checks the session holding the lock until it fails, or ctx is done
+func (l *PgLeader) watch(ctx context.Context) {
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		err := l.conn.Ping(ctx)
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		l.logger.Error("leadership lost", "name", l.name, logging.Err(err))
+		l.leader.Store(false)
+		metrics.Leader.Set(0)
+		l.lostOnce.Do(func() { close(l.lost) })
+		return
+	}
+}
+
+// IsLeader reports whether leading, as of the last check of the session
+func (l *PgLeader) IsLeader() bool {
+	return l.leader.Load()
+}
+
+// Lost is closed once leadership is lost, another pipeline may lead by then
+func (l *PgLeader) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Close resigns, releasing the lock for a standby to take over at once
+func (l *PgLeader) Close() error {
+	l.cancel()
+	l.wg.Wait()
+	l.leader.Store(false)
+	metrics.Leader.Set(0)
+	if l.conn != nil {
+		l.conn.Close()
+	}
+	// closing the pool ends the session, releasing the lock
+	return l.sessions.Close()
+}
@@ -0,0 +1,157 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeLocks holds the advisory locks of the sessions of every candidate, by name
+type fakeLocks struct {
+	mu      sync.Mutex
+	holders map[string]*fakeSession
+}
+
+func (l *fakeLocks) holder(name string) *fakeSession {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.holders[name]
+}
+
+// fakeSessions are the sessions of a candidate, ending along with it
+type fakeSessions struct {
+	locks    *fakeLocks
+	mu       sync.Mutex
+	sessions []*fakeSession
+	closed   bool
+}
+
+func (s *fakeSessions) Open(ctx context.Context) (lockSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session := &fakeSession{locks: s.locks}
+	s.sessions = append(s.sessions, session)
+	return session, nil
+}
+
+func (s *fakeSessions) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, session := range s.sessions {
+		session.end()
+	}
+	return nil
+}
+
+func (s *fakeSessions) last() *fakeSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[len(s.sessions)-1]
+}
+
+type fakeSession struct {
+	locks *fakeLocks
+	mu    sync.Mutex
+	ended bool
+}
+
+func (s *fakeSession) TryLock(ctx context.Context, name string) (bool, error) {
+	if err := s.Ping(ctx); err != nil {
+		return false, err
+	}
+	s.locks.mu.Lock()
+	defer s.locks.mu.Unlock()
+	if holder, ok := s.locks.holders[name]; ok && holder != s {
+		return false, nil
+	}
+	s.locks.holders[name] = s
+	return true, nil
+}
+
+func (s *fakeSession) Ping(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return errors.New("connection lost")
+	}
+	return nil
+}
+
+func (s *fakeSession) Close() error {
+	return nil
+}
+
+// end terminates the session, releasing its locks
+func (s *fakeSession) end() {
+	s.mu.Lock()
+	s.ended = true
+	s.mu.Unlock()
+	s.locks.mu.Lock()
+	defer s.locks.mu.Unlock()
+	for name, holder := range s.locks.holders {
+		if holder == s {
+			delete(s.locks.holders, name)
+		}
+	}
+}
+
+func newFakeLeader(locks *fakeLocks) (*PgLeader, *fakeSessions) {
+	sessions := &fakeSessions{locks: locks}
+	return newPgLeader(sessions, "pipeline", 10*time.Millisecond, slog.Default()), sessions
+}
+
+func TestPgLeader(t *testing.T) {
+	ctx := context.Background()
+	locks := &fakeLocks{holders: map[string]*fakeSession{}}
+	leader, sessions := newFakeLeader(locks)
+	standby, _ := newFakeLeader(locks)
+	defer standby.Close()
+
+	assert.NoError(t, leader.Campaign(ctx), "free lock must be gained")
+	assert.True(t, leader.IsLeader())
+	assert.Equal(t, sessions.last(), locks.holder("pipeline"), "lock must be held by the session of the leader")
+
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, standby.Campaign(waitCtx), context.DeadlineExceeded, "standby must wait while the lock is held")
+	assert.False(t, standby.IsLeader())
+
+	campaigned := make(chan error, 1)
+	go func() { campaigned <- standby.Campaign(ctx) }()
+	assert.NoError(t, leader.Close())
+	assert.True(t, sessions.closed, "sessions must be closed")
+	assert.False(t, leader.IsLeader())
+	select {
+	case err := <-campaigned:
+		assert.NoError(t, err, "standby must take over once the lock is released")
+		assert.True(t, standby.IsLeader())
+	case <-time.After(time.Second):
+		t.Fatal("standby must take over once the lock is released")
+	}
+}
+
+func TestPgLeader_lost(t *testing.T) {
+	ctx := context.Background()
+	leader, sessions := newFakeLeader(&fakeLocks{holders: map[string]*fakeSession{}})
+	defer leader.Close()
+	assert.NoError(t, leader.Campaign(ctx))
+
+	select {
+	case <-leader.Lost():
+		t.Fatal("leadership must not be lost while the session is alive")
+	case <-time.After(50 * time.Millisecond):
+	}
+	sessions.last().end()
+	select {
+	case <-leader.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("lost session must be detected")
+	}
+	assert.False(t, leader.IsLeader())
+}
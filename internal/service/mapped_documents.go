@@ -0,0 +1,141 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"pg-to-es/internal/config"
+	"pg-to-es/internal/mapping"
+	"pg-to-es/internal/model"
+
+	"github.com/lib/pq"
+)
+
+// versionColumn versions documents by the time of the transaction reading them, in microseconds,
+// so a document read earlier never replaces one read later
+const versionColumn = "(extract(epoch FROM transaction_timestamp()) * 1000000)::bigint"
+
+// MappedDocuments builds documents straight from postgres, as described by a mapping.Mapping
+type MappedDocuments struct {
+	db *sql.DB
+	m  *mapping.Mapping
+	// type of the root key, for ids to be compared to it
+	keyType string
+}
+
+// Initialize Mapped Documents
+func NewMappedDocuments(ctx context.Context, cfg config.Pg, m *mapping.Mapping) (*MappedDocuments, error) {
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var keyType string
+	err = db.QueryRowContext(ctx, `SELECT format_type(atttypid, atttypmod) FROM pg_attribute
+		WHERE attrelid = to_regclass($1) AND attname = $2 AND NOT attisdropped`, m.Root.Table, m.Root.Key).Scan(&keyType)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("key lookup of '%s.%s' failed, err: %w", m.Root.Table, m.Root.Key, err)
+	}
+	return &MappedDocuments{db, m, keyType}, nil
+}
+
+func (d *MappedDocuments) Close() error {
+	return d.db.Close()
+}
+
+// Snapshot walks every document, in batches of batchSize, as of a single consistent snapshot.
+// Returns the position of the snapshot, see PgDocuments.Snapshot
+func (d *MappedDocuments) Snapshot(ctx context.Context, batchSize int, fn func([]model.Document) error) (string, error) {
+	return snapshot(ctx, d.db, func(tx *sql.Tx) error {
+		query := d.query(fmt.Sprintf("$1::text IS NULL OR %s > $1::%s", d.m.Key(), d.keyType)) + " LIMIT $2"
+		var lastID *string
+		for {
+			docs, err := d.read(ctx, tx, query, lastID, batchSize)
+			if err != nil {
+				return err
+			}
+			if len(docs) == 0 {
+				return nil
+			}
+			err = fn(docs)
+			if err != nil {
+				return err
+			}
+			lastID = &docs[len(docs)-1].ID
+		}
+	})
+}
+
+func (d *MappedDocuments) Roots(ctx context.Context, table string, row map[string]interface{}) ([]string, error) {
+	query, args, err := d.m.RootsQuery(table, row)
+	if err != nil {
+		return nil, fmt.Errorf("table '%s', err: %w", table, err)
+	}
+	if query == "" {
+		return nil, nil
+	}
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("roots query failed, err: %w", err)
+	}
+	return scanIDs(rows)
+}
+
+// Build reads the documents of ids, the ones not found are returned without source, to be deleted
+func (d *MappedDocuments) Build(ctx context.Context, ids []string) ([]model.Document, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	query := fmt.Sprintf("SELECT ids.id, docs.doc, %s FROM unnest($2::text[]) ids(id) LEFT JOIN (%s) docs(id, doc) ON docs.id = ids.id",
+		versionColumn, d.m.DocumentQuery(fmt.Sprintf("%s = ANY($1::%s[])", d.m.Key(), d.keyType)))
+	return d.read(ctx, d.db, query, pq.Array(ids), pq.Array(ids))
+}
+
+// query selects the id, source & version of the documents matching where
+func (d *MappedDocuments) query(where string) string {
+	return fmt.Sprintf("SELECT id, doc, %s FROM (%s) docs(id, doc)", versionColumn, d.m.DocumentQuery(where))
+}
+
+func (d *MappedDocuments) read(ctx context.Context, q queryer, query string, args ...interface{}) ([]model.Document, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("documents query failed, err: %w", err)
+	}
+	defer rows.Close()
+	var docs []model.Document
+	for rows.Next() {
+		var (
+			doc    model.Document
+			source sql.NullString
+		)
+		err = rows.Scan(&doc.ID, &source, &doc.Version)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan() failed, err: %w", err)
+		}
+		if source.Valid {
+			doc.Source = []byte(source.String)
+		}
+		docs = append(docs, doc)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err(), err: %w", err)
+	}
+	return docs, nil
+}
+
+func scanIDs(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan() failed, err: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err(), err: %w", err)
+	}
+	return ids, nil
+}
@@ -0,0 +1,247 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"pg-to-es/internal/config"
+	"pg-to-es/internal/logging"
+	"pg-to-es/internal/model"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// positionHeader carries the position of a delta in its source
+const positionHeader = "Pg-Position"
+
+// NatsBus is an EventBus over a NATS JetStream stream, consumed through a durable consumer acknowledging
+// every message up to the one acknowledged. Positions are the sequences of the stream
+type NatsBus struct {
+	conn   *nats.Conn
+	js     jetstream.JetStream
+	stream jetstream.Stream
+	cfg    config.Bus
+	logger *slog.Logger
+
+	mu sync.Mutex
+	// messages consumed & not acknowledged yet, by sequence
+	pending map[uint64]jetstream.Msg
+	// the consumer consumed through, nil until Consume
+	consumer jetstream.Consumer
+}
+
+// NewNatsBus connects to cfg.URL & creates the stream, or updates it to match cfg
+func NewNatsBus(ctx context.Context, cfg config.Bus, logger *slog.Logger) (*NatsBus, error) {
+	conn, err := nats.Connect(cfg.URL, nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, fmt.Errorf("nats.Connect() failed, err: %w", err)
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("jetstream.New() failed, err: %w", err)
+	}
+	stream, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     cfg.Stream,
+		Subjects: []string{cfg.Subject},
+		Storage:  jetstream.FileStorage,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("js.CreateOrUpdateStream() failed, err: %w", err)
+	}
+	return &NatsBus{conn: conn, js: js, stream: stream, cfg: cfg, logger: logger, pending: map[uint64]jetstream.Msg{}}, nil
+}
+
+// Publish awaits the stream to store delta. Deltas published anew, after a restart, are dropped by the stream
+// within its duplicate window. Gaps carry the position of the delta ahead of them, thus are never dropped
+func (b *NatsBus) Publish(ctx context.Context, delta model.Delta) error {
+	msg := nats.NewMsg(b.cfg.Subject)
+	msg.Data = []byte(delta.Payload)
+	var opts []jetstream.PublishOpt
+	if delta.Position != "" {
+		msg.Header.Set(positionHeader, delta.Position)
+		if !strings.HasPrefix(delta.Payload, gapPrefix) {
+			opts = append(opts, jetstream.WithMsgID(delta.Position))
+		}
+	}
+	_, err := b.js.PublishMsg(ctx, msg, opts...)
+	if err != nil {
+		return fmt.Errorf("js.PublishMsg() failed, err: %w", err)
+	}
+	return nil
+}
+
+func (b *NatsBus) Position(ctx context.Context) (string, error) {
+	msg, err := b.stream.GetLastMsgForSubject(ctx, b.cfg.Subject)
+	if errors.Is(err, jetstream.ErrMsgNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("stream.GetLastMsgForSubject() failed, err: %w", err)
+	}
+	return msg.Header.Get(positionHeader), nil
+}
+
+// Acked returns the position of the last message the consumer acknowledged, as stored along with it
+func (b *NatsBus) Acked(ctx context.Context) (string, error) {
+	consumer, err := b.stream.Consumer(ctx, b.cfg.Consumer)
+	if errors.Is(err, jetstream.ErrConsumerNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("stream.Consumer() failed, err: %w", err)
+	}
+	seq := consumer.CachedInfo().AckFloor.Stream
+	if seq == 0 {
+		return "", nil
+	}
+	msg, err := b.stream.GetMsg(ctx, seq)
+	if err != nil {
+		return "", fmt.Errorf("stream.GetMsg() failed, err: %w", err)
+	}
+	return msg.Header.Get(positionHeader), nil
+}
+
+// Consume streams the messages of the consumer, a single process consuming at once. Messages delivered anew
+// as not acknowledged in time are dropped once consumed, for deltas to stay in order
+func (b *NatsBus) Consume(ctx context.Context, from string) (<-chan model.Delta, error) {
+	var after uint64
+	if from != "" {
+		var ok bool
+		after, ok = parseBusPosition(from)
+		if !ok {
+			return nil, fmt.Errorf("invalid bus position '%s'", from)
+		}
+	}
+	// the consumer is created anew past the last message acknowledged, as the ones delivered before a
+	// restart would only be delivered anew after AckWait
+	consumer, err := b.stream.Consumer(ctx, b.cfg.Consumer)
+	switch {
+	case err == nil:
+		after = max(after, consumer.CachedInfo().AckFloor.Stream)
+		err = b.stream.DeleteConsumer(ctx, b.cfg.Consumer)
+		if err != nil {
+			return nil, fmt.Errorf("stream.DeleteConsumer() failed, err: %w", err)
+		}
+	case !errors.Is(err, jetstream.ErrConsumerNotFound):
+		return nil, fmt.Errorf("stream.Consumer() failed, err: %w", err)
+	}
+	consumer, err = b.stream.CreateConsumer(ctx, jetstream.ConsumerConfig{
+		Durable:       b.cfg.Consumer,
+		AckPolicy:     jetstream.AckAllPolicy,
+		AckWait:       b.cfg.AckWait,
+		DeliverPolicy: jetstream.DeliverByStartSequencePolicy,
+		OptStartSeq:   after + 1,
+		FilterSubject: b.cfg.Subject,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("stream.CreateConsumer() failed, err: %w", err)
+	}
+	b.mu.Lock()
+	b.consumer = consumer
+	b.mu.Unlock()
+	messages, err := consumer.Messages()
+	if err != nil {
+		return nil, fmt.Errorf("consumer.Messages() failed, err: %w", err)
+	}
+	stream := make(chan model.Delta)
+	go func() {
+		defer close(stream)
+		defer messages.Stop()
+		stop := context.AfterFunc(ctx, messages.Stop)
+		defer stop()
+		for {
+			msg, err := messages.Next()
+			if errors.Is(err, jetstream.ErrMsgIteratorClosed) || ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				b.logger.Warn("messages.Next() failed", logging.Err(err))
+				continue
+			}
+			meta, err := msg.Metadata()
+			if err != nil {
+				b.logger.Warn("msg.Metadata() failed", logging.Err(err))
+				continue
+			}
+			seq := meta.Sequence.Stream
+			if seq <= after {
+				continue
+			}
+			after = seq
+			b.mu.Lock()
+			b.pending[seq] = msg
+			b.mu.Unlock()
+			select {
+			case stream <- model.Delta{Position: busPosition(seq), Payload: string(msg.Data())}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return stream, nil
+}
+
+// Ack acknowledges the message of position, along with every one before it, & removes the ones before it
+// from the stream
+func (b *NatsBus) Ack(ctx context.Context, position string) error {
+	seq, ok := parseBusPosition(position)
+	if !ok {
+		return fmt.Errorf("invalid bus position '%s'", position)
+	}
+	b.mu.Lock()
+	msg := b.pending[seq]
+	for pending := range b.pending {
+		if pending <= seq {
+			delete(b.pending, pending)
+		}
+	}
+	b.mu.Unlock()
+	if msg == nil {
+		return nil
+	}
+	err := msg.DoubleAck(ctx)
+	if err != nil {
+		return fmt.Errorf("msg.DoubleAck() failed, err: %w", err)
+	}
+	// the stream keeps messages until purged, the one acknowledged last is kept for Acked & Position
+	err = b.stream.Purge(ctx, jetstream.WithPurgeSequence(seq))
+	if err != nil {
+		return fmt.Errorf("stream.Purge() failed, err: %w", err)
+	}
+	return nil
+}
+
+// Depth returns the number of messages not acknowledged yet, 0 until consuming
+func (b *NatsBus) Depth() int {
+	b.mu.Lock()
+	consumer := b.consumer
+	b.mu.Unlock()
+	if consumer == nil {
+		return 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	info, err := consumer.Info(ctx)
+	if err != nil {
+		b.logger.Warn("consumer.Info() failed", logging.Err(err))
+		return 0
+	}
+	return int(info.NumPending) + info.NumAckPending
+}
+
+// Connected reports whether connected to the nats server
+func (b *NatsBus) Connected() bool {
+	return b.conn.IsConnected()
+}
+
+func (b *NatsBus) Close() error {
+	b.conn.Close()
+	return nil
+}
@@ -0,0 +1,275 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"pg-to-es/internal/config"
+	"pg-to-es/internal/logging"
+	"pg-to-es/internal/model"
+	"pg-to-es/internal/tracing"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OutboxListener streams events from the es_outbox table (see db.InstallOutbox).
+// Notifications carry the event id only & merely wake the listener up, events are
+// read from the table, so neither large rows nor events written while the pipeline
+// is down are lost. Events are marked processed once acknowledged.
+type OutboxListener struct {
+	cfg         config.Pg
+	store       outboxStore
+	lstnr       notifier
+	deltaStream chan model.Delta
+	quit        chan struct{}
+	closeOnce   sync.Once
+	// whether the last poll succeeded
+	connected atomic.Bool
+	logger    *slog.Logger
+
+	mu sync.Mutex
+	// hand over sequence of ids handed over but not yet acknowledged. Ids are assigned on
+	// insert rather than on commit, thus a lower id may be handed over after a higher one
+	inflight map[int64]uint64
+	seq      uint64
+}
+
+// Initialize Outbox Listener
+func NewOutboxListener(cfg config.Pg, logger *slog.Logger) (*OutboxListener, error) {
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return nil, err
+	}
+	listener := pq.NewListener(cfg.String(), cfg.ListenerMinReconnectInterval,
+		cfg.ListenerMaxReconnectInterval, func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				logger.Warn("outbox listener event", "event", event, logging.Err(err))
+			}
+		})
+	return newOutboxListener(cfg, pgOutboxStore{db: db}, listener, logger), nil
+}
+
+func newOutboxListener(cfg config.Pg, store outboxStore, lstnr notifier, logger *slog.Logger) *OutboxListener {
+	return &OutboxListener{
+		cfg:         cfg,
+		store:       store,
+		lstnr:       lstnr,
+		deltaStream: make(chan model.Delta),
+		quit:        make(chan struct{}),
+		inflight:    map[int64]uint64{},
+		logger:      logger,
+	}
+}
+
+// notifier wakes the listener up on the notifications of a channel, as pq.Listener does
+type notifier interface {
+	Listen(channel string) error
+	NotificationChannel() <-chan *pq.Notification
+	Close() error
+}
+
+// outboxEvent is an event read from es_outbox
+type outboxEvent struct {
+	id      int64
+	payload string
+}
+
+// outboxStore reads & marks the events of es_outbox
+type outboxStore interface {
+	// Unprocessed reads up to limit unprocessed events, by id
+	Unprocessed(ctx context.Context, limit int) ([]outboxEvent, error)
+	// MarkProcessed marks the events of ids processed
+	MarkProcessed(ctx context.Context, ids []int64) error
+	// Cleanup deletes the events processed longer than retention ago
+	Cleanup(ctx context.Context, retention time.Duration) error
+	Close() error
+}
+
+type pgOutboxStore struct {
+	db *sql.DB
+}
+
+func (s pgOutboxStore) Unprocessed(ctx context.Context, limit int) ([]outboxEvent, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, payload::text FROM es_outbox WHERE processed_at IS NULL ORDER BY id LIMIT $1", limit)
+	if err != nil {
+		return nil, fmt.Errorf("outbox query failed, err: %w", err)
+	}
+	defer rows.Close()
+	var events []outboxEvent
+	for rows.Next() {
+		var e outboxEvent
+		err = rows.Scan(&e.id, &e.payload)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan() failed, err: %w", err)
+		}
+		events = append(events, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err(), err: %w", err)
+	}
+	return events, nil
+}
+
+func (s pgOutboxStore) MarkProcessed(ctx context.Context, ids []int64) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE es_outbox SET processed_at = CURRENT_TIMESTAMP WHERE id = ANY($1)", pq.Array(ids))
+	return err
+}
+
+func (s pgOutboxStore) Cleanup(ctx context.Context, retention time.Duration) error {
+	_, err := s.db.ExecContext(ctx,
+		"DELETE FROM es_outbox WHERE processed_at < CURRENT_TIMESTAMP - $1 * INTERVAL '1 second'", retention.Seconds())
+	return err
+}
+
+func (s pgOutboxStore) Close() error {
+	return s.db.Close()
+}
+
+// Prepare starts listening for wake ups, events are retained by es_outbox regardless
+func (l *OutboxListener) Prepare(ctx context.Context) error {
+	err := l.lstnr.Listen(l.cfg.ListenerChannel)
+	if err == pq.ErrChannelAlreadyOpen {
+		return nil
+	}
+	return err
+}
+
+// Start streaming every unprocessed event, es_outbox tracks progress thus from is ignored
+func (l *OutboxListener) Start(ctx context.Context, from string) (<-chan model.Delta, error) {
+	err := l.Prepare(ctx)
+	if err != nil {
+		return nil, err
+	}
+	go l.listen(ctx)
+	return l.deltaStream, nil
+}
+
+// Ack marks the event at position & every event handed over before it processed
+func (l *OutboxListener) Ack(ctx context.Context, position string) error {
+	id, err := strconv.ParseInt(position, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid position '%s', err: %w", position, err)
+	}
+	l.mu.Lock()
+	var ids []int64
+	if seq, ok := l.inflight[id]; ok {
+		for inflight, s := range l.inflight {
+			if s <= seq {
+				ids = append(ids, inflight)
+			}
+		}
+	}
+	l.mu.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+	err = l.store.MarkProcessed(ctx, ids)
+	if err != nil {
+		return fmt.Errorf("marking events processed failed, err: %w", err)
+	}
+	l.mu.Lock()
+	for _, id := range ids {
+		delete(l.inflight, id)
+	}
+	l.mu.Unlock()
+	return nil
+}
+
+// Gaps is nil, events are read from es_outbox, notifications missed merely delay them until the next poll
+func (l *OutboxListener) Gaps() <-chan model.Gap {
+	return nil
+}
+
+// Stop listening
+func (l *OutboxListener) Stop() {
+	l.closeOnce.Do(func() {
+		close(l.quit)
+		l.lstnr.Close()
+		l.store.Close()
+	})
+}
+
+// Connected reports whether the last poll succeeded
+func (l *OutboxListener) Connected() bool {
+	return l.connected.Load()
+}
+
+func (l *OutboxListener) listen(ctx context.Context) {
+	defer close(l.deltaStream)
+	ticker := time.NewTicker(l.cfg.OutboxPollInterval)
+	defer ticker.Stop()
+	for {
+		n, err := l.poll(ctx)
+		l.connected.Store(err == nil)
+		if err != nil {
+			l.logger.Error("outbox poll failed", logging.Err(err))
+		}
+		if n > 0 {
+			// outbox may have more events queued, poll again right away
+			continue
+		}
+		select {
+		case <-l.lstnr.NotificationChannel():
+		case <-ticker.C:
+			err = l.cleanup(ctx)
+			if err != nil {
+				l.logger.Error("outbox cleanup failed", logging.Err(err))
+			}
+		case <-l.quit:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// poll reads a batch of unprocessed events & hands over the ones not yet handed over,
+// returns the number of deltas handed over
+func (l *OutboxListener) poll(ctx context.Context) (int, error) {
+	events, err := l.store.Unprocessed(ctx, l.cfg.OutboxBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("store.Unprocessed() failed, err: %w", err)
+	}
+
+	delivered := 0
+	for _, e := range events {
+		l.mu.Lock()
+		_, inflight := l.inflight[e.id]
+		if !inflight {
+			// tracked ahead of the hand over, the ack may arrive before the send returns
+			l.seq++
+			l.inflight[e.id] = l.seq
+		}
+		l.mu.Unlock()
+		if inflight {
+			continue
+		}
+		delta := model.Delta{Position: strconv.FormatInt(e.id, 10), Payload: e.payload}
+		// spans the receipt of the event up to its hand over
+		_, span := tracing.Start(ctx, "outbox.receive", trace.WithAttributes(tracing.Delta(delta)...))
+		select {
+		case l.deltaStream <- delta:
+			span.End()
+			delivered++
+		case <-l.quit:
+			span.End()
+			return delivered, nil
+		case <-ctx.Done():
+			span.End()
+			return delivered, nil
+		}
+	}
+	return delivered, nil
+}
+
+// cleanup deletes events processed longer than the retention ago
+func (l *OutboxListener) cleanup(ctx context.Context) error {
+	return l.store.Cleanup(ctx, l.cfg.OutboxRetention)
+}
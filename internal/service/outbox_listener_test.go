@@ -0,0 +1,183 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"pg-to-es/internal/config"
+	"pg-to-es/internal/model"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeOutbox holds the events of es_outbox, visible once committed
+type fakeOutbox struct {
+	mu        sync.Mutex
+	events    []outboxEvent
+	processed map[int64]bool
+	// ids of every call to MarkProcessed
+	marked [][]int64
+}
+
+func newFakeOutbox(events ...outboxEvent) *fakeOutbox {
+	return &fakeOutbox{events: events, processed: map[int64]bool{}}
+}
+
+// commit makes events visible
+func (o *fakeOutbox) commit(events ...outboxEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, events...)
+	sort.Slice(o.events, func(i, j int) bool { return o.events[i].id < o.events[j].id })
+}
+
+func (o *fakeOutbox) Unprocessed(ctx context.Context, limit int) ([]outboxEvent, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var events []outboxEvent
+	for _, e := range o.events {
+		if !o.processed[e.id] && len(events) < limit {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (o *fakeOutbox) MarkProcessed(ctx context.Context, ids []int64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	sorted := append([]int64{}, ids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	o.marked = append(o.marked, sorted)
+	for _, id := range ids {
+		o.processed[id] = true
+	}
+	return nil
+}
+
+func (o *fakeOutbox) Cleanup(ctx context.Context, retention time.Duration) error {
+	return nil
+}
+
+func (o *fakeOutbox) Close() error {
+	return nil
+}
+
+func (o *fakeOutbox) Marked() [][]int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([][]int64{}, o.marked...)
+}
+
+type fakeNotifier struct {
+	notifications chan *pq.Notification
+}
+
+func (n *fakeNotifier) Listen(channel string) error {
+	return nil
+}
+
+func (n *fakeNotifier) NotificationChannel() <-chan *pq.Notification {
+	return n.notifications
+}
+
+func (n *fakeNotifier) Close() error {
+	return nil
+}
+
+func newFakeOutboxListener(outbox *fakeOutbox) (*OutboxListener, *fakeNotifier) {
+	n := &fakeNotifier{notifications: make(chan *pq.Notification)}
+	cfg := config.Pg{OutboxPollInterval: 10 * time.Millisecond, OutboxBatchSize: 10}
+	return newOutboxListener(cfg, outbox, n, slog.Default()), n
+}
+
+// positions polls once, returning the positions of the deltas handed over
+func positions(t *testing.T, l *OutboxListener) []string {
+	l.deltaStream = make(chan model.Delta, 10)
+	_, err := l.poll(context.Background())
+	assert.NoError(t, err)
+	close(l.deltaStream)
+	var got []string
+	for delta := range l.deltaStream {
+		got = append(got, delta.Position)
+	}
+	return got
+}
+
+func TestOutboxListener_Ack(t *testing.T) {
+	ctx := context.Background()
+	// event 1 & 2 are committed after event 3, thus handed over after it
+	outbox := newFakeOutbox(outboxEvent{id: 3, payload: "3"})
+	l, _ := newFakeOutboxListener(outbox)
+	assert.Equal(t, []string{"3"}, positions(t, l))
+	outbox.commit(outboxEvent{id: 1, payload: "1"}, outboxEvent{id: 2, payload: "2"}, outboxEvent{id: 4, payload: "4"})
+	assert.Equal(t, []string{"1", "2", "4"}, positions(t, l))
+
+	assert.NoError(t, l.Ack(ctx, "5"), "unknown position must be ignored")
+	assert.NoError(t, l.Ack(ctx, "1"))
+	assert.NoError(t, l.Ack(ctx, "1"), "acknowledged position must be ignored")
+	assert.NoError(t, l.Ack(ctx, "4"))
+	assert.Equal(t, [][]int64{{1, 3}, {2, 4}}, outbox.Marked(), "events must be marked up to the one acknowledged, in hand over order")
+	assert.Error(t, l.Ack(ctx, "x"), "invalid position must fail")
+}
+
+func TestOutboxListener_poll(t *testing.T) {
+	ctx := context.Background()
+	outbox := newFakeOutbox(outboxEvent{id: 1, payload: "1"}, outboxEvent{id: 2, payload: "2"})
+	l, _ := newFakeOutboxListener(outbox)
+	assert.Equal(t, []string{"1", "2"}, positions(t, l))
+	assert.Empty(t, positions(t, l), "events in flight must not be handed over again")
+
+	outbox.commit(outboxEvent{id: 3, payload: "3"})
+	assert.NoError(t, l.Ack(ctx, "1"))
+	assert.Equal(t, []string{"3"}, positions(t, l), "events committed since must be handed over only")
+}
+
+func TestOutboxListener_notify(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	outbox := newFakeOutbox()
+	l, n := newFakeOutboxListener(outbox)
+	deltaStream, err := l.Start(ctx, "")
+	assert.NoError(t, err)
+	defer l.Stop()
+
+	// every event notified while the listener polls as well
+	go func() {
+		for id := int64(1); id <= 20; id++ {
+			outbox.commit(outboxEvent{id: id, payload: "event"})
+			select {
+			case n.notifications <- &pq.Notification{Extra: "event"}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var got []string
+	timeout := time.After(time.Second)
+	for len(got) < 20 {
+		select {
+		case delta := <-deltaStream:
+			got = append(got, delta.Position)
+			// acknowledged as the pipeline does, making room in the batch
+			assert.NoError(t, l.Ack(ctx, delta.Position))
+		case <-timeout:
+			t.Fatalf("events must be handed over, got %v", got)
+		}
+	}
+	select {
+	case delta := <-deltaStream:
+		t.Fatalf("event %s must be handed over once", delta.Position)
+	case <-time.After(50 * time.Millisecond):
+	}
+	want := make([]string, 20)
+	for idx := range want {
+		want[idx] = strconv.Itoa(idx + 1)
+	}
+	assert.Equal(t, want, got, "events must be handed over once, in order")
+}
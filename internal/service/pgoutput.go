@@ -0,0 +1,257 @@
+package service
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// pgoutput (protocol version 1) message types we care about
+const (
+	pgoutputBegin    = 'B'
+	pgoutputCommit   = 'C'
+	pgoutputRelation = 'R'
+	pgoutputInsert   = 'I'
+	pgoutputUpdate   = 'U'
+	pgoutputDelete   = 'D'
+)
+
+// postgres type oids which are emitted as json numbers, everything else is emitted as string
+var numericOids = map[uint32]bool{
+	20:   true, // int8
+	21:   true, // int2
+	23:   true, // int4
+	700:  true, // float4
+	701:  true, // float8
+	1700: true, // numeric
+}
+
+type relation struct {
+	id      uint32
+	name    string
+	columns []relationColumn
+}
+
+type relationColumn struct {
+	name    string
+	key     bool
+	typeOid uint32
+}
+
+// rowChange is a decoded insert, update or delete
+type rowChange struct {
+	operation string
+	table     string
+	// row holds the new tuple for INSERT/UPDATE and the old (key) tuple for DELETE
+	row map[string]interface{}
+}
+
+// pgoutputDecoder decodes the binary messages returned by pg_logical_slot_*_binary_changes
+type pgoutputDecoder struct {
+	relations map[uint32]relation
+	// xid of the transaction being decoded
+	xid uint32
+}
+
+func newPgoutputDecoder() *pgoutputDecoder {
+	return &pgoutputDecoder{relations: map[uint32]relation{}}
+}
+
+// Decode a single message, returns nil change for messages which do not carry row data
+func (d *pgoutputDecoder) Decode(msg []byte) (*rowChange, error) {
+	if len(msg) == 0 {
+		return nil, fmt.Errorf("empty message")
+	}
+	r := &reader{buf: msg[1:]}
+	switch msg[0] {
+	case pgoutputBegin:
+		r.take(16) // final lsn & commit timestamp
+		d.xid = r.uint32()
+		if r.err != nil {
+			return nil, fmt.Errorf("begin message malformed, err: %w", r.err)
+		}
+		return nil, nil
+	case pgoutputRelation:
+		rel := relation{id: r.uint32()}
+		r.string() // namespace
+		rel.name = r.string()
+		r.byte() // replica identity
+		n := int(r.uint16())
+		for i := 0; i < n; i++ {
+			flags := r.byte()
+			col := relationColumn{key: flags&1 == 1}
+			col.name = r.string()
+			col.typeOid = r.uint32()
+			r.uint32() // type modifier
+			rel.columns = append(rel.columns, col)
+		}
+		if r.err != nil {
+			return nil, fmt.Errorf("relation message malformed, err: %w", r.err)
+		}
+		d.relations[rel.id] = rel
+		return nil, nil
+	case pgoutputInsert:
+		rel, err := d.relation(r.uint32())
+		if err != nil {
+			return nil, err
+		}
+		if kind := r.byte(); kind != 'N' {
+			return nil, fmt.Errorf("insert message malformed, unexpected tuple kind '%c'", kind)
+		}
+		row, err := r.tuple(rel)
+		if err != nil {
+			return nil, err
+		}
+		return &rowChange{operation: "INSERT", table: rel.name, row: row}, nil
+	case pgoutputUpdate:
+		rel, err := d.relation(r.uint32())
+		if err != nil {
+			return nil, err
+		}
+		kind := r.byte()
+		if kind == 'K' || kind == 'O' {
+			// skip the old tuple, only the new one is of interest
+			if _, err = r.tuple(rel); err != nil {
+				return nil, err
+			}
+			kind = r.byte()
+		}
+		if kind != 'N' {
+			return nil, fmt.Errorf("update message malformed, unexpected tuple kind '%c'", kind)
+		}
+		row, err := r.tuple(rel)
+		if err != nil {
+			return nil, err
+		}
+		return &rowChange{operation: "UPDATE", table: rel.name, row: row}, nil
+	case pgoutputDelete:
+		rel, err := d.relation(r.uint32())
+		if err != nil {
+			return nil, err
+		}
+		if kind := r.byte(); kind != 'K' && kind != 'O' {
+			return nil, fmt.Errorf("delete message malformed, unexpected tuple kind '%c'", kind)
+		}
+		row, err := r.tuple(rel)
+		if err != nil {
+			return nil, err
+		}
+		return &rowChange{operation: "DELETE", table: rel.name, row: row}, nil
+	default:
+		// commit, origin, type & truncate carry nothing the pipeline needs
+		return nil, nil
+	}
+}
+
+func (d *pgoutputDecoder) relation(id uint32) (relation, error) {
+	rel, ok := d.relations[id]
+	if !ok {
+		return rel, fmt.Errorf("unknown relation %d", id)
+	}
+	return rel, nil
+}
+
+type reader struct {
+	buf []byte
+	err error
+}
+
+func (r *reader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < n {
+		r.err = fmt.Errorf("unexpected end of message")
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *reader) byte() byte {
+	b := r.take(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *reader) uint16() uint16 {
+	b := r.take(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *reader) uint32() uint32 {
+	b := r.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *reader) string() string {
+	if r.err != nil {
+		return ""
+	}
+	for i, c := range r.buf {
+		if c == 0 {
+			s := string(r.buf[:i])
+			r.buf = r.buf[i+1:]
+			return s
+		}
+	}
+	r.err = fmt.Errorf("unterminated string")
+	return ""
+}
+
+func (r *reader) tuple(rel relation) (map[string]interface{}, error) {
+	n := int(r.uint16())
+	if r.err == nil && n > len(rel.columns) {
+		return nil, fmt.Errorf("tuple of '%s' has %d columns, relation has %d", rel.name, n, len(rel.columns))
+	}
+	row := make(map[string]interface{}, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		col := rel.columns[i]
+		switch kind := r.byte(); kind {
+		case 'n':
+			row[col.name] = nil
+		case 'u':
+			// unchanged toasted value, not sent by postgres
+		case 't':
+			value := string(r.take(int(r.uint32())))
+			if numericOids[col.typeOid] {
+				if _, err := strconv.ParseFloat(value, 64); err == nil {
+					row[col.name] = json.Number(value)
+					continue
+				}
+			}
+			row[col.name] = value
+		default:
+			r.err = fmt.Errorf("unexpected column kind '%c'", kind)
+		}
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("tuple of '%s' malformed, err: %w", rel.name, r.err)
+	}
+	return row, nil
+}
+
+// parseLSN parses textual pg_lsn representation, e.g. 16/B374D848
+func parseLSN(s string) (uint64, error) {
+	var hi, lo uint32
+	_, err := fmt.Sscanf(s, "%X/%X", &hi, &lo)
+	if err != nil {
+		return 0, fmt.Errorf("invalid lsn '%s', err: %w", s, err)
+	}
+	return uint64(hi)<<32 | uint64(lo), nil
+}
+
+// formatLSN formats lsn as textual pg_lsn
+func formatLSN(lsn uint64) string {
+	return fmt.Sprintf("%X/%X", uint32(lsn>>32), uint32(lsn))
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type msgBuilder []byte
+
+func (b msgBuilder) byte(c byte) msgBuilder { return append(b, c) }
+func (b msgBuilder) string(s string) msgBuilder {
+	return append(append(b, s...), 0)
+}
+func (b msgBuilder) uint16(v uint16) msgBuilder { return binary.BigEndian.AppendUint16(b, v) }
+func (b msgBuilder) uint32(v uint32) msgBuilder { return binary.BigEndian.AppendUint32(b, v) }
+func (b msgBuilder) text(s string) msgBuilder {
+	return b.byte('t').uint32(uint32(len(s))).append(s)
+}
+func (b msgBuilder) append(s string) msgBuilder { return append(b, s...) }
+
+func usersRelation() []byte {
+	return msgBuilder{}.byte('R').uint32(16384).string("public").string("users").byte('d').uint16(3).
+		byte(1).string("id").uint32(23).uint32(0).
+		byte(0).string("name").uint32(1043).uint32(0).
+		byte(0).string("created_at").uint32(1114).uint32(0)
+}
+
+func TestPgoutputDecoder_Decode(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     []byte
+		want    *rowChange
+		wantErr bool
+	}{
+		{
+			name: "insert should decode new tuple with numeric columns as numbers",
+			msg: msgBuilder{}.byte('I').uint32(16384).byte('N').uint16(3).
+				text("1").text("User 1").byte('n'),
+			want: &rowChange{
+				operation: "INSERT",
+				table:     "users",
+				row: map[string]interface{}{
+					"id":         json.Number("1"),
+					"name":       "User 1",
+					"created_at": nil,
+				},
+			},
+		},
+		{
+			name: "update should skip old tuple",
+			msg: msgBuilder{}.byte('U').uint32(16384).byte('K').uint16(1).text("1").
+				byte('N').uint16(3).text("1").text("User 2").text("2023-01-01 00:00:00"),
+			want: &rowChange{
+				operation: "UPDATE",
+				table:     "users",
+				row: map[string]interface{}{
+					"id":         json.Number("1"),
+					"name":       "User 2",
+					"created_at": "2023-01-01 00:00:00",
+				},
+			},
+		},
+		{
+			name: "delete should decode key tuple",
+			msg:  msgBuilder{}.byte('D').uint32(16384).byte('K').uint16(1).text("7"),
+			want: &rowChange{
+				operation: "DELETE",
+				table:     "users",
+				row: map[string]interface{}{
+					"id": json.Number("7"),
+				},
+			},
+		},
+		{
+			name: "commit should carry no change",
+			msg:  msgBuilder{}.byte('C').byte(0),
+			want: nil,
+		},
+		{
+			name:    "unknown relation should return error",
+			msg:     msgBuilder{}.byte('I').uint32(1).byte('N').uint16(1).text("1"),
+			wantErr: true,
+		},
+		{
+			name:    "truncated tuple should return error",
+			msg:     msgBuilder{}.byte('I').uint32(16384).byte('N').uint16(3).text("1"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newPgoutputDecoder()
+			_, err := d.Decode(usersRelation())
+			assert.NoError(t, err, "relation must decode")
+			got, err := d.Decode(tt.msg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Decode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			assert.Equal(t, tt.want, got, "change must match")
+		})
+	}
+}
+
+func TestParseLSN(t *testing.T) {
+	lsn, err := parseLSN("16/B374D848")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0x16B374D848), lsn)
+	assert.Equal(t, "16/B374D848", formatLSN(lsn))
+
+	_, err = parseLSN("not-an-lsn")
+	assert.Error(t, err)
+}
@@ -0,0 +1,20 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+	"pg-to-es/internal/config"
+)
+
+// openPostgres opens a connection pool configured as per cfg
+func openPostgres(cfg config.Pg) (*sql.DB, error) {
+	db, err := sql.Open("postgres", cfg.String())
+	if err != nil {
+		return nil, fmt.Errorf("sql.Open() failed, err: %w", err)
+	}
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetConnMaxIdleTime(cfg.MaxIdleTimeForConns)
+	db.SetConnMaxLifetime(cfg.MaxLifetimeForConns)
+	return db, nil
+}
@@ -0,0 +1,373 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"pg-to-es/internal/logging"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// segmentExt names the segment files of a DiskQueue, after the sequence of their first record
+const segmentExt = ".seg"
+
+// frameHeader is the length & crc32 of the record following it
+const frameHeader = 8
+
+// queueRecord is a delta as appended to a DiskQueue
+type queueRecord struct {
+	Seq      uint64 `json:"seq"`
+	Position string `json:"position,omitempty"`
+	Payload  string `json:"payload"`
+}
+
+// DiskQueue is an append-only queue of deltas on disk, split in segment files of about segmentBytes.
+// Appends are synced to disk before returning. Segments whose every record was acknowledged are
+// deleted, but for the last one, which keeps the position of the last delta appended
+type DiskQueue struct {
+	dir          string
+	segmentBytes int64
+	// persists the sequence of the last record acknowledged
+	acks *FileCheckpoint
+
+	mu sync.Mutex
+	// sequence of the first record of each segment, in order
+	segments []uint64
+	active   *os.File
+	size     int64
+	next     uint64
+	acked    uint64
+	position string
+	// closed & replaced on every append, waking readers up
+	appended chan struct{}
+	logger   *slog.Logger
+}
+
+// OpenDiskQueue opens the queue held by dir, creating it if missing. A record torn by a crash
+// while appended is dropped
+func OpenDiskQueue(dir string, segmentBytes int64, logger *slog.Logger) (*DiskQueue, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("os.MkdirAll() failed, err: %w", err)
+	}
+	q := &DiskQueue{
+		dir:          dir,
+		segmentBytes: segmentBytes,
+		acks:         NewFileCheckpoint(filepath.Join(dir, "acked")),
+		appended:     make(chan struct{}),
+		logger:       logger,
+	}
+	acked, err := q.acks.Load(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("acks.Load() failed, err: %w", err)
+	}
+	if acked != "" {
+		q.acked, err = strconv.ParseUint(acked, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid acknowledged sequence '%s', err: %w", acked, err)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadDir() failed, err: %w", err)
+	}
+	for _, entry := range entries {
+		first, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), segmentExt), 10, 64)
+		if err == nil && strings.HasSuffix(entry.Name(), segmentExt) {
+			q.segments = append(q.segments, first)
+		}
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+	q.next = q.acked + 1
+	if len(q.segments) == 0 {
+		return q, nil
+	}
+
+	// the last segment is scanned for the last record appended, & truncated past it
+	last := q.segments[len(q.segments)-1]
+	q.next = max(q.next, last)
+	f, err := os.OpenFile(q.segmentPath(last), os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("os.OpenFile() failed, err: %w", err)
+	}
+	end, err := scanSegment(f, 0, func(rec queueRecord) {
+		q.next = rec.Seq + 1
+		q.position = rec.Position
+	})
+	if err == nil {
+		err = f.Truncate(end)
+	}
+	if err == nil {
+		_, err = f.Seek(end, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("segment %d recovery failed, err: %w", last, err)
+	}
+	q.active, q.size = f, end
+	return q, nil
+}
+
+// Append durably appends delta, returning its sequence
+func (q *DiskQueue) Append(position, payload string) (uint64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.active == nil || q.size >= q.segmentBytes {
+		err := q.roll()
+		if err != nil {
+			return 0, err
+		}
+	}
+	rec := queueRecord{Seq: q.next, Position: position, Payload: payload}
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	frame := make([]byte, frameHeader+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(body)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(body))
+	copy(frame[frameHeader:], body)
+	_, err = q.active.Write(frame)
+	if err == nil {
+		err = q.active.Sync()
+	}
+	if err != nil {
+		// drops what may have been written of the record
+		q.active.Truncate(q.size)
+		q.active.Seek(q.size, io.SeekStart)
+		return 0, fmt.Errorf("appending to segment failed, err: %w", err)
+	}
+	q.size += int64(len(frame))
+	q.next++
+	q.position = position
+	close(q.appended)
+	q.appended = make(chan struct{})
+	return rec.Seq, nil
+}
+
+// roll starts a new segment, from the next record on
+func (q *DiskQueue) roll() error {
+	f, err := os.OpenFile(q.segmentPath(q.next), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile() failed, err: %w", err)
+	}
+	err = syncDir(q.dir)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if q.active != nil {
+		q.active.Close()
+	}
+	q.active, q.size = f, 0
+	q.segments = append(q.segments, q.next)
+	return nil
+}
+
+// Ack acknowledges every record up to & including seq, deleting the segments no longer needed
+func (q *DiskQueue) Ack(seq uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if seq <= q.acked {
+		return nil
+	}
+	err := q.acks.Save(context.Background(), strconv.FormatUint(seq, 10))
+	if err != nil {
+		return fmt.Errorf("acks.Save() failed, err: %w", err)
+	}
+	q.acked = seq
+	return q.compact()
+}
+
+// compact deletes every segment but the last whose records were all acknowledged
+func (q *DiskQueue) compact() error {
+	for len(q.segments) > 1 && q.segments[1]-1 <= q.acked {
+		err := os.Remove(q.segmentPath(q.segments[0]))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("os.Remove() failed, err: %w", err)
+		}
+		q.segments = q.segments[1:]
+	}
+	return nil
+}
+
+// Reset drops every record, acknowledging them, and resumes from position
+func (q *DiskQueue) Reset(position string) error {
+	q.mu.Lock()
+	seq := q.next
+	q.mu.Unlock()
+	_, err := q.Append(position, "")
+	if err != nil {
+		return err
+	}
+	return q.Ack(seq)
+}
+
+// Acked returns the sequence of the last record acknowledged
+func (q *DiskQueue) Acked() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.acked
+}
+
+// Position returns the position of the last delta appended
+func (q *DiskQueue) Position() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.position
+}
+
+// Len returns the number of records not acknowledged yet
+func (q *DiskQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.next-1 <= q.acked {
+		return 0
+	}
+	return int(q.next - 1 - q.acked)
+}
+
+// Read streams every record appended after seq, in order, including the ones appended later, until
+// ctx is done. The stream is closed once done, or on failure
+func (q *DiskQueue) Read(ctx context.Context, after uint64) <-chan queueRecord {
+	stream := make(chan queueRecord)
+	go func() {
+		defer close(stream)
+		// the segment read & the offset of the next record in it
+		var (
+			f      *os.File
+			first  uint64
+			offset int64
+		)
+		defer func() {
+			if f != nil {
+				f.Close()
+			}
+		}()
+		for {
+			q.mu.Lock()
+			appended := q.appended
+			segments := q.segments
+			q.mu.Unlock()
+			if f == nil && len(segments) > 0 {
+				// the last segment starting at or before the next record, the first one otherwise
+				idx := sort.Search(len(segments), func(i int) bool { return segments[i] > after+1 }) - 1
+				first = segments[max(idx, 0)]
+				var err error
+				f, err = os.Open(q.segmentPath(first))
+				if err != nil {
+					q.logger.Error("opening segment failed", "segment", first, logging.Err(err))
+					return
+				}
+				offset = 0
+			}
+			var records []queueRecord
+			if f != nil {
+				var err error
+				offset, err = scanSegment(f, offset, func(rec queueRecord) {
+					if rec.Seq > after {
+						records = append(records, rec)
+					}
+				})
+				if err != nil {
+					q.logger.Error("reading segment failed", "segment", first, logging.Err(err))
+					return
+				}
+			}
+			for _, rec := range records {
+				select {
+				case stream <- rec:
+					after = rec.Seq
+				case <-ctx.Done():
+					return
+				}
+			}
+			if len(records) > 0 {
+				continue
+			}
+			// moves on to the next segment once every record of this one is read
+			idx := sort.Search(len(segments), func(i int) bool { return segments[i] > first })
+			if f != nil && idx < len(segments) {
+				f.Close()
+				f = nil
+				after = max(after, segments[idx]-1)
+				continue
+			}
+			select {
+			case <-appended:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return stream
+}
+
+func (q *DiskQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.active == nil {
+		return nil
+	}
+	err := q.active.Close()
+	q.active = nil
+	return err
+}
+
+func (q *DiskQueue) segmentPath(first uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", first, segmentExt))
+}
+
+// scanSegment reads the records of f from offset on, returning the offset past the last complete one.
+// A record torn or corrupted ends the scan
+func scanSegment(f *os.File, offset int64, fn func(rec queueRecord)) (int64, error) {
+	_, err := f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return offset, err
+	}
+	r := bufio.NewReader(f)
+	header := make([]byte, frameHeader)
+	for {
+		_, err = io.ReadFull(r, header)
+		if err != nil {
+			return offset, nil
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header))
+		_, err = io.ReadFull(r, body)
+		if err != nil || crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+			return offset, nil
+		}
+		var rec queueRecord
+		err = json.Unmarshal(body, &rec)
+		if err != nil {
+			return offset, nil
+		}
+		fn(rec)
+		offset += int64(len(header) + len(body))
+	}
+}
+
+// syncDir syncs dir, for the files created in it to survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("os.Open() failed, err: %w", err)
+	}
+	defer d.Close()
+	err = d.Sync()
+	if err != nil {
+		return fmt.Errorf("dir.Sync() failed, err: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"pg-to-es/internal/mock"
+	"pg-to-es/internal/model"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskQueue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+	q, err := OpenDiskQueue(dir, 64, slog.Default())
+	if !assert.NoError(t, err) {
+		return
+	}
+	for i := 1; i <= 5; i++ {
+		seq, err := q.Append(fmt.Sprintf("0/%d", i), fmt.Sprintf(`{"n":%d}`, i))
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(i), seq)
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	assert.Greater(t, len(segments), 2, "segments must roll once full")
+
+	records := q.Read(ctx, 2)
+	for want := uint64(3); want <= 5; want++ {
+		assert.Equal(t, want, (<-records).Seq, "records must be read in order, after the one given")
+	}
+	_, err = q.Append("0/6", `{"n":6}`)
+	assert.NoError(t, err)
+	select {
+	case rec := <-records:
+		assert.Equal(t, queueRecord{Seq: 6, Position: "0/6", Payload: `{"n":6}`}, rec, "records appended later must be read")
+	case <-time.After(time.Second):
+		t.Fatal("record appended later not read")
+	}
+
+	assert.NoError(t, q.Ack(5))
+	assert.Equal(t, 1, q.Len())
+	left, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	assert.Less(t, len(left), len(segments), "acknowledged segments must be deleted")
+	assert.NoError(t, q.Close())
+
+	// a record torn by a crash is dropped
+	last := left[len(left)-1]
+	f, err := os.OpenFile(last, os.O_APPEND|os.O_WRONLY, 0o644)
+	if assert.NoError(t, err) {
+		f.Write([]byte{0, 0, 0, 42, 1, 2})
+		f.Close()
+	}
+	q, err = OpenDiskQueue(dir, 64, slog.Default())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer q.Close()
+	assert.Equal(t, uint64(5), q.Acked(), "acknowledgements must survive restarts")
+	assert.Equal(t, "0/6", q.Position())
+	seq, err := q.Append("0/7", `{"n":7}`)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(7), seq, "sequence must resume after the last record")
+	records = q.Read(ctx, q.Acked())
+	assert.Equal(t, uint64(6), (<-records).Seq, "records not acknowledged must be read anew")
+	assert.Equal(t, uint64(7), (<-records).Seq)
+}
+
+func TestQueuedListener(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	q, err := OpenDiskQueue(dir, 1<<20, slog.Default())
+	if !assert.NoError(t, err) {
+		return
+	}
+	listener := mock.NewDbListener()
+	l := NewQueuedListener(listener, q, slog.Default())
+	stream, err := l.Start(ctx, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	listener.Push(model.Delta{Position: "0/1", Payload: "a"})
+	listener.Push(model.Delta{Position: "0/2", Payload: "b"})
+	assert.Equal(t, model.Delta{Position: "queue:1", Payload: "a"}, <-stream)
+	assert.Equal(t, model.Delta{Position: "queue:2", Payload: "b"}, <-stream)
+	assert.Eventually(t, func() bool { return len(listener.Acked()) == 2 }, time.Second, time.Millisecond,
+		"deltas must be acknowledged to the listener once queued")
+	assert.NoError(t, l.Ack(ctx, "queue:1"))
+	l.Stop()
+	q.Close()
+
+	// restarted, the delta not acknowledged is streamed anew & the listener resumes after the last queued
+	q, err = OpenDiskQueue(dir, 1<<20, slog.Default())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer q.Close()
+	listener = mock.NewDbListener()
+	l = NewQueuedListener(listener, q, slog.Default())
+	stream, err = l.Start(ctx, "queue:1")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Stop()
+	assert.Equal(t, "0/2", listener.From())
+	assert.Equal(t, model.Delta{Position: "queue:2", Payload: "b"}, <-stream)
+	assert.Equal(t, 1, l.Depth())
+
+	// a position of the listener, as handed off by a backfill, drops what is queued
+	l.Stop()
+	listener = mock.NewDbListener()
+	l = NewQueuedListener(listener, q, slog.Default())
+	stream, err = l.Start(ctx, "0/9")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "0/9", listener.From())
+	assert.Equal(t, 0, l.Depth())
+	listener.Push(model.Delta{Position: "0/10", Payload: "c"})
+	assert.Equal(t, model.Delta{Position: "queue:4", Payload: "c"}, <-stream)
+}
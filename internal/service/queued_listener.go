@@ -0,0 +1,166 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"pg-to-es/internal/contract"
+	"pg-to-es/internal/logging"
+	"pg-to-es/internal/model"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// queuePositionPrefix marks the positions of the deltas streamed by a QueuedListener, as opposed to the
+// ones of the listener it wraps
+const queuePositionPrefix = "queue:"
+
+// QueuedListener appends every delta of a listener to a DiskQueue as soon as received, acknowledging it to
+// the listener once synced to disk, and streams them from the queue. Deltas not indexed yet thus survive
+// restarts & elasticsearch outages, & are replayed in order. Positions are the ones of the queue
+type QueuedListener struct {
+	listener contract.DbListener
+	queue    *DiskQueue
+	// cancels the reads of the queue
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	logger    *slog.Logger
+}
+
+func NewQueuedListener(listener contract.DbListener, queue *DiskQueue, logger *slog.Logger) *QueuedListener {
+	return &QueuedListener{listener: listener, queue: queue, cancel: func() {}, logger: logger}
+}
+
+func (l *QueuedListener) Prepare(ctx context.Context) error {
+	return l.listener.Prepare(ctx)
+}
+
+// Start streams the deltas queued after from, a position of the queue, & then the ones received from now on.
+// The listener resumes after the last delta queued. Any other position, such as the one of a backfill, drops
+// every delta queued for the listener to resume from it
+func (l *QueuedListener) Start(ctx context.Context, from string) (<-chan model.Delta, error) {
+	if seq, ok := parseQueuePosition(from); ok {
+		err := l.queue.Ack(seq)
+		if err != nil {
+			return nil, err
+		}
+	} else if from != "" {
+		err := l.queue.Reset(from)
+		if err != nil {
+			return nil, err
+		}
+	}
+	deltaStream, err := l.listener.Start(ctx, l.queue.Position())
+	if err != nil {
+		return nil, err
+	}
+	ctx, l.cancel = context.WithCancel(ctx)
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		l.append(ctx, deltaStream)
+	}()
+
+	stream := make(chan model.Delta)
+	records := l.queue.Read(ctx, l.queue.Acked())
+	go func() {
+		defer close(stream)
+		for rec := range records {
+			// left by Reset
+			if rec.Payload == "" {
+				continue
+			}
+			select {
+			case stream <- model.Delta{Position: queuePosition(rec.Seq), Payload: rec.Payload}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return stream, nil
+}
+
+// append queues every delta of deltaStream, retrying until appended or stopped
+func (l *QueuedListener) append(ctx context.Context, deltaStream <-chan model.Delta) {
+	for {
+		var delta model.Delta
+		select {
+		case d, ok := <-deltaStream:
+			if !ok {
+				return
+			}
+			delta = d
+		case <-ctx.Done():
+			return
+		}
+		for {
+			_, err := l.queue.Append(delta.Position, delta.Payload)
+			if err == nil {
+				break
+			}
+			l.logger.Error("queue.Append() failed, retrying", logging.Err(err))
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return
+			}
+		}
+		if delta.Position == "" {
+			continue
+		}
+		err := l.listener.Ack(ctx, delta.Position)
+		if err != nil {
+			l.logger.Warn("listener.Ack() failed", logging.Position, delta.Position, logging.Err(err))
+		}
+	}
+}
+
+// Ack acknowledges every delta queued up to & including position, compacting the queue
+func (l *QueuedListener) Ack(ctx context.Context, position string) error {
+	seq, ok := parseQueuePosition(position)
+	if !ok {
+		return fmt.Errorf("invalid queue position '%s'", position)
+	}
+	return l.queue.Ack(seq)
+}
+
+func (l *QueuedListener) Gaps() <-chan model.Gap {
+	return l.listener.Gaps()
+}
+
+// Connected reports whether the listener wrapped is, when holding a connection to its source
+func (l *QueuedListener) Connected() bool {
+	if c, ok := l.listener.(contract.Connection); ok {
+		return c.Connected()
+	}
+	return true
+}
+
+// Depth returns the number of deltas queued & not acknowledged yet
+func (l *QueuedListener) Depth() int {
+	return l.queue.Len()
+}
+
+// Stop the listener & the stream of the queue, deltas queued & not acknowledged are streamed anew by Start
+func (l *QueuedListener) Stop() {
+	l.closeOnce.Do(func() {
+		l.listener.Stop()
+		l.cancel()
+		l.wg.Wait()
+	})
+}
+
+func queuePosition(seq uint64) string {
+	return queuePositionPrefix + strconv.FormatUint(seq, 10)
+}
+
+func parseQueuePosition(position string) (uint64, bool) {
+	if !strings.HasPrefix(position, queuePositionPrefix) {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(strings.TrimPrefix(position, queuePositionPrefix), 10, 64)
+	return seq, err == nil
+}
@@ -0,0 +1,518 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"pg-to-es/internal/config"
+	"pg-to-es/internal/logging"
+	"pg-to-es/internal/metrics"
+	"pg-to-es/internal/model"
+	"pg-to-es/internal/tracing"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tables published to the replication slot
+var replicatedTables = []string{"users", "projects", "hashtags", "project_hashtags", "user_projects"}
+
+// documentQuery builds the same denormalized payload notify_trigger() builds, a row per document
+// affected, filtered per table by documentFilters
+const documentQuery = `SELECT json_agg(json_build_object(
+	'user_id', U.id,
+	'user_name', U.name,
+	'user_created_at', U.created_at,
+	'project_id', P.id,
+	'project_name', P.name,
+	'project_slug', P.slug,
+	'project_description', P.description,
+	'project_created_at', P.created_at,
+	'hashtag_id', H.id,
+	'hashtag_name', H.name,
+	'hashtag_created_at', H.created_at,
+	'operation', $1::text,
+	'table', $2::text
+) ORDER BY U.id, P.id, H.id)
+FROM users U
+	LEFT JOIN user_projects UP ON U.id = UP.user_id AND $2::text != 'users'
+	LEFT JOIN projects P ON UP.project_id = P.id
+	LEFT JOIN project_hashtags PH ON P.id = PH.project_id AND $2::text != 'projects'
+	LEFT JOIN hashtags H ON PH.hashtag_id = H.id
+WHERE %s`
+
+type documentFilter struct {
+	where   string
+	columns []string
+}
+
+var documentFilters = map[string]documentFilter{
+	"users":            {"U.id = $3", []string{"id"}},
+	"projects":         {"P.id = $3", []string{"id"}},
+	"hashtags":         {"H.id = $3", []string{"id"}},
+	"project_hashtags": {"PH.hashtag_id = $3 AND PH.project_id = $4", []string{"hashtag_id", "project_id"}},
+	"user_projects":    {"UP.project_id = $3 AND UP.user_id = $4", []string{"project_id", "user_id"}},
+}
+
+// ReplicationListener streams changes from a logical replication slot (pgoutput plugin).
+// Unlike DbListener, changes committed while the pipeline is down are retained by the slot
+// and delivered once it is back up. The slot is only advanced past a transaction once
+// all of its deltas are acknowledged.
+type ReplicationListener struct {
+	cfg config.Pg
+	db  *sql.DB
+	// tables published when rows are streamed raw, nil for the payload of notify_trigger()
+	tables      []string
+	decoder     *pgoutputDecoder
+	deltaStream chan model.Delta
+	quit        chan struct{}
+	closeOnce   sync.Once
+	// whether the last poll succeeded
+	connected atomic.Bool
+	logger    *slog.Logger
+	// cursor is the position of the last delta handed over, touched by listen() only
+	cursor replicationPosition
+
+	mu sync.Mutex
+	// number of deltas of each transaction handed over but not yet released, by commit lsn
+	txLen     map[uint64]int
+	acked     replicationPosition
+	confirmed uint64
+}
+
+// replicationPosition locates a delta by the commit lsn of its transaction & its index within it
+type replicationPosition struct {
+	commit uint64
+	index  int
+	// snapshot a backfill was taken at, transactions it sees are skipped
+	snapshot *pgSnapshot
+}
+
+func (p replicationPosition) String() string {
+	s := fmt.Sprintf("%s:%d", formatLSN(p.commit), p.index)
+	if p.snapshot != nil {
+		s += " snapshot:" + p.snapshot.String()
+	}
+	return s
+}
+
+func (p replicationPosition) after(q replicationPosition) bool {
+	return p.commit > q.commit || (p.commit == q.commit && p.index > q.index)
+}
+
+// parseReplicationPosition parses positions as formatted by replicationPosition.String
+func parseReplicationPosition(s string) (replicationPosition, error) {
+	var p replicationPosition
+	if s == "" {
+		return p, nil
+	}
+	s, snapshot, found := strings.Cut(s, " snapshot:")
+	if found {
+		lsn, rest, ok := strings.Cut(snapshot, ":")
+		if !ok {
+			return p, fmt.Errorf("invalid position snapshot '%s'", snapshot)
+		}
+		snap, err := parsePgSnapshot(lsn, rest)
+		if err != nil {
+			return p, err
+		}
+		p.snapshot = &snap
+	}
+	idx := strings.LastIndex(s, ":")
+	if idx < 0 {
+		return p, fmt.Errorf("invalid position '%s'", s)
+	}
+	commit, err := parseLSN(s[:idx])
+	if err != nil {
+		return p, err
+	}
+	p.index, err = strconv.Atoi(s[idx+1:])
+	if err != nil {
+		return p, fmt.Errorf("invalid position '%s', err: %w", s, err)
+	}
+	p.commit = commit
+	return p, nil
+}
+
+// skips reports whether the change at pos of transaction xid was already handed over,
+// either before the cursor or as part of the backfill snapshot
+func (p replicationPosition) skips(pos replicationPosition, xid uint32) bool {
+	if p.snapshot != nil && p.snapshot.visible(xid, pos.commit) {
+		return true
+	}
+	return !pos.after(p)
+}
+
+// Initialize Replication Listener. Rows of tables are streamed as changed, along with their table
+// & operation, when tables is set, else deltas are built the way notify_trigger() builds them
+func NewReplicationListener(cfg config.Pg, tables []string, logger *slog.Logger) (*ReplicationListener, error) {
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &ReplicationListener{
+		cfg:         cfg,
+		db:          db,
+		tables:      tables,
+		decoder:     newPgoutputDecoder(),
+		deltaStream: make(chan model.Delta),
+		quit:        make(chan struct{}),
+		txLen:       map[uint64]int{},
+		logger:      logger,
+	}, nil
+}
+
+// Start streaming changes from the replication slot after position from,
+// creating the publication & slot if required
+func (l *ReplicationListener) Start(ctx context.Context, from string) (<-chan model.Delta, error) {
+	cursor, err := parseReplicationPosition(from)
+	if err != nil {
+		return nil, err
+	}
+	err = l.Prepare(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var confirmed string
+	err = l.db.QueryRowContext(ctx, "SELECT confirmed_flush_lsn::text FROM pg_replication_slots WHERE slot_name = $1",
+		l.cfg.ReplicationSlot).Scan(&confirmed)
+	if err != nil {
+		return nil, fmt.Errorf("confirmed_flush_lsn lookup failed, err: %w", err)
+	}
+	l.confirmed, err = parseLSN(confirmed)
+	if err != nil {
+		return nil, err
+	}
+	l.cursor, l.acked = cursor, cursor
+	go l.listen(ctx)
+	return l.deltaStream, nil
+}
+
+// Prepare creates the publication & slot if required, the slot retains every change committed from then on
+func (l *ReplicationListener) Prepare(ctx context.Context) error {
+	err := l.ensurePublication(ctx)
+	if err != nil {
+		return err
+	}
+	return l.ensureSlot(ctx)
+}
+
+// Ack acknowledges every delta up to & including position, advancing the slot
+// past every transaction acknowledged completely
+func (l *ReplicationListener) Ack(ctx context.Context, position string) error {
+	pos, err := parseReplicationPosition(position)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	if pos.after(l.acked) {
+		l.acked = replicationPosition{commit: pos.commit, index: pos.index}
+	}
+	l.mu.Unlock()
+	return l.release(ctx)
+}
+
+// Gaps is nil, the slot retains every change until acknowledged
+func (l *ReplicationListener) Gaps() <-chan model.Gap {
+	return nil
+}
+
+// Stop streaming
+func (l *ReplicationListener) Stop() {
+	l.closeOnce.Do(func() {
+		close(l.quit)
+		l.db.Close()
+	})
+}
+
+// release advances the slot past the longest run of completely acknowledged transactions
+func (l *ReplicationListener) release(ctx context.Context) error {
+	l.mu.Lock()
+	ends := make([]uint64, 0, len(l.txLen))
+	for end := range l.txLen {
+		ends = append(ends, end)
+	}
+	sort.Slice(ends, func(i, j int) bool { return ends[i] < ends[j] })
+	target := l.confirmed
+	for _, end := range ends {
+		n := l.txLen[end]
+		if n > 0 && (replicationPosition{commit: end, index: n - 1}).after(l.acked) {
+			break
+		}
+		delete(l.txLen, end)
+		target = end
+	}
+	advance := target > l.confirmed
+	l.mu.Unlock()
+	if !advance {
+		return nil
+	}
+	_, err := l.db.ExecContext(ctx, "SELECT pg_replication_slot_advance($1, $2::pg_lsn)", l.cfg.ReplicationSlot, formatLSN(target))
+	if err != nil {
+		return fmt.Errorf("pg_replication_slot_advance() failed, lsn: %s, err: %w", formatLSN(target), err)
+	}
+	l.mu.Lock()
+	if target > l.confirmed {
+		l.confirmed = target
+	}
+	l.mu.Unlock()
+	return nil
+}
+
+// ensurePublication creates the publication, or adds the tables it misses to it
+func (l *ReplicationListener) ensurePublication(ctx context.Context) error {
+	tables := l.tables
+	if tables == nil {
+		tables = replicatedTables
+	}
+	rows, err := l.db.QueryContext(ctx, "SELECT tablename FROM pg_publication_tables WHERE pubname = $1",
+		l.cfg.ReplicationPublication)
+	if err != nil {
+		return fmt.Errorf("pg_publication_tables lookup failed, err: %w", err)
+	}
+	published := map[string]bool{}
+	for rows.Next() {
+		var table string
+		err = rows.Scan(&table)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("rows.Scan() failed, err: %w", err)
+		}
+		published[table] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("rows.Err(), err: %w", err)
+	}
+	var exists bool
+	err = l.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = $1)",
+		l.cfg.ReplicationPublication).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("pg_publication lookup failed, err: %w", err)
+	}
+	var missing []string
+	for _, table := range tables {
+		if !published[table] {
+			// identifiers can not be parameterized
+			missing = append(missing, pq.QuoteIdentifier(table))
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	verb, clause := "CREATE", "FOR TABLE"
+	if exists {
+		verb, clause = "ALTER", "ADD TABLE"
+	}
+	_, err = l.db.ExecContext(ctx, fmt.Sprintf("%s PUBLICATION %s %s %s", verb,
+		pq.QuoteIdentifier(l.cfg.ReplicationPublication), clause, strings.Join(missing, ", ")))
+	if err != nil {
+		return fmt.Errorf("%s PUBLICATION failed, err: %w", verb, err)
+	}
+	return nil
+}
+
+func (l *ReplicationListener) ensureSlot(ctx context.Context) error {
+	var exists bool
+	err := l.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = $1)",
+		l.cfg.ReplicationSlot).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("pg_replication_slots lookup failed, err: %w", err)
+	}
+	if exists {
+		return nil
+	}
+	_, err = l.db.ExecContext(ctx, "SELECT pg_create_logical_replication_slot($1, 'pgoutput')", l.cfg.ReplicationSlot)
+	if err != nil {
+		return fmt.Errorf("pg_create_logical_replication_slot() failed, err: %w", err)
+	}
+	return nil
+}
+
+// Connected reports whether the last poll succeeded
+func (l *ReplicationListener) Connected() bool {
+	return l.connected.Load()
+}
+
+func (l *ReplicationListener) listen(ctx context.Context) {
+	defer close(l.deltaStream)
+	ticker := time.NewTicker(l.cfg.ReplicationPollInterval)
+	defer ticker.Stop()
+	for {
+		n, err := l.poll(ctx)
+		l.connected.Store(err == nil)
+		if err != nil {
+			l.logger.Error("replication poll failed", logging.Err(err))
+		}
+		lag, err := l.lag(ctx)
+		if err == nil {
+			metrics.ReplicationLagBytes.Set(lag)
+		} else if ctx.Err() == nil {
+			l.logger.Warn("replication lag failed", logging.Err(err))
+		}
+		if n > 0 {
+			// slot may have more changes queued, poll again right away
+			continue
+		}
+		select {
+		case <-ticker.C:
+		case <-l.quit:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// lag returns the WAL written past the position the slot was confirmed at, in bytes
+func (l *ReplicationListener) lag(ctx context.Context) (float64, error) {
+	var lag float64
+	err := l.db.QueryRowContext(ctx,
+		"SELECT COALESCE(pg_wal_lsn_diff(pg_current_wal_lsn(), confirmed_flush_lsn), 0) FROM pg_replication_slots WHERE slot_name = $1",
+		l.cfg.ReplicationSlot).Scan(&lag)
+	if err != nil {
+		return 0, fmt.Errorf("querying slot lag failed, err: %w", err)
+	}
+	return lag, nil
+}
+
+// poll peeks a batch of changes from the slot & hands over every change past the cursor,
+// returns the number of deltas handed over
+func (l *ReplicationListener) poll(ctx context.Context) (int, error) {
+	rows, err := l.db.QueryContext(ctx,
+		"SELECT lsn::text, data FROM pg_logical_slot_peek_binary_changes($1, NULL, $2, 'proto_version', '1', 'publication_names', $3)",
+		l.cfg.ReplicationSlot, l.cfg.ReplicationBatchSize, l.cfg.ReplicationPublication)
+	if err != nil {
+		return 0, fmt.Errorf("pg_logical_slot_peek_binary_changes() failed, err: %w", err)
+	}
+	type message struct {
+		lsn  string
+		data []byte
+	}
+	var messages []message
+	for rows.Next() {
+		var m message
+		err = rows.Scan(&m.lsn, &m.data)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("rows.Scan() failed, err: %w", err)
+		}
+		messages = append(messages, m)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("rows.Err(), err: %w", err)
+	}
+
+	delivered := 0
+	var changes []*rowChange
+	for _, m := range messages {
+		if len(m.data) == 0 || m.data[0] != pgoutputCommit {
+			change, err := l.decoder.Decode(m.data)
+			if err != nil {
+				return delivered, fmt.Errorf("decoder.Decode() failed, lsn: %s, err: %w", m.lsn, err)
+			}
+			if change != nil {
+				changes = append(changes, change)
+			}
+			continue
+		}
+		// transaction complete, its commit lsn positions all of its changes
+		commit, err := parseLSN(m.lsn)
+		if err != nil {
+			return delivered, err
+		}
+		xid := l.decoder.xid
+		l.mu.Lock()
+		if l.cursor.snapshot != nil && l.cursor.snapshot.visible(xid, commit) {
+			// covered by the backfill, nothing to acknowledge
+			l.txLen[commit] = 0
+		} else {
+			l.txLen[commit] = len(changes)
+		}
+		l.mu.Unlock()
+		for idx, change := range changes {
+			pos := replicationPosition{commit: commit, index: idx}
+			if l.cursor.skips(pos, xid) {
+				continue
+			}
+			if l.cursor.snapshot != nil && commit <= l.cursor.snapshot.lsn {
+				// snapshot keeps filtering until every transaction it may see has passed
+				pos.snapshot = l.cursor.snapshot
+			}
+			payload, err := l.delta(ctx, change, xid)
+			if err != nil {
+				return delivered, fmt.Errorf("building delta failed, position: %s, err: %w", pos, err)
+			}
+			delta := model.Delta{Position: pos.String(), Payload: payload}
+			// spans the receipt of the change up to its hand over
+			_, span := tracing.Start(ctx, "replication.receive", trace.WithAttributes(tracing.Delta(delta)...))
+			select {
+			case l.deltaStream <- delta:
+				span.End()
+				l.cursor = pos
+				delivered++
+			case <-l.quit:
+				span.End()
+				return delivered, nil
+			case <-ctx.Done():
+				span.End()
+				return delivered, nil
+			}
+		}
+		changes = nil
+	}
+	// transactions without any changes of interest are released right away
+	return delivered, l.release(ctx)
+}
+
+// delta renders a row change of transaction xid in the format produced by notify_trigger(), or raw when
+// tables are set
+func (l *ReplicationListener) delta(ctx context.Context, change *rowChange, xid uint32) (string, error) {
+	var payload json.RawMessage
+	if change.operation == "DELETE" || l.tables != nil {
+		b, err := json.Marshal(change.row)
+		if err != nil {
+			return "", err
+		}
+		payload = b
+	} else {
+		filter, ok := documentFilters[change.table]
+		if !ok {
+			return "", fmt.Errorf("table '%s' is not supported", change.table)
+		}
+		args := []interface{}{change.operation, change.table}
+		for _, column := range filter.columns {
+			args = append(args, change.row[column])
+		}
+		// the row may have been changed again or deleted since, in which case
+		// a later change carries the state we are after
+		var document sql.NullString
+		err := l.db.QueryRowContext(ctx, fmt.Sprintf(documentQuery, filter.where), args...).Scan(&document)
+		if err != nil && err != sql.ErrNoRows {
+			return "", fmt.Errorf("document query failed, err: %w", err)
+		}
+		payload = json.RawMessage("null")
+		if document.Valid {
+			payload = json.RawMessage(document.String)
+		}
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"operation": change.operation,
+		"table":     change.table,
+		"txid":      xid,
+		"payload":   payload,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplicationPosition(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    replicationPosition
+		wantErr bool
+	}{
+		{name: "empty position should be the earliest", in: "", want: replicationPosition{}},
+		{name: "valid position should parse", in: "16/B374D848:2", want: replicationPosition{commit: 0x16B374D848, index: 2}},
+		{name: "missing index should fail", in: "16/B374D848", wantErr: true},
+		{name: "invalid index should fail", in: "16/B374D848:x", wantErr: true},
+		{
+			name: "snapshot position should parse",
+			in:   "0/0:0 snapshot:16/C0000000:750:760:752,755",
+			want: replicationPosition{snapshot: &pgSnapshot{
+				lsn: 0x16C0000000, xmin: 750, xmax: 760, xip: map[uint32]bool{752: true, 755: true},
+			}},
+		},
+		{name: "invalid snapshot should fail", in: "0/0:0 snapshot:16/C0000000:750", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseReplicationPosition(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseReplicationPosition() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				assert.Equal(t, tt.want, got)
+			}
+			if !tt.wantErr && tt.in != "" {
+				assert.Equal(t, tt.in, got.String(), "position must round trip")
+			}
+		})
+	}
+	assert.True(t, replicationPosition{commit: 2}.after(replicationPosition{commit: 1, index: 5}), "later commit must come after")
+	assert.True(t, replicationPosition{commit: 2, index: 1}.after(replicationPosition{commit: 2}), "later index must come after")
+	assert.False(t, replicationPosition{commit: 2, index: 1}.after(replicationPosition{commit: 2, index: 1}), "position must not come after itself")
+}
+
+func TestPgSnapshot_visible(t *testing.T) {
+	snap, err := parsePgSnapshot("16/C0000000", "750:760:752,755")
+	assert.NoError(t, err)
+	tests := []struct {
+		name   string
+		xid    uint32
+		commit uint64
+		want   bool
+	}{
+		{name: "xid before xmin should be visible", xid: 700, commit: 0x16B0000000, want: true},
+		{name: "xid between xmin & xmax should be visible", xid: 751, commit: 0x16B0000000, want: true},
+		{name: "xid in progress should not be visible", xid: 752, commit: 0x16B0000000, want: false},
+		{name: "xid at xmax should not be visible", xid: 760, commit: 0x16B0000000, want: false},
+		{name: "commit past snapshot should not be visible", xid: 700, commit: 0x16D0000000, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, snap.visible(tt.xid, tt.commit))
+		})
+	}
+
+	cursor := replicationPosition{snapshot: &snap}
+	assert.True(t, cursor.skips(replicationPosition{commit: 0x16B0000000}, 751), "changes seen by the snapshot must be skipped")
+	assert.False(t, cursor.skips(replicationPosition{commit: 0x16B0000000}, 752), "changes unseen by the snapshot must be handed over")
+}
@@ -0,0 +1,137 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"pg-to-es/internal/config"
+	"pg-to-es/internal/model"
+	"pg-to-es/internal/route"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentation names the tracer every span is started by
+const instrumentation = "pg-to-es"
+
+// Attributes a change is followed by, from the listener receiving it to elasticsearch
+const (
+	// TxID is the id of the postgres transaction the change was committed by
+	TxID = attribute.Key("pg.txid")
+	// Position is the position of the delta in its source: an outbox event id, an LSN, a queue or bus sequence
+	Position  = attribute.Key("pg_to_es.position")
+	Table     = attribute.Key("pg.table")
+	Operation = attribute.Key("pg.operation")
+	Index     = attribute.Key("es.index")
+	DocID     = attribute.Key("es.doc_id")
+)
+
+// Attributes of the processing of deltas
+const (
+	// Attempts is the number of attempts made at applying or flushing deltas
+	Attempts = attribute.Key("pg_to_es.attempts")
+	// Deltas is the number of deltas flushed at once
+	Deltas = attribute.Key("pg_to_es.deltas")
+	// Documents is the number of documents written or read at once
+	Documents = attribute.Key("pg_to_es.documents")
+)
+
+// Setup exports the spans of service over OTLP/HTTP to cfg.Endpoint, spans are dropped when no endpoint is
+// set. The returned func flushes the spans not exported yet & stops exporting
+func Setup(ctx context.Context, cfg config.Tracing, service string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("otlptracehttp.New() failed, err: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(service)))
+	if err != nil {
+		return nil, fmt.Errorf("resource.Merge() failed, err: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Start starts a span of name, a child of the span of ctx if any
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, opts...)
+}
+
+// Fail records err on span, marking it as failed, unless err is nil
+func Fail(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// End ends span, as failed with err if any
+func End(span trace.Span, err error) {
+	Fail(span, err)
+	span.End()
+}
+
+// Delta returns the attributes of delta following it end to end: the transaction it was committed by, its
+// position, table & operation, the ones delta does not carry are left out
+func Delta(delta model.Delta) []attribute.KeyValue {
+	var e struct {
+		TxID      *int64 `json:"txid"`
+		Table     string `json:"table"`
+		Operation string `json:"operation"`
+	}
+	json.Unmarshal([]byte(delta.Payload), &e)
+	var attrs []attribute.KeyValue
+	if e.TxID != nil {
+		attrs = append(attrs, TxID.Int64(*e.TxID))
+	}
+	if delta.Position != "" {
+		attrs = append(attrs, Position.String(delta.Position))
+	}
+	if e.Table != "" {
+		attrs = append(attrs, Table.String(e.Table))
+	}
+	if e.Operation != "" {
+		attrs = append(attrs, Operation.String(e.Operation))
+	}
+	return attrs
+}
+
+// Middleware traces requests by the route they matched, continuing the trace of the caller if any
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		template := route.Template(r)
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := Start(ctx, r.Method+" "+template,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(template),
+				semconv.URLPath(r.URL.Path),
+			))
+		defer span.End()
+		rec := route.NewStatusRecorder(w)
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.Status))
+		if rec.Status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.Status))
+		}
+	})
+}
@@ -0,0 +1,79 @@
+package tracing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"pg-to-es/internal/model"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+func TestDelta(t *testing.T) {
+	tests := []struct {
+		name  string
+		delta model.Delta
+		want  []attribute.KeyValue
+	}{
+		{
+			name:  "notified changes should be followed by transaction",
+			delta: model.Delta{Payload: `{"operation":"UPDATE","table":"users","txid":4242,"payload":{}}`},
+			want:  []attribute.KeyValue{TxID.Int64(4242), Table.String("users"), Operation.String("UPDATE")},
+		},
+		{
+			name:  "outbox events should be followed by id too",
+			delta: model.Delta{Position: "17", Payload: `{"operation":"DELETE","table":"projects","txid":4243,"payload":{}}`},
+			want:  []attribute.KeyValue{TxID.Int64(4243), Position.String("17"), Table.String("projects"), Operation.String("DELETE")},
+		},
+		{
+			name:  "changes predating transaction ids should be followed by position",
+			delta: model.Delta{Position: "0/16B3748:0", Payload: `{"operation":"INSERT","table":"users","payload":{}}`},
+			want:  []attribute.KeyValue{Position.String("0/16B3748:0"), Table.String("users"), Operation.String("INSERT")},
+		},
+		{
+			name:  "undecodable payloads should carry nothing",
+			delta: model.Delta{Payload: `not json`},
+			want:  nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Delta(tt.delta))
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(prev)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/search/user/{userID}", func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["userID"] == "x" {
+			http.Error(w, "failed", http.StatusInternalServerError)
+		}
+	}).Methods("GET")
+	r.Use(Middleware)
+	for _, target := range []string{"/search/user/1", "/search/user/x"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+
+	spans := exporter.GetSpans()
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+	assert.Equal(t, "GET /search/user/{userID}", spans[0].Name, "requests must be traced by route rather than path")
+	assert.Contains(t, spans[0].Attributes, semconv.URLPath("/search/user/1"))
+	assert.Contains(t, spans[0].Attributes, semconv.HTTPResponseStatusCode(http.StatusOK))
+	assert.Equal(t, codes.Unset, spans[0].Status.Code)
+	assert.Equal(t, codes.Error, spans[1].Status.Code, "requests failing must be traced as failed")
+}